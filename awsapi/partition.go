@@ -0,0 +1,21 @@
+// Package awsapi は、AWS を扱う各ツールで共通の処理をまとめたもの。
+package awsapi
+
+import "strings"
+
+// PartitionForRegion は、リージョン名から AWS パーティションを判定する
+// (us-gov-west-1 → aws-us-gov、cn-north-1 → aws-cn など)
+func PartitionForRegion(region string) string {
+	switch {
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	case strings.HasPrefix(region, "cn-"):
+		return "aws-cn"
+	case strings.HasPrefix(region, "us-isob-"):
+		return "aws-iso-b"
+	case strings.HasPrefix(region, "us-iso-"):
+		return "aws-iso"
+	default:
+		return "aws"
+	}
+}
@@ -0,0 +1,20 @@
+package awsapi
+
+import "testing"
+
+func TestPartitionForRegion(t *testing.T) {
+	tests := map[string]string{
+		"ap-northeast-1": "aws",
+		"us-east-1":      "aws",
+		"us-gov-west-1":  "aws-us-gov",
+		"cn-north-1":     "aws-cn",
+		"us-iso-east-1":  "aws-iso",
+		"us-isob-east-1": "aws-iso-b",
+		"":               "aws",
+	}
+	for region, want := range tests {
+		if got := PartitionForRegion(region); got != want {
+			t.Errorf("PartitionForRegion(%q) = %q, want %q", region, got, want)
+		}
+	}
+}
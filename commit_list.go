@@ -1,19 +1,25 @@
 package main
 
 import (
-	"encoding/csv"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	// ↓↓↓ ここのタイポを修正しました ↓↓↓
-	"github.com/joho/godotenv" 
+	"github.com/google/go-github/v63/github"
+
+	"securityhub-exporter/envfile"
+	"securityhub-exporter/heartbeat"
+	"securityhub-exporter/githubapi"
+	"securityhub-exporter/report"
 )
 
 // .env から読み込む設定を格納する構造体
@@ -22,163 +28,362 @@ type Config struct {
 	GitHubOwner string
 	SinceDate   string
 	UntilDate   string
-	TargetRepos []string
+	TargetRepos []string // 空の場合は GitHubOwner の全リポジトリを対象にする (discoverRepos を参照)
+	Sort        string // "date" の場合は全リポジトリを通して新しい順に並べる
+	Mode        string // "prs" の場合はコミットの代わりにマージ済みプルリクエストを取得する
+	// 指定した場合は、既定のブランチの代わりにこのブランチのコミットを取得する
+	Branch string
+	// true の場合は、親コミットが2つ以上あるマージコミットを出力しない
+	ExcludeMerges bool
+	// true の場合は、コミットごとに詳細 API を呼び出して変更行数 (追加・削除・合計) を取得する
+	FetchStats bool
+	// true の場合は、commits.csv の代わりにリポジトリごとの commits_<リポジトリ名>.csv に出力する
+	SplitByRepo bool
+	// true の場合は、コミットごとにそのコミットを含むプルリクエストの番号を取得する
+	FetchPRs bool
+	// true の場合は、コミットメッセージの改行 (CR/LF) を空白に置き換えて1行にする
+	FlattenMessage bool
+	// true の場合は、コミットメッセージの1行目 (件名) だけを出力する (FlattenMessage より優先)
+	FirstLineOnly bool
+	// 指定した場合は、この作成者 (GitHub ログイン名またはメールアドレス) のコミットのみ取得する
+	Author string
+	// true の場合は、リポジトリを自動検出するときにアーカイブ済みのリポジトリを除外する
+	ExcludeArchived bool
 }
 
 // .env ファイルを読み込み、設定を構造体として返す
 func loadConfig() Config {
-	err := godotenv.Load()
+	if err := envfile.Load(); err != nil {
+		log.Fatalf("エラー: %v", err)
+	}
+
+	// TARGET_REPOS が未設定または "*" の場合は、対象のリポジトリを API から自動で検出する
+	var targetRepos []string
+	if reposStr := os.Getenv("TARGET_REPOS"); reposStr != "" && reposStr != "*" {
+		targetRepos = strings.Split(reposStr, ",")
+	}
+
+	sinceDate, err := normalizeDate(os.Getenv("SINCE_DATE"), false)
+	if err != nil {
+		log.Fatalf("エラー: SINCE_DATE が不正です: %v", err)
+	}
+	untilDate, err := normalizeDate(os.Getenv("UNTIL_DATE"), true)
 	if err != nil {
-		log.Println("警告: .env ファイルの読み込みに失敗しました。環境変数を直接使用します。")
+		log.Fatalf("エラー: UNTIL_DATE が不正です: %v", err)
+	}
+	if sinceDate != "" && untilDate != "" && sinceDate > untilDate {
+		log.Fatalf("エラー: SINCE_DATE (%s) が UNTIL_DATE (%s) より後になっています。", sinceDate, untilDate)
 	}
 
-	reposStr := os.Getenv("TARGET_REPOS")
-	if reposStr == "" {
-		log.Fatal("エラー: .env に TARGET_REPOS が設定されていません。")
+	// MODE の指定ミスでコミットの取得に黙って切り替わらないよう、未知の値はエラーにする
+	mode := os.Getenv("MODE")
+	if mode != "" && mode != "prs" {
+		log.Fatalf("エラー: MODE は prs のみ指定できます (指定値: %s)", mode)
 	}
 
 	return Config{
 		GitHubToken: os.Getenv("GITHUB_TOKEN"),
 		GitHubOwner: os.Getenv("GITHUB_OWNER"),
-		SinceDate:   os.Getenv("SINCE_DATE"),
-		UntilDate:   os.Getenv("UNTIL_DATE"),
-		TargetRepos: strings.Split(reposStr, ","),
+		SinceDate:   sinceDate,
+		UntilDate:   untilDate,
+		TargetRepos: targetRepos,
+		Sort:        os.Getenv("SORT"),
+		Mode:        mode,
+
+		ExcludeArchived: os.Getenv("EXCLUDE_ARCHIVED") == "true",
+		Author:          os.Getenv("AUTHOR_LOGIN"),
+		ExcludeMerges:   os.Getenv("EXCLUDE_MERGES") == "true",
+		Branch:          os.Getenv("BRANCH"),
+		FetchStats:      os.Getenv("FETCH_STATS") == "true",
+		FetchPRs:        os.Getenv("FETCH_PRS") == "true",
+		SplitByRepo:     os.Getenv("SPLIT_BY_REPO") == "true",
+		FlattenMessage:  os.Getenv("FLATTEN_MESSAGE") == "true",
+		FirstLineOnly:   os.Getenv("FIRST_LINE_ONLY") == "true",
 	}
 }
 
-// checkTokenAndOrg は、指定されたトークンと組織名が有効かを確認する
-func checkTokenAndOrg(token, owner string) error {
-	if token == "" {
-		return fmt.Errorf("GITHUB_TOKEN が設定されていません。")
-	}
-	if owner == "" {
-		return fmt.Errorf("GITHUB_OWNER が設定されていません。")
+// normalizeDate は、SINCE_DATE/UNTIL_DATE の値 (RFC3339 または YYYY-MM-DD) を解析し、
+// API に渡す UTC の RFC3339 形式に揃える。YYYY-MM-DD の場合、endOfDay が true なら
+// その日の終わり (23:59:59)、false なら始まり (00:00:00) とする。未設定の場合は空文字を返す
+func normalizeDate(value string, endOfDay bool) (string, error) {
+	if value == "" {
+		return "", nil
 	}
-
-	fmt.Println("--- トークンと組織名の有効性を確認中... ---")
-
-	apiURL := fmt.Sprintf("https://api.github.com/orgs/%s", owner)
-	req, err := http.NewRequest("GET", apiURL, nil)
+	t, err := time.Parse(time.RFC3339, value)
 	if err != nil {
-		return fmt.Errorf("リクエストの作成に失敗しました: %w", err)
+		day, dayErr := time.Parse(time.DateOnly, value)
+		if dayErr != nil {
+			return "", fmt.Errorf("'%s' は RFC3339 (例: 2024-01-01T00:00:00Z) または YYYY-MM-DD の形式で指定してください", value)
+		}
+		t = day
+		if endOfDay {
+			t = day.Add(24*time.Hour - time.Second)
+		}
 	}
+	return t.UTC().Format(time.RFC3339), nil
+}
 
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Accept", "application/vnd.github.v3+json")
+// isStatus は、API の応答が指定したステータスコードかを返す (応答がない場合は false)
+func isStatus(resp *github.Response, code int) bool {
+	return resp != nil && resp.StatusCode == code
+}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("APIへのリクエストに失敗しました: %w", err)
+// discoverRepos は、GitHubOwner の全リポジトリ名を名前順に返す。
+// 組織として見つからない場合は個人アカウントのリポジトリ一覧を取得する。
+// ExcludeArchived が true の場合はアーカイブ済みのリポジトリを除外する
+func discoverRepos(ctx context.Context, client *github.Client, cfg Config) ([]string, error) {
+	allRepos := []*github.Repository{}
+
+	orgOpt := &github.RepositoryListByOrgOptions{Type: "all", ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		repos, resp, err := client.Repositories.ListByOrg(ctx, cfg.GitHubOwner, orgOpt)
+		if isStatus(resp, http.StatusNotFound) {
+			return discoverUserRepos(ctx, client, cfg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("リポジトリ一覧の取得に失敗しました: %w", err)
+		}
+		allRepos = append(allRepos, repos...)
+		if resp.NextPage == 0 {
+			break
+		}
+		orgOpt.Page = resp.NextPage
 	}
-	defer resp.Body.Close()
+	return repoNames(allRepos, cfg.ExcludeArchived), nil
+}
 
-	switch resp.StatusCode {
-	case http.StatusOK:
-		fmt.Println("✅ トークンと組織名は有効です。")
-		return nil // 成功
-	case http.StatusNotFound:
-		return fmt.Errorf("エラー: 組織名 '%s' が見つからないか、トークンにアクセス権がありません。(Status: 404)", owner)
-	case http.StatusUnauthorized:
-		return fmt.Errorf("エラー: GITHUB_TOKEN が無効です。(Status: 401)")
-	default:
-		return fmt.Errorf("エラー: GitHub APIから予期せぬ応答がありました。(Status: %d)", resp.StatusCode)
+// discoverUserRepos は、個人アカウントが所有するリポジトリ名を名前順に返す
+func discoverUserRepos(ctx context.Context, client *github.Client, cfg Config) ([]string, error) {
+	allRepos := []*github.Repository{}
+
+	userOpt := &github.RepositoryListByUserOptions{Type: "owner", ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		repos, resp, err := client.Repositories.ListByUser(ctx, cfg.GitHubOwner, userOpt)
+		if err != nil {
+			return nil, fmt.Errorf("リポジトリ一覧の取得に失敗しました: %w", err)
+		}
+		allRepos = append(allRepos, repos...)
+		if resp.NextPage == 0 {
+			break
+		}
+		userOpt.Page = resp.NextPage
 	}
+	return repoNames(allRepos, cfg.ExcludeArchived), nil
 }
 
-// GitHub APIのレスポンスを格納する構造体
-type CommitInfo struct {
-	SHA     string `json:"sha"`
-	HTMLURL string `json:"html_url"`
-	Commit  struct {
-		Message string `json:"message"`
-		Author  struct {
-			Date time.Time `json:"date"`
-		} `json:"author"`
-	} `json:"commit"`
+// repoNames は、リポジトリ名を名前順に返す (excludeArchived が true の場合はアーカイブ済みを除く)
+func repoNames(repos []*github.Repository, excludeArchived bool) []string {
+	names := []string{}
+	for _, repo := range repos {
+		if excludeArchived && repo.GetArchived() {
+			continue
+		}
+		names = append(names, repo.GetName())
+	}
+	sort.Strings(names)
+	return names
 }
 
 // CSVに出力する1行のデータを表す構造体
 type CommitRecord struct {
-	RepoName    string
-	CommitDate  string
-	Message     string
-	SHA         string
-	URL         string
+	RepoName           string
+	CommitDate         string
+	Message            string
+	SHA                string
+	URL                string
+	Verified           bool   // 署名が検証済みか
+	VerificationReason string // 検証結果の理由 (valid, unsigned, unknown_key など)
+	AuthorLogin        string // GitHub アカウント (紐付かない場合は unlinked、ghost ユーザーに置き換えられた場合は ghost)
+	AuthorName         string // git に記録された作成者名
+	AuthorEmail        string // git に記録された作成者のメールアドレス
+	// 変更行数 (FETCH_STATS=true の場合のみ。取得できなかった場合は StatsFetched が false)
+	StatsFetched bool
+	Additions    int
+	Deletions    int
+	Total        int
+	// コミットを含むプルリクエストの番号 (FETCH_PRS=true の場合のみ)
+	PRNumbers []int
+}
+
+// 作成者が GitHub アカウントに紐付かない場合の表記
+const (
+	authorUnlinked = "unlinked" // author が null (メールアドレスがどのアカウントにも登録されていない、またはアカウントが削除された)
+	authorGhost    = "ghost"    // アカウントが削除され、GitHub の ghost ユーザーに置き換えられた
+)
+
+// commitAuthorLogin は、コミットの作成者の GitHub ログイン名を返す。
+// 削除済みアカウントのコミットは author が null で返ることが多く、その場合は未登録のメールアドレスと
+// 区別できないため unlinked になる (ghost になるのは GitHub が ghost ユーザーに置き換えた場合のみ)
+func commitAuthorLogin(c *github.RepositoryCommit) string {
+	login := c.GetAuthor().GetLogin()
+	if login == "" {
+		return authorUnlinked
+	}
+	return login
+}
+
+// isUnlinkedAuthor は、作成者が GitHub アカウントに紐付かない (unlinked/ghost) かを返す
+func isUnlinkedAuthor(login string) bool {
+	return login == authorUnlinked || login == authorGhost
+}
+
+// マージ済みプルリクエストのCSV 1行分のデータ
+type MergedPRRecord struct {
+	RepoName       string
+	Number         int
+	Title          string
+	Author         string
+	MergedAt       string
+	BaseBranch     string
+	MergeCommitSHA string
+	URL            string
 }
 
 func main() {
 	cfg := loadConfig()
 
-	if err := checkTokenAndOrg(cfg.GitHubToken, cfg.GitHubOwner); err != nil {
-		log.Fatal(err) 
+	// HEARTBEAT_FILE が設定されていれば、外部監視用に実行状況を定期的に書き込む
+	hb := heartbeat.Start("commit_list")
+	defer hb.Stop()
+
+	if cfg.GitHubToken == "" || cfg.GitHubOwner == "" {
+		log.Fatal("エラー: GITHUB_TOKEN または GITHUB_OWNER が .envファイル、または環境変数で設定されていません。")
+	}
+
+	ctx := context.Background()
+	client, err := githubapi.NewClient(ctx, cfg.GitHubToken)
+	if err != nil {
+		log.Fatalf("エラー: %v", err)
+	}
+
+	// SELF_TEST=true の場合は認証とアクセス権の確認だけを行って終了する
+	if os.Getenv("SELF_TEST") == "true" {
+		if !githubapi.SelfTest(ctx, client, cfg.GitHubOwner, false) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// 終了時に、今回の実行で消費した API リクエスト数と残量を表示する
+	defer func() { fmt.Println(githubapi.DefaultRateUsage.Summary()) }()
+
+	// コミットは個人アカウントのリポジトリからも取得できるため、Organization でない場合も続ける
+	var notOrg *githubapi.NotOrganizationError
+	if err := githubapi.RequireOrganization(ctx, client, cfg.GitHubOwner); errors.As(err, &notOrg) {
+		fmt.Printf("✅ '%s' は個人アカウントです。個人アカウントのリポジトリとしてコミットを取得します。\n", cfg.GitHubOwner)
+	} else if err != nil {
+		log.Fatalf("エラー: %v", err)
+	}
+
+	// CSV_DELIMITER などの CSV 出力設定は、取得を始める前に検証しておく
+	if err := report.OptionsFromEnv().Check(); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(cfg.TargetRepos) == 0 {
+		fmt.Println("--- TARGET_REPOS が未指定のため、対象のリポジトリを検出中... ---")
+		repos, err := discoverRepos(ctx, client, cfg)
+		if err != nil {
+			log.Fatalf("エラー: %v", err)
+		}
+		if len(repos) == 0 {
+			log.Fatalf("エラー: '%s' に対象のリポジトリが見つかりませんでした。", cfg.GitHubOwner)
+		}
+		cfg.TargetRepos = repos
+		fmt.Printf("✅ %d 件のリポジトリを対象にします。", len(repos))
+		if cfg.ExcludeArchived {
+			fmt.Print(" (EXCLUDE_ARCHIVED=true のためアーカイブ済みを除外)")
+		}
+		fmt.Println()
+	}
+
+	if cfg.Mode == "prs" {
+		runMergedPRs(ctx, client, cfg)
+		hb.Complete()
+		return
 	}
 
 	fmt.Println("\n--- 設定値に基づいてコミットの取得を開始します ---")
-	fmt.Printf("OWNER: %s, SINCE: %s, UNTIL: %s\n", cfg.GitHubOwner, cfg.SinceDate, cfg.UntilDate)
+	fmt.Printf("OWNER: %s, SINCE: %s, UNTIL: %s, API: %s, API VERSION: %s\n", cfg.GitHubOwner, cfg.SinceDate, cfg.UntilDate, client.BaseURL, githubapi.APIVersion())
+	if cfg.Author != "" {
+		fmt.Printf("AUTHOR: %s (この作成者のコミットのみ取得します)\n", cfg.Author)
+	}
+	if cfg.ExcludeMerges {
+		fmt.Println("EXCLUDE_MERGES: マージコミットを除外します")
+	}
 	fmt.Println("-------------------------------------------------")
 
-	allCommits := []CommitRecord{}
-	client := &http.Client{}
-
-	for _, repo := range cfg.TargetRepos {
-		repoCommitsFound := 0
-		
-		fmt.Printf("\nリポジトリ '%s' のコミットを取得中...\n", repo)
-		
-		nextURL := fmt.Sprintf("https://api.github.com/repos/%s/%s/commits?since=%s&until=%s&per_page=100", cfg.GitHubOwner, repo, cfg.SinceDate, cfg.UntilDate)
-		
-		for nextURL != "" {
-			req, err := http.NewRequest("GET", nextURL, nil)
-			if err != nil {
-				log.Printf("リクエスト作成エラー (%s): %v\n", repo, err)
-				break
-			}
+	// リポジトリごとの取得結果 (出力順を TARGET_REPOS の順に揃えるため、リポジトリの位置に格納する)
+	type repoResult struct {
+		records []CommitRecord
+		err     error
+	}
+	results := make([]repoResult, len(cfg.TargetRepos))
 
-			req.Header.Set("Authorization", "Bearer "+cfg.GitHubToken)
-			req.Header.Set("Accept", "application/vnd.github.v3+json")
-			req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	// COMMIT_WORKERS で、同時にコミットを取得するリポジトリ数を指定する
+	workerCount := defaultCommitWorkers
+	if value := os.Getenv("COMMIT_WORKERS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			log.Fatalf("エラー: COMMIT_WORKERS は1以上の整数を指定してください (指定値: %s)", value)
+		}
+		workerCount = n
+	}
 
-			resp, err := client.Do(req)
-			if err != nil {
-				log.Printf("リクエスト送信エラー (%s): %v\n", repo, err)
-				break
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workerCount; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				records, err := fetchRepoCommits(ctx, client, cfg, cfg.TargetRepos[i])
+				results[i] = repoResult{records: records, err: err}
 			}
-			defer resp.Body.Close()
+		}()
+	}
+	for i := range cfg.TargetRepos {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
 
-			if resp.StatusCode != http.StatusOK {
-				log.Printf("APIエラー (%s): ステータスコード %d。リポジトリ名を確認してください。\n", repo, resp.StatusCode)
-				break
-			}
-			
-			var commits []CommitInfo
-			if err := json.NewDecoder(resp.Body).Decode(&commits); err != nil {
-				log.Printf("JSONデコードエラー (%s): %v\n", repo, err)
-				break
+	allCommits := []CommitRecord{}
+	// エラーでページ送りが途中で止まり、コミットが欠けている可能性のあるリポジトリと、その理由 (マニフェストに残す)
+	truncatedRepos := []string{}
+	truncatedReasons := make(map[string]string)
+	// GitHub アカウントに紐付かない作成者のコミット数 (メールアドレスとアカウントの対応漏れの調査用)
+	unlinkedCommits := 0
+
+	for i, repo := range cfg.TargetRepos {
+		result := results[i]
+		repoVerified := 0
+		repoUnlinked := 0
+		for _, record := range result.records {
+			if record.Verified {
+				repoVerified++
 			}
-			
-			if len(commits) == 0 && repoCommitsFound == 0 {
-				break
+			if isUnlinkedAuthor(record.AuthorLogin) {
+				repoUnlinked++
 			}
-			
-			repoCommitsFound += len(commits)
-
-			for _, c := range commits {
-				record := CommitRecord{
-					RepoName:    repo,
-					CommitDate:  c.Commit.Author.Date.Format(time.RFC3339),
-					Message:     c.Commit.Message,
-					SHA:         c.SHA,
-					URL:         c.HTMLURL,
-				}
-				allCommits = append(allCommits, record)
-			}
-			
-			nextURL = getNextPageURL(resp.Header.Get("Link"))
 		}
-		fmt.Printf("'%s' の結果: %d 件のコミットが見つかりました。\n", repo, repoCommitsFound)
+		allCommits = append(allCommits, result.records...)
+		unlinkedCommits += repoUnlinked
+
+		fmt.Printf("'%s' (ブランチ: %s) の結果: %d 件のコミットが見つかりました。\n", repo, branchLabel(cfg.Branch), len(result.records))
+		if len(result.records) > 0 {
+			fmt.Printf("  署名検証済み: %d 件 (%.1f%%)\n", repoVerified, float64(repoVerified)*100/float64(len(result.records)))
+		}
+		if repoUnlinked > 0 {
+			fmt.Printf("  アカウントに紐付かない作成者: %d 件\n", repoUnlinked)
+		}
+		if result.err != nil {
+			log.Printf("%v\n", result.err)
+			truncatedRepos = append(truncatedRepos, repo)
+			truncatedReasons[repo] = result.err.Error()
+		}
 	}
-	
+
 	fmt.Println("\n-------------------------------------------------")
 	if len(allCommits) == 0 {
 		fmt.Println("⚠️ 全リポジトリを通してコミットが見つかりませんでした。CSVファイルはヘッダーのみの空ファイルとして出力されます。")
@@ -187,34 +392,445 @@ func main() {
 		fmt.Printf("合計 %d 件のコミットを取得完了。CSVファイルに出力します。\n", len(allCommits))
 	}
 	
-	writeToCSV(allCommits)
+	if unlinkedCommits > 0 {
+		fmt.Printf("GitHub アカウントに紐付かない作成者 (unlinked/ghost) のコミット: %d 件\n", unlinkedCommits)
+	}
+
+	if len(truncatedRepos) > 0 {
+		fmt.Println("\n⚠️⚠️⚠️ 警告: 次のリポジトリはページ送りが途中で止まったため、コミットが欠けている可能性があります (truncated: true)")
+		for _, repo := range truncatedRepos {
+			fmt.Printf("  - %s\n", repo)
+		}
+	}
+
+	if cfg.FetchStats {
+		fmt.Printf("\n%d 件のコミットの変更行数を取得中...\n", len(allCommits))
+		skipped := enrichCommits(allCommits, workerCount, "変更行数", func(record *CommitRecord) error {
+			return fetchCommitStats(ctx, client, cfg, record)
+		})
+		if skipped > 0 {
+			fmt.Printf("⚠️ %d 件のコミットは変更行数を取得できなかったため、空欄で出力します。\n", skipped)
+		}
+	}
+
+	if cfg.FetchPRs {
+		fmt.Printf("\n%d 件のコミットの関連プルリクエストを取得中...\n", len(allCommits))
+		skipped := enrichCommits(allCommits, workerCount, "関連プルリクエスト", func(record *CommitRecord) error {
+			return fetchCommitPRs(ctx, client, cfg, record)
+		})
+		if skipped > 0 {
+			fmt.Printf("⚠️ %d 件のコミットは関連プルリクエストを取得できなかったため、空欄で出力します。\n", skipped)
+		}
+	}
+
+	if cfg.Sort == "date" {
+		sortCommitsByDate(allCommits)
+	}
+
+	if cfg.SplitByRepo {
+		byRepo := make(map[string][]CommitRecord)
+		for _, record := range allCommits {
+			byRepo[record.RepoName] = append(byRepo[record.RepoName], record)
+		}
+		// コミットのないリポジトリもヘッダーのみのファイルを出力し、確認済みであることがわかるようにする
+		for _, repo := range cfg.TargetRepos {
+			path := repoCSVFileName(repo)
+			writeToCSV(path, byRepo[repo], cfg)
+			var reasons []string
+			if reason, ok := truncatedReasons[repo]; ok {
+				reasons = append(reasons, reason)
+			}
+			writeManifest(path, reasons)
+		}
+	} else {
+		writeToCSV("commits.csv", allCommits, cfg)
+		var reasons []string
+		for _, repo := range truncatedRepos {
+			reasons = append(reasons, truncatedReasons[repo])
+		}
+		writeManifest("commits.csv", reasons)
+	}
+	hb.Complete()
 }
 
-// Linkヘッダーから次のページのURLを抽出する関数
-func getNextPageURL(linkHeader string) string {
-	if linkHeader == "" {
-		return ""
+// branchLabel は、ログに表示するブランチ名を返す (BRANCH 未指定時は既定のブランチ)
+func branchLabel(branch string) string {
+	if branch == "" {
+		return "既定のブランチ"
+	}
+	return branch
+}
+
+// 1ページあたり、レート制限の解除を待って再試行する回数の上限
+const maxRateLimitRetries = 3
+
+// rateLimitWait は、API のエラーがレート制限によるものかを判定し、再試行までの待ち時間を返す。
+// 二次レート制限では Retry-After、一次レート制限ではリセット時刻に従う
+func rateLimitWait(resp *github.Response, err error) (time.Duration, bool) {
+	var rateErr *github.RateLimitError
+	if errors.As(err, &rateErr) {
+		// 時計のずれを考慮して、リセット時刻の1秒後まで待つ
+		return max(time.Until(rateErr.Rate.Reset.Time)+time.Second, time.Second), true
+	}
+	var abuseErr *github.AbuseRateLimitError
+	if errors.As(err, &abuseErr) && abuseErr.RetryAfter != nil {
+		return *abuseErr.RetryAfter, true
 	}
-	re := regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
-	matches := re.FindStringSubmatch(linkHeader)
-	if len(matches) > 1 {
-		return matches[1]
+	if abuseErr != nil || isStatus(resp, http.StatusTooManyRequests) {
+		// 待ち時間が示されないレート制限は、1分待ってから再試行する
+		return time.Minute, true
 	}
-	return ""
+	return 0, false
 }
 
-// 取得したコミットデータをCSVファイルに書き込む関数
-func writeToCSV(records []CommitRecord) {
-	file, err := os.Create("commits.csv")
+// 同時にコミットを取得するリポジトリ数の既定値 (GitHub の二次レート制限にかからない程度に抑える)
+const defaultCommitWorkers = 4
+
+// fetchRepoCommits は、1リポジトリの期間内のコミットを最後のページまで取得する。
+// ページ送りが途中で止まった場合は、それまでに取得できたコミットとエラーを返す
+func fetchRepoCommits(ctx context.Context, client *github.Client, cfg Config, repo string) ([]CommitRecord, error) {
+	records := []CommitRecord{}
+
+	fmt.Printf("リポジトリ '%s' (ブランチ: %s) のコミットを取得中...\n", repo, branchLabel(cfg.Branch))
+
+	// 作成者の絞り込みは API 側で行うため、件数のログも絞り込み後の件数になる
+	opt := &github.CommitsListOptions{
+		SHA:         cfg.Branch,
+		Author:      cfg.Author,
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	// loadConfig で RFC3339 に揃えてある (未設定の場合はゼロ値のままで、条件に含めない)
+	opt.Since, _ = time.Parse(time.RFC3339, cfg.SinceDate)
+	opt.Until, _ = time.Parse(time.RFC3339, cfg.UntilDate)
+
+	// 同じページをレート制限で再試行した回数
+	retries := 0
+	for {
+		commits, resp, err := client.Repositories.ListCommits(ctx, cfg.GitHubOwner, repo, opt)
+		if wait, limited := rateLimitWait(resp, err); limited {
+			if retries >= maxRateLimitRetries {
+				return records, fmt.Errorf("レート制限 (%s): %d 回再試行しても解除されませんでした: %w", repo, maxRateLimitRetries, err)
+			}
+			retries++
+			log.Printf("レート制限 (%s): %s 待機してから同じページを再試行します (%d/%d)\n", repo, wait, retries, maxRateLimitRetries)
+			time.Sleep(wait)
+			continue
+		}
+		retries = 0
+
+		if isStatus(resp, http.StatusConflict) {
+			// コミットが1つもない空のリポジトリでは 409 が返る
+			log.Printf("空のリポジトリ (%s): コミットがありません\n", repo)
+			return records, nil
+		}
+		if err != nil {
+			return records, fmt.Errorf("APIエラー (%s): %w。リポジトリ名を確認してください。", repo, err)
+		}
+
+		// 本文が空の 200 応答は API の一時的な不調によるもので、「コミットなし」とは区別する
+		// (go-github は空の本文をエラーにせず、commits を nil のまま返す)
+		if commits == nil {
+			return records, fmt.Errorf("空のレスポンス本文 (%s): コミット0件とは判断せず、取得が不完全なものとして扱います", repo)
+		}
+
+		// 空の配列 ([]) が返された場合のみ、期間内にコミットがないと判断する
+		if len(commits) == 0 && len(records) == 0 {
+			log.Printf("期間内のコミットなし (%s): 空の配列が返されました\n", repo)
+			return records, nil
+		}
+
+		for _, c := range commits {
+			if cfg.ExcludeMerges && len(c.Parents) > 1 {
+				continue
+			}
+			commit := c.GetCommit()
+			records = append(records, CommitRecord{
+				RepoName:           repo,
+				CommitDate:         commit.GetAuthor().GetDate().Format(time.RFC3339),
+				Message:            commit.GetMessage(),
+				SHA:                c.GetSHA(),
+				URL:                c.GetHTMLURL(),
+				Verified:           commit.GetVerification().GetVerified(),
+				VerificationReason: commit.GetVerification().GetReason(),
+				AuthorLogin:        commitAuthorLogin(c),
+				AuthorName:         commit.GetAuthor().GetName(),
+				AuthorEmail:        commit.GetAuthor().GetEmail(),
+			})
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+	return records, nil
+}
+
+// コミットごとの追加取得 (変更行数・関連プルリクエスト) で、他のツールや次回の実行のために残しておく
+// core API のリクエスト数
+const enrichRateReserve = 100
+
+// enrichCommits は、records の各コミットについて fetch を workerCount 並列で呼び出し、
+// 取得できなかったコミット数を返す。コミットごとに API を呼び出すため、
+// core API の残りが enrichRateReserve を下回った時点で以降のコミットの取得をやめる
+func enrichCommits(records []CommitRecord, workerCount int, label string, fetch func(record *CommitRecord) error) int {
+	if remaining, ok := githubapi.DefaultRateUsage.Remaining(); ok && remaining-enrichRateReserve < len(records) {
+		fmt.Printf("⚠️ API の残り %d リクエストでは、全コミットの%sを取得できない可能性があります。\n", remaining, label)
+	}
+
+	fetched := make([]bool, len(records))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workerCount; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if remaining, ok := githubapi.DefaultRateUsage.Remaining(); ok && remaining < enrichRateReserve {
+					continue
+				}
+				if err := fetch(&records[i]); err != nil {
+					log.Printf("%sの取得エラー (%s %s): %v\n", label, records[i].RepoName, records[i].SHA, err)
+					continue
+				}
+				fetched[i] = true
+			}
+		}()
+	}
+	for i := range records {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	skipped := 0
+	for _, ok := range fetched {
+		if !ok {
+			skipped++
+		}
+	}
+	return skipped
+}
+
+// fetchCommitStats は、コミットの詳細から変更行数を取得して record に設定する
+func fetchCommitStats(ctx context.Context, client *github.Client, cfg Config, record *CommitRecord) error {
+	commit, _, err := client.Repositories.GetCommit(ctx, cfg.GitHubOwner, record.RepoName, record.SHA, nil)
+	if err != nil {
+		return err
+	}
+	record.StatsFetched = true
+	record.Additions = commit.GetStats().GetAdditions()
+	record.Deletions = commit.GetStats().GetDeletions()
+	record.Total = commit.GetStats().GetTotal()
+	return nil
+}
+
+// fetchCommitPRs は、コミットを含むプルリクエストの番号を record に設定する
+func fetchCommitPRs(ctx context.Context, client *github.Client, cfg Config, record *CommitRecord) error {
+	numbers := []int{}
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		prs, resp, err := client.PullRequests.ListPullRequestsWithCommit(ctx, cfg.GitHubOwner, record.RepoName, record.SHA, opt)
+		if err != nil {
+			return err
+		}
+		for _, pr := range prs {
+			numbers = append(numbers, pr.GetNumber())
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+	record.PRNumbers = numbers
+	return nil
+}
+
+// sortCommitsByDate は、全リポジトリのコミットをコミット日付の新しい順に並べる (同時刻はリポジトリ名順)
+func sortCommitsByDate(records []CommitRecord) {
+	sort.SliceStable(records, func(i, j int) bool {
+		ti, _ := time.Parse(time.RFC3339, records[i].CommitDate)
+		tj, _ := time.Parse(time.RFC3339, records[j].CommitDate)
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return records[i].RepoName < records[j].RepoName
+	})
+}
+
+// runMergedPRs は、期間内にマージされたプルリクエストを全リポジトリから取得し、CSVに出力する
+func runMergedPRs(ctx context.Context, client *github.Client, cfg Config) {
+	fmt.Println("\n--- 設定値に基づいてマージ済みプルリクエストの取得を開始します ---")
+	fmt.Printf("OWNER: %s, SINCE: %s, UNTIL: %s\n", cfg.GitHubOwner, cfg.SinceDate, cfg.UntilDate)
+	fmt.Println("-------------------------------------------------")
+
+	// 期間が未設定の場合は、その側の境界を設けない
+	since, _ := time.Parse(time.RFC3339, cfg.SinceDate)
+	until, _ := time.Parse(time.RFC3339, cfg.UntilDate)
+
+	allPRs := []MergedPRRecord{}
+	// 取得エラーでプルリクエストが欠けている可能性のあるリポジトリ (マニフェストに残す)
+	var truncatedReasons []string
+
+	for _, repo := range cfg.TargetRepos {
+		fmt.Printf("\nリポジトリ '%s' のマージ済みプルリクエストを取得中...\n", repo)
+		prs, err := fetchMergedPRs(ctx, client, cfg, repo, since, until)
+		if err != nil {
+			log.Printf("プルリクエストの取得エラー (%s): %v\n", repo, err)
+			truncatedReasons = append(truncatedReasons, fmt.Sprintf("%s: %v", repo, err))
+		}
+		fmt.Printf("'%s' の結果: %d 件のマージ済みプルリクエストが見つかりました。\n", repo, len(prs))
+		allPRs = append(allPRs, prs...)
+	}
+
+	fmt.Println("\n-------------------------------------------------")
+	fmt.Printf("合計 %d 件のマージ済みプルリクエストを取得完了。CSVファイルに出力します。\n", len(allPRs))
+
+	writeMergedPRsToCSV(allPRs)
+	writeManifest("merged_prs.csv", truncatedReasons)
+}
+
+// fetchMergedPRs は、1リポジトリのクローズ済みプルリクエストを更新日時の新しい順に取得し、
+// マージ日時が期間内のものだけを返す。マージ日時は更新日時以前のため、
+// 更新日時が期間の開始より古くなった時点で以降のページは取得しない
+func fetchMergedPRs(ctx context.Context, client *github.Client, cfg Config, repo string, since, until time.Time) ([]MergedPRRecord, error) {
+	records := []MergedPRRecord{}
+	opt := &github.PullRequestListOptions{
+		State:       "closed",
+		Sort:        "updated",
+		Direction:   "desc",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	for {
+		prs, resp, err := client.PullRequests.List(ctx, cfg.GitHubOwner, repo, opt)
+		if err != nil {
+			return records, fmt.Errorf("%w。リポジトリ名を確認してください。", err)
+		}
+
+		reachedSince := false
+		for _, pr := range prs {
+			if !since.IsZero() && pr.GetUpdatedAt().Before(since) {
+				reachedSince = true
+				break
+			}
+			if pr.MergedAt == nil {
+				continue // マージされずにクローズされたもの
+			}
+			mergedAt := pr.GetMergedAt().Time
+			if !since.IsZero() && mergedAt.Before(since) {
+				continue
+			}
+			if !until.IsZero() && mergedAt.After(until) {
+				continue
+			}
+			records = append(records, MergedPRRecord{
+				RepoName:       repo,
+				Number:         pr.GetNumber(),
+				Title:          pr.GetTitle(),
+				Author:         pr.GetUser().GetLogin(),
+				MergedAt:       mergedAt.Format(time.RFC3339),
+				BaseBranch:     pr.GetBase().GetRef(),
+				MergeCommitSHA: pr.GetMergeCommitSHA(),
+				URL:            pr.GetHTMLURL(),
+			})
+		}
+		if reachedSince || resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	return records, nil
+}
+
+// writeMergedPRsToCSV は、マージ済みプルリクエストを merged_prs.csv に書き込む
+func writeMergedPRsToCSV(records []MergedPRRecord) {
+	writer, err := report.Create("merged_prs.csv", report.OptionsFromEnv())
 	if err != nil {
 		log.Fatalf("CSVファイルの作成に失敗しました: %v", err)
 	}
-	defer file.Close()
+	defer writer.Close()
+
+	headers := []string{"No", "リポジトリ", "PR番号", "タイトル", "作成者", "マージ日時", "マージ先ブランチ", "マージコミット", "URL"}
+	if err := writer.Write(headers); err != nil {
+		log.Fatalf("ヘッダーの書き込みに失敗しました: %v", err)
+	}
+
+	for i, record := range records {
+		row := []string{
+			strconv.Itoa(i + 1),
+			record.RepoName,
+			strconv.Itoa(record.Number),
+			record.Title,
+			record.Author,
+			record.MergedAt,
+			record.BaseBranch,
+			record.MergeCommitSHA,
+			record.URL,
+		}
+		if err := writer.Write(row); err != nil {
+			log.Printf("行の書き込みに失敗しました (PR: %s#%d): %v\n", record.RepoName, record.Number, err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		log.Fatalf("CSVファイルの書き込みに失敗しました: %v", err)
+	}
+
+	fmt.Println("merged_prs.csv の出力が完了しました。")
+}
+
+// ファイル名に使えない文字
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// repoCSVFileName は、SPLIT_BY_REPO=true の場合のリポジトリごとの出力ファイル名を返す
+func repoCSVFileName(repo string) string {
+	return "commits_" + unsafeFileNameChars.ReplaceAllString(repo, "_") + ".csv"
+}
+
+// 改行 (CRLF・CR・LF)
+var lineBreaks = regexp.MustCompile(`\r\n|\r|\n`)
+
+// csvMessage は、FIRST_LINE_ONLY・FLATTEN_MESSAGE に応じて CSV に出力するコミットメッセージを返す。
+// 改行を含むセルを正しく扱えない CSV の利用先向けで、既定ではメッセージ全体をそのまま返す
+func csvMessage(message string, cfg Config) string {
+	switch {
+	case cfg.FirstLineOnly:
+		return lineBreaks.Split(message, 2)[0]
+	case cfg.FlattenMessage:
+		return lineBreaks.ReplaceAllString(message, " ")
+	}
+	return message
+}
+
+// writeManifest は、出力した CSV のマニフェスト (<CSV>.manifest.json) を書き出す。
+// reasons があれば、取得が途中で止まった出力として truncated: true を残す
+func writeManifest(path string, reasons []string) {
+	if err := report.WriteManifest(path, report.Manifest{Tool: "commit_list", Files: []string{path}, TruncatedReasons: reasons}); err != nil {
+		log.Fatalf("マニフェストの書き込みに失敗しました: %v", err)
+	}
+	if len(reasons) > 0 {
+		fmt.Printf("⚠️ '%s' は取得が不完全なため、マニフェスト '%s' に truncated: true を記録しました。\n", path, report.ManifestPath(path))
+	}
+}
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+// 取得したコミットデータをCSVファイルに書き込む関数
+// (FETCH_STATS・FETCH_PRS の場合は変更行数・関連プルリクエストの列を加える)
+func writeToCSV(path string, records []CommitRecord, cfg Config) {
+	writer, err := report.Create(path, report.OptionsFromEnv())
+	if err != nil {
+		log.Fatalf("CSVファイルの作成に失敗しました: %v", err)
+	}
+	defer writer.Close()
 	
-	headers := []string{"No", "リポジトリ", "コミット日付", "コミット内容", "識別番号", "URL"}
+	headers := []string{"No", "リポジトリ", "コミット日付", "コミット内容", "識別番号", "URL", "署名検証", "検証結果の理由", "作成者 (GitHub)", "作成者名", "作成者メールアドレス"}
+	if cfg.FetchStats {
+		headers = append(headers, "追加行数", "削除行数", "変更行数")
+	}
+	if cfg.FetchPRs {
+		headers = append(headers, "関連プルリクエスト")
+	}
 	if err := writer.Write(headers); err != nil {
 		log.Fatalf("ヘッダーの書き込みに失敗しました: %v", err)
 	}
@@ -224,14 +840,38 @@ func writeToCSV(records []CommitRecord) {
 			strconv.Itoa(i + 1),
 			record.RepoName,
 			record.CommitDate,
-			record.Message,
+			csvMessage(record.Message, cfg),
 			record.SHA,
 			record.URL,
+			strconv.FormatBool(record.Verified),
+			record.VerificationReason,
+			record.AuthorLogin,
+			record.AuthorName,
+			record.AuthorEmail,
+		}
+		if cfg.FetchStats {
+			if record.StatsFetched {
+				row = append(row, strconv.Itoa(record.Additions), strconv.Itoa(record.Deletions), strconv.Itoa(record.Total))
+			} else {
+				row = append(row, "", "", "")
+			}
+		}
+		if cfg.FetchPRs {
+			// 関連するプルリクエストがない場合は空欄
+			numbers := make([]string, len(record.PRNumbers))
+			for i, number := range record.PRNumbers {
+				numbers[i] = strconv.Itoa(number)
+			}
+			row = append(row, strings.Join(numbers, ","))
 		}
 		if err := writer.Write(row); err != nil {
 			log.Printf("行の書き込みに失敗しました (SHA: %s): %v\n", record.SHA, err)
 		}
 	}
-	
-	fmt.Println("commits.csv の出力が完了しました。")
+
+	if err := writer.Close(); err != nil {
+		log.Fatalf("CSVファイルの書き込みに失敗しました: %v", err)
+	}
+
+	fmt.Printf("%s の出力が完了しました。\n", path)
 }
\ No newline at end of file
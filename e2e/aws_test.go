@@ -0,0 +1,343 @@
+package e2e
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 偽の AWS API が返すアカウント ID
+const testAccountID = "123456789012"
+
+// newFakeAWS は、偽の AWS API を起動する。AWS_ENDPOINT_URL で全サービスをこのサーバーに向けるため、
+// Security Hub (REST-JSON、POST /findings など) と STS・IAM (Query プロトコル、POST / の Action) を1つのサーバーで受ける。
+// queryActions は Action 名から、応答の XML (Result 要素の中身) を返す関数への対応
+func newFakeAWS(t *testing.T, queryActions map[string]func(form url.Values) (int, string)) *fakeServer {
+	s := newFakeServer(t, "")
+
+	s.handle("POST /", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		action := r.PostForm.Get("Action")
+		handler, ok := queryActions[action]
+		if !ok {
+			s.mu.Lock()
+			s.unhandled = append(s.unhandled, "POST / Action="+action)
+			s.mu.Unlock()
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(queryError("InvalidAction", "unexpected action "+action)))
+			return
+		}
+		status, body := handler(r.PostForm)
+		w.Header().Set("Content-Type", "text/xml")
+		w.WriteHeader(status)
+		if status != http.StatusOK {
+			w.Write([]byte(body))
+			return
+		}
+		w.Write([]byte("<" + action + "Response><" + action + "Result>" + body + "</" + action + "Result>" +
+			"<ResponseMetadata><RequestId>test</RequestId></ResponseMetadata></" + action + "Response>"))
+	})
+	return s
+}
+
+// queryError は、Query プロトコルのエラー応答を返す
+func queryError(code, message string) string {
+	return "<ErrorResponse><Error><Type>Sender</Type><Code>" + code + "</Code><Message>" + message +
+		"</Message></Error><RequestId>test</RequestId></ErrorResponse>"
+}
+
+// callerIdentity は STS GetCallerIdentity の応答を返す
+func callerIdentity(url.Values) (int, string) {
+	return http.StatusOK, "<Arn>arn:aws:iam::" + testAccountID + ":user/auditor</Arn><UserId>AIDAAUDITOR</UserId><Account>" + testAccountID + "</Account>"
+}
+
+// runAWSTool は、偽の AWS API に向けて作業ディレクトリ dir でツールを実行し、出力を返す
+func runAWSTool(t *testing.T, tool string, aws *fakeServer, dir string, env map[string]string) string {
+	t.Helper()
+	bin := buildTool(t, tool)
+	all := map[string]string{
+		"AWS_ENDPOINT_URL": aws.URL,
+		"AWS_REGION":       "ap-northeast-1",
+		// 実行環境の設定ファイルや EC2 のメタデータを読まないようにする
+		"AWS_CONFIG_FILE":             filepath.Join(dir, "aws_config"),
+		"AWS_SHARED_CREDENTIALS_FILE": filepath.Join(dir, "aws_credentials"),
+		"AWS_EC2_METADATA_DISABLED":   "true",
+	}
+	for key, value := range env {
+		all[key] = value
+	}
+	return runTool(t, bin, dir, all)
+}
+
+// securityHubFinding は GetFindings の応答に含める検出結果を返す
+func securityHubFinding(id, severity, controlID, resourceID string) map[string]any {
+	return map[string]any{
+		"SchemaVersion": "2018-10-08",
+		"Id":            id,
+		"ProductArn":    "arn:aws:securityhub:ap-northeast-1::product/aws/securityhub",
+		"ProductName":   "Security Hub",
+		"GeneratorId":   "security-control/" + controlID,
+		"AwsAccountId":  testAccountID,
+		"Region":        "ap-northeast-1",
+		"Title":         controlID + " のテスト",
+		"Description":   controlID + " のテスト",
+		"CreatedAt":     "2024-05-01T00:00:00Z",
+		"UpdatedAt":     "2024-05-02T00:00:00Z",
+		"RecordState":   "ACTIVE",
+		"Severity":      map[string]any{"Label": severity},
+		"Workflow":      map[string]any{"Status": "NEW"},
+		"Compliance":    map[string]any{"Status": "FAILED", "SecurityControlId": controlID},
+		"Resources":     []map[string]any{{"Type": "AwsS3Bucket", "Id": resourceID, "Region": "ap-northeast-1"}},
+	}
+}
+
+// newFakeSecurityHub は、GetFindings が2ページに分けて検出結果を返す偽の AWS API を起動する
+func newFakeSecurityHub(t *testing.T) *fakeServer {
+	s := newFakeAWS(t, map[string]func(url.Values) (int, string){"GetCallerIdentity": callerIdentity})
+	pages := map[string]map[string]any{
+		"": {
+			"Findings": []map[string]any{
+				securityHubFinding("finding-1", "CRITICAL", "S3.1", "arn:aws:s3:::bucket-a"),
+				securityHubFinding("finding-2", "HIGH", "S3.2", "arn:aws:s3:::bucket-b"),
+			},
+			"NextToken": "page-2",
+		},
+		"page-2": {
+			"Findings": []map[string]any{
+				securityHubFinding("finding-3", "HIGH", "S3.8", "arn:aws:s3:::bucket-c"),
+			},
+		},
+	}
+	s.handle("POST /findings", func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			NextToken string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		page, ok := pages[input.NextToken]
+		if !ok {
+			http.Error(w, `{"__type":"InvalidInputException","message":"invalid NextToken"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	})
+	return s
+}
+
+func TestGetSecurityHubList(t *testing.T) {
+	aws := newFakeSecurityHub(t)
+	dir := t.TempDir()
+	outputFile := filepath.Join(dir, "security_hub_findings.csv")
+	runAWSTool(t, "get_security_hub_list", aws, dir, map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKIATESTTESTTEST",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"OUTPUT_FILE":           outputFile,
+		"OUTPUT_FORMAT":         "csv,json",
+		"LOCALE":                "en",
+		"SORT_BY":               "priority",
+	})
+
+	// 2ページ目まで取得し、重要度の高い順に並ぶ
+	rows := csvRows(t, outputFile)
+	assertEqual(t, "ID", column(rows, "ID"), []string{"finding-1", "finding-2", "finding-3"})
+	assertEqual(t, "Severity", column(rows, "Severity"), []string{"CRITICAL", "HIGH", "HIGH"})
+	assertEqual(t, "ControlID", column(rows, "ControlID"), []string{"S3.1", "S3.2", "S3.8"})
+	assertEqual(t, "AccountID", column(rows, "AccountID"), []string{testAccountID, testAccountID, testAccountID})
+
+	var details []struct {
+		ID          string `json:"id"`
+		Severity    string `json:"severity"`
+		ResourceARN string `json:"resourceArn"`
+	}
+	readJSON(t, filepath.Join(dir, "security_hub_findings.json"), &details)
+	var arns []string
+	for _, detail := range details {
+		arns = append(arns, detail.ResourceARN)
+	}
+	assertEqual(t, "resourceArn", arns, []string{"arn:aws:s3:::bucket-a", "arn:aws:s3:::bucket-b", "arn:aws:s3:::bucket-c"})
+
+	var manifest struct {
+		Tool      string   `json:"tool"`
+		Files     []string `json:"files"`
+		Truncated bool     `json:"truncated"`
+	}
+	readJSON(t, outputFile+".manifest.json", &manifest)
+	if manifest.Tool != "get_security_hub_list" || manifest.Truncated || len(manifest.Files) != 2 {
+		t.Errorf("マニフェスト = %+v, want CSV と JSON の2ファイルで truncated: false", manifest)
+	}
+	if unhandled := aws.unhandledRequests(); len(unhandled) > 0 {
+		t.Errorf("未登録のリクエスト: %v", unhandled)
+	}
+}
+
+func TestGetSecurityHubListStream(t *testing.T) {
+	aws := newFakeSecurityHub(t)
+	dir := t.TempDir()
+	outputFile := filepath.Join(dir, "security_hub_findings.csv")
+	runAWSTool(t, "get_security_hub_list", aws, dir, map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKIATESTTESTTEST",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"OUTPUT_FILE":           outputFile,
+		"LOCALE":                "en",
+		"STREAM":                "true",
+	})
+
+	// 逐次出力は取得順のまま書き出す
+	rows := csvRows(t, outputFile)
+	assertEqual(t, "ID", column(rows, "ID"), []string{"finding-1", "finding-2", "finding-3"})
+
+	var manifest struct {
+		Truncated bool `json:"truncated"`
+	}
+	readJSON(t, outputFile+".manifest.json", &manifest)
+	if manifest.Truncated {
+		t.Errorf("マニフェスト = %+v, want truncated: false", manifest)
+	}
+}
+
+// signingRegion は、SigV4 の署名 (Credential=<キー>/<日付>/<リージョン>/<サービス>/aws4_request) から
+// リクエストの送信先リージョンを返す。AWS_ENDPOINT_URL では全リージョンが同じサーバーに届くため、署名で区別する
+func signingRegion(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	_, credential, ok := strings.Cut(auth, "Credential=")
+	if !ok {
+		return ""
+	}
+	parts := strings.Split(credential, "/")
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[2]
+}
+
+func TestGetSecurityHubListScanRegion(t *testing.T) {
+	aws := newFakeAWS(t, nil)
+	// us-east-1 は集約先のリージョンで、ap-northeast-1 の検出結果 (Region は ap-northeast-1 のまま) も返す
+	aggregated := securityHubFinding("finding-2", "HIGH", "S3.2", "arn:aws:s3:::bucket-b")
+	findings := map[string][]map[string]any{
+		"ap-northeast-1": {securityHubFinding("finding-1", "CRITICAL", "S3.1", "arn:aws:s3:::bucket-a")},
+		"us-east-1":      {aggregated},
+	}
+	aws.handle("POST /findings", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"Findings": findings[signingRegion(r)]})
+	})
+
+	dir := t.TempDir()
+	outputFile := filepath.Join(dir, "security_hub_findings.csv")
+	runAWSTool(t, "get_security_hub_list", aws, dir, map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKIATESTTESTTEST",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_REGIONS":           "ap-northeast-1,us-east-1",
+		"OUTPUT_FILE":           outputFile,
+		"OUTPUT_FORMAT":         "csv,json",
+		"LOCALE":                "en",
+	})
+
+	// スキャンリージョン列は、検出結果の Region ではなく取得したリージョンになる
+	rows := csvRows(t, outputFile)
+	assertEqual(t, "ID", column(rows, "ID"), []string{"finding-1", "finding-2"})
+	assertEqual(t, "ScanRegion", column(rows, "ScanRegion"), []string{"ap-northeast-1", "us-east-1"})
+
+	var details []struct {
+		Region     string `json:"region"`
+		ScanRegion string `json:"scanRegion"`
+	}
+	readJSON(t, filepath.Join(dir, "security_hub_findings.json"), &details)
+	if len(details) != 2 || details[1].Region != "ap-northeast-1" || details[1].ScanRegion != "us-east-1" {
+		t.Errorf("JSON = %+v, want finding-2 の region は ap-northeast-1、scanRegion は us-east-1", details)
+	}
+}
+
+// newFakeIAM は、ユーザー alice (コンソールのパスワードと有効なアクセスキーを持ち、2つのグループに所属) と
+// bob (パスワードなし、無効なアクセスキーのみ、グループなし) のいる偽の STS・IAM を起動する
+func newFakeIAM(t *testing.T) *fakeServer {
+	const createDate = "<CreateDate>2024-01-02T03:04:05Z</CreateDate>"
+	user := func(name, id string) string {
+		return "<member><Path>/</Path><UserName>" + name + "</UserName><UserId>" + id + "</UserId>" +
+			"<Arn>arn:aws:iam::" + testAccountID + ":user/" + name + "</Arn>" + createDate + "</member>"
+	}
+	group := func(name string) string {
+		return "<member><Path>/</Path><GroupName>" + name + "</GroupName><GroupId>AGPA" + strings.ToUpper(name) + "</GroupId>" +
+			"<Arn>arn:aws:iam::" + testAccountID + ":group/" + name + "</Arn>" + createDate + "</member>"
+	}
+	accessKey := func(userName, status string) string {
+		return "<member><UserName>" + userName + "</UserName><AccessKeyId>AKIA" + strings.ToUpper(userName) + "</AccessKeyId>" +
+			"<Status>" + status + "</Status>" + createDate + "</member>"
+	}
+
+	return newFakeAWS(t, map[string]func(url.Values) (int, string){
+		"GetCallerIdentity": callerIdentity,
+		"ListUsers": func(url.Values) (int, string) {
+			return http.StatusOK, "<IsTruncated>false</IsTruncated><Users>" + user("alice", "AIDAALICE") + user("bob", "AIDABOB") + "</Users>"
+		},
+		"ListGroupsForUser": func(form url.Values) (int, string) {
+			groups := ""
+			if form.Get("UserName") == "alice" {
+				groups = group("admins") + group("developers")
+			}
+			return http.StatusOK, "<IsTruncated>false</IsTruncated><Groups>" + groups + "</Groups>"
+		},
+		"GetLoginProfile": func(form url.Values) (int, string) {
+			if form.Get("UserName") != "alice" {
+				return http.StatusNotFound, queryError("NoSuchEntity", "Login Profile for User "+form.Get("UserName")+" cannot be found.")
+			}
+			return http.StatusOK, "<LoginProfile><UserName>alice</UserName>" + createDate + "</LoginProfile>"
+		},
+		"ListAccessKeys": func(form url.Values) (int, string) {
+			status := "Inactive"
+			if form.Get("UserName") == "alice" {
+				status = "Active"
+			}
+			return http.StatusOK, "<IsTruncated>false</IsTruncated><AccessKeyMetadata>" + accessKey(form.Get("UserName"), status) + "</AccessKeyMetadata>"
+		},
+	})
+}
+
+func TestGetIAMUsers(t *testing.T) {
+	for _, format := range []string{"", "long"} {
+		t.Run("format="+format, func(t *testing.T) {
+			aws := newFakeIAM(t)
+			dir := t.TempDir()
+			// AWS_PROFILES で指定するプロファイル audit の認証情報とリージョン
+			if err := os.WriteFile(filepath.Join(dir, "aws_config"), []byte("[profile audit]\nregion = us-east-1\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			credentials := "[audit]\naws_access_key_id = AKIATESTTESTTEST\naws_secret_access_key = secret\n"
+			if err := os.WriteFile(filepath.Join(dir, "aws_credentials"), []byte(credentials), 0644); err != nil {
+				t.Fatal(err)
+			}
+			// リージョンはプロファイルの設定から決まるよう、AWS_REGION は空にする
+			runAWSTool(t, "get_iam_users", aws, dir, map[string]string{"AWS_PROFILES": "audit", "AWS_REGION": "", "FORMAT": format})
+
+			rows := csvRows(t, filepath.Join(dir, "iam_users_list.csv"))
+			if format == "long" {
+				// グループごとに1行、グループのないユーザーも1行
+				assertEqual(t, "UserName", column(rows, "UserName"), []string{"alice", "alice", "bob"})
+				assertEqual(t, "Groups", column(rows, "Groups"), []string{"admins", "developers", ""})
+				return
+			}
+			assertEqual(t, "AccountID", column(rows, "AccountID"), []string{testAccountID, testAccountID})
+			assertEqual(t, "ProfileName", column(rows, "ProfileName"), []string{"audit", "audit"})
+			assertEqual(t, "UserName", column(rows, "UserName"), []string{"alice", "bob"})
+			assertEqual(t, "CreateDate", column(rows, "CreateDate"), []string{"2024-01-02T03:04:05Z", "2024-01-02T03:04:05Z"})
+			assertEqual(t, "Groups", column(rows, "Groups"), []string{"admins;developers", ""})
+			assertEqual(t, "ConsoleAccess", column(rows, "ConsoleAccess"), []string{"true", "false"})
+			assertEqual(t, "ActiveAccessKeys", column(rows, "ActiveAccessKeys"), []string{"1", "0"})
+			assertEqual(t, "DualAccess", column(rows, "DualAccess"), []string{"true", "false"})
+			if unhandled := aws.unhandledRequests(); len(unhandled) > 0 {
+				t.Errorf("未登録のリクエスト: %v", unhandled)
+			}
+		})
+	}
+}
@@ -0,0 +1,5 @@
+// Package e2e は、各ツールをビルドし、偽の AWS・GitHub の API に向けて実行するエンドツーエンドのテスト。
+// AWS は AWS_ENDPOINT_URL (SDK の BaseEndpoint)、GitHub は GITHUB_API_BASE で httptest のサーバーに向け、
+// 出力された CSV・JSON の内容を検証する。
+// ツールごとにバイナリをビルドするため時間がかかる。go test -short の場合は実行しない
+package e2e
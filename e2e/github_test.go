@@ -0,0 +1,335 @@
+package e2e
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newFakeGitHub は、Organization "acme" を持つ偽の GitHub API を起動する。
+// go-github は GITHUB_API_BASE を GitHub Enterprise Server として扱い /api/v3/ を付けるため、REST API はその下で応答する。
+// メンバーは alice (オーナー、Platform チームのメンテナー) と bob (メンバー、2FA 無効、Platform チームのメンバー)、
+// リポジトリは app の1つ
+func newFakeGitHub(t *testing.T) *fakeServer {
+	s := newFakeServer(t, "/api/v3")
+	s.header = http.Header{
+		"X-Ratelimit-Limit":     {"5000"},
+		"X-Ratelimit-Remaining": {"4999"},
+		"X-Ratelimit-Reset":     {"4102444800"},
+		"X-Ratelimit-Resource":  {"core"},
+	}
+
+	s.json("GET /user", `{"login":"auditor"}`)
+	s.json("GET /users/acme", `{"login":"acme","type":"Organization"}`)
+	s.json("GET /orgs/acme", `{"login":"acme","plan":{"name":"team"}}`)
+
+	s.handle("GET /orgs/acme/members", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("filter") == "2fa_disabled" {
+			w.Write([]byte(`[{"login":"bob","id":2}]`))
+			return
+		}
+		w.Write([]byte(`[{"login":"alice","id":1},{"login":"bob","id":2}]`))
+	})
+	s.json("GET /users/alice", `{"login":"alice","id":1,"name":"Alice","email":"alice@example.com","type":"User","company":"Acme"}`)
+	s.json("GET /users/bob", `{"login":"bob","id":2,"name":"","email":"","type":"User"}`)
+	s.json("GET /orgs/acme/memberships/alice", `{"role":"admin","state":"active"}`)
+	s.json("GET /orgs/acme/memberships/bob", `{"role":"member","state":"active"}`)
+
+	s.json("GET /orgs/acme/teams", `[{"id":10,"name":"Platform","slug":"platform","description":"基盤","privacy":"closed"}]`)
+	s.handle("GET /orgs/acme/teams/platform/members", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("role") {
+		case "maintainer":
+			w.Write([]byte(`[{"login":"alice"}]`))
+		case "member":
+			w.Write([]byte(`[{"login":"bob"}]`))
+		default:
+			w.Write([]byte(`[{"login":"alice"},{"login":"bob"}]`))
+		}
+	})
+	s.json("GET /orgs/acme/teams/platform/repos", `[{"name":"app","full_name":"acme/app","role_name":"deployer","permissions":{"push":true}}]`)
+
+	s.json("GET /orgs/acme/repos", `[{"name":"app","full_name":"acme/app","archived":false}]`)
+	s.json("GET /repos/acme/app/hooks", `[
+		{"id":100,"active":true,"events":["push","pull_request"],"config":{"url":"https://hooks.example.com/deploy?token=secret","content_type":"json"}},
+		{"id":101,"active":false,"events":["release"],"config":{"url":"https://chat.example.net/notify"}}
+	]`)
+	s.json("GET /repos/acme/app/collaborators", `[{"login":"bob","id":2,"role_name":"deployer"}]`)
+	s.json("GET /repos/acme/app/commits", `[
+		{"sha":"2222222222222222222222222222222222222222","html_url":"https://github.example/acme/app/commit/2222",
+		 "commit":{"message":"Fix login\n\ndetails","author":{"name":"Bob","email":"bob@example.com","date":"2024-05-02T10:00:00Z"},"verification":{"verified":false,"reason":"unsigned"}},
+		 "author":{"login":"bob"},"parents":[{"sha":"1111111111111111111111111111111111111111"}]},
+		{"sha":"1111111111111111111111111111111111111111","html_url":"https://github.example/acme/app/commit/1111",
+		 "commit":{"message":"Initial commit","author":{"name":"Alice","email":"alice@example.com","date":"2024-05-01T09:00:00Z"},"verification":{"verified":true,"reason":"valid"}},
+		 "author":{"login":"alice"},"parents":[]}
+	]`)
+
+	// 組織ロールとカスタムリポジトリロール
+	s.json("GET /orgs/acme/organization-roles", `{"total_count":1,"roles":[{"id":7,"name":"security-auditor","permissions":["read_audit_logs","read_organization_custom_repo_role"]}]}`)
+	s.json("GET /orgs/acme/organization-roles/7/teams", `[{"id":10,"name":"Platform","slug":"platform"}]`)
+	s.json("GET /orgs/acme/organization-roles/7/users", `[{"login":"alice","id":1}]`)
+	s.json("GET /orgs/acme/custom-repository-roles", `{"total_count":2,"custom_roles":[
+		{"id":8,"name":"deployer","base_role":"write","permissions":["manage_webhooks","add_label"]},
+		{"id":9,"name":"unused","base_role":"read","permissions":["add_label"]}
+	]}`)
+
+	// GraphQL API (GitHub Enterprise Server 形式の /api/graphql)。REST と同じメンバー・チームの所属を返す
+	s.handleRaw("POST /api/graphql", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Query string `json:"query"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(req.Query, "membersWithRole"):
+			w.Write([]byte(`{"data":{"organization":{"membersWithRole":{
+				"pageInfo":{"hasNextPage":false,"endCursor":""},
+				"nodes":[{"login":"alice"},{"login":"bob"}]}}}}`))
+		case strings.Contains(req.Query, "teams("):
+			w.Write([]byte(`{"data":{"organization":{"teams":{
+				"pageInfo":{"hasNextPage":false,"endCursor":""},
+				"nodes":[{"name":"Platform","slug":"platform","description":"基盤","privacy":"VISIBLE","parentTeam":null,
+					"members":{"pageInfo":{"hasNextPage":false,"endCursor":""},"edges":[
+						{"role":"MAINTAINER","node":{"login":"alice"}},
+						{"role":"MEMBER","node":{"login":"bob"}}]}}]}}}}`))
+		default:
+			w.Write([]byte(`{"errors":[{"message":"unexpected query"}]}`))
+		}
+	})
+	return s
+}
+
+// runGitHubTool は、偽の GitHub API に向けて作業ディレクトリ dir でツールを実行し、出力を返す
+func runGitHubTool(t *testing.T, tool string, github *fakeServer, dir string, env map[string]string) string {
+	t.Helper()
+	bin := buildTool(t, tool)
+	all := map[string]string{
+		"GITHUB_API_BASE": github.URL,
+		"GITHUB_TOKEN":    "test-token",
+		"GITHUB_OWNER":    "acme",
+	}
+	for key, value := range env {
+		all[key] = value
+	}
+	return runTool(t, bin, dir, all)
+}
+
+func TestGetUsers(t *testing.T) {
+	github := newFakeGitHub(t)
+	// bob のメールアドレスは公開コミットから推定する
+	github.json("GET /search/commits", `{"total_count":1,"incomplete_results":false,"items":[
+		{"sha":"3333","commit":{"author":{"name":"Bob","email":"bob@example.com"}}}
+	]}`)
+
+	dir := t.TempDir()
+	// 過去の CSV: bob の氏名を引き継ぎ、すでにいない carol は removed_users.csv に出る
+	old := "\ufeffLogin (ユーザー名),Name (氏名),Email\nbob,Bob Builder,\ncarol,,\n"
+	if err := os.WriteFile(filepath.Join(dir, "old_user_list.csv"), []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runGitHubTool(t, "get_users", github, dir, map[string]string{"FETCH_TEAMS": "true", "INFER_EMAIL": "true"})
+
+	rows := csvRows(t, filepath.Join(dir, "github_user_list.csv"))
+	assertEqual(t, "Login", column(rows, "Login (ユーザー名)"), []string{"alice", "bob"})
+	assertEqual(t, "Name", column(rows, "Name (氏名)"), []string{"Alice", "Bob Builder"})
+	assertEqual(t, "Email", column(rows, "Email"), []string{"alice@example.com", "bob@example.com"})
+	assertEqual(t, "2FA", column(rows, "2FA"), []string{"有効", "無効"})
+	assertEqual(t, "Role", column(rows, "Role (ロール)"), []string{"owner", "member"})
+	assertEqual(t, "Teams", column(rows, "Teams (所属チーム)"), []string{"Platform", "Platform"})
+
+	removed := csvRows(t, filepath.Join(dir, "removed_users.csv"))
+	assertEqual(t, "removed", column(removed, "Login (ユーザー名)"), []string{"carol"})
+}
+
+func TestGetUserTeamMatrix(t *testing.T) {
+	t.Run("wide", func(t *testing.T) {
+		github := newFakeGitHub(t)
+		dir := t.TempDir()
+		runGitHubTool(t, "get_user_team_matrix", github, dir, nil)
+
+		records := readCSV(t, filepath.Join(dir, "github_user_team_concurrent_matrix.csv"))
+		assertEqual(t, "header", records[0], []string{"Login (ユーザー名)", "Platform"})
+		assertEqual(t, "alice", records[1], []string{"alice", "○"})
+		assertEqual(t, "bob", records[2], []string{"bob", "○"})
+
+		teams := csvRows(t, filepath.Join(dir, "teams.csv"))
+		assertEqual(t, "teams", column(teams, "Slug"), []string{"platform"})
+	})
+
+	// REST と GraphQL のどちらで取得しても、同じロールの縦持ちの表になる
+	for _, api := range []string{"rest", "graphql"} {
+		t.Run("long/"+api, func(t *testing.T) {
+			github := newFakeGitHub(t)
+			dir := t.TempDir()
+			runGitHubTool(t, "get_user_team_matrix", github, dir, map[string]string{"FORMAT": "long", "API": api})
+
+			rows := csvRows(t, filepath.Join(dir, "github_user_team_concurrent_long.csv"))
+			assertEqual(t, "Login", column(rows, "Login (ユーザー名)"), []string{"alice", "bob"})
+			assertEqual(t, "Team", column(rows, "Team (チーム名)"), []string{"Platform", "Platform"})
+			assertEqual(t, "Role", column(rows, "Role (ロール)"), []string{"maintainer", "member"})
+
+			teams := csvRows(t, filepath.Join(dir, "teams.csv"))
+			assertEqual(t, "teams", column(teams, "Slug"), []string{"platform"})
+		})
+	}
+}
+
+func TestGetTeamRepoMatrix(t *testing.T) {
+	t.Run("wide", func(t *testing.T) {
+		github := newFakeGitHub(t)
+		dir := t.TempDir()
+		runGitHubTool(t, "get_team_repo_matrix", github, dir, nil)
+
+		records := readCSV(t, filepath.Join(dir, "github_user_team_matrix.csv"))
+		assertEqual(t, "header", records[0], []string{"Login (ユーザー名)", "Platform"})
+		assertEqual(t, "alice", records[1], []string{"alice", "Yes"})
+		assertEqual(t, "bob", records[2], []string{"bob", "Yes"})
+
+		teams := csvRows(t, filepath.Join(dir, "teams.csv"))
+		assertEqual(t, "teams", column(teams, "Slug"), []string{"platform"})
+	})
+
+	// ロング形式でもチームのメタ情報のサイドカーを出力する
+	t.Run("long", func(t *testing.T) {
+		github := newFakeGitHub(t)
+		dir := t.TempDir()
+		runGitHubTool(t, "get_team_repo_matrix", github, dir, map[string]string{"FORMAT": "long"})
+
+		teams := csvRows(t, filepath.Join(dir, "teams.csv"))
+		assertEqual(t, "teams", column(teams, "Slug"), []string{"platform"})
+	})
+}
+
+func TestGetRepoWebhooks(t *testing.T) {
+	github := newFakeGitHub(t)
+	dir := t.TempDir()
+	runGitHubTool(t, "get_repo_webhooks", github, dir, nil)
+
+	rows := csvRows(t, filepath.Join(dir, "github_repo_webhooks.csv"))
+	assertEqual(t, "Hook ID", column(rows, "Hook ID"), []string{"100", "101"})
+	// URL のクエリ (トークンなど) は出力せず、送信先のホストだけを残す
+	assertEqual(t, "Host", column(rows, "Host (送信先ホスト)"), []string{"hooks.example.com", "chat.example.net"})
+	assertEqual(t, "Active", column(rows, "Active (有効)"), []string{"○", ""})
+	content, _ := os.ReadFile(filepath.Join(dir, "github_repo_webhooks.csv"))
+	if strings.Contains(string(content), "secret") {
+		t.Errorf("Webhook の URL のクエリが出力されています:\n%s", content)
+	}
+}
+
+func TestGetCustomRepoRoles(t *testing.T) {
+	github := newFakeGitHub(t)
+	dir := t.TempDir()
+	runGitHubTool(t, "get_custom_repo_roles", github, dir, nil)
+
+	rows := csvRows(t, filepath.Join(dir, "github_custom_roles.csv"))
+	var got []string
+	for _, row := range rows {
+		got = append(got, strings.Join([]string{
+			row["Kind (種別)"], row["Role (ロール名)"], row["Base role (基本ロール)"], row["Permissions (権限)"],
+			row["Assignee type (割り当て先種別)"], row["Assignee (割り当て先)"], row["Repository (リポジトリ)"],
+		}, ","))
+	}
+	assertEqual(t, "rows", got, []string{
+		"organization,security-auditor,,read_audit_logs;read_organization_custom_repo_role,User,alice,",
+		"organization,security-auditor,,read_audit_logs;read_organization_custom_repo_role,Team,platform,",
+		"repository,deployer,write,add_label;manage_webhooks,User,bob,app",
+		"repository,deployer,write,add_label;manage_webhooks,Team,platform,app",
+		"repository,unused,read,add_label,,,",
+	})
+}
+
+func TestCommitList(t *testing.T) {
+	github := newFakeGitHub(t)
+	dir := t.TempDir()
+	runGitHubTool(t, "commit_list", github, dir, map[string]string{"TARGET_REPOS": "app"})
+
+	path := filepath.Join(dir, "commits.csv")
+	rows := csvRows(t, path)
+	assertEqual(t, "識別番号", column(rows, "識別番号"), []string{
+		"2222222222222222222222222222222222222222", "1111111111111111111111111111111111111111",
+	})
+	assertEqual(t, "作成者", column(rows, "作成者 (GitHub)"), []string{"bob", "alice"})
+	assertEqual(t, "署名検証", column(rows, "署名検証"), []string{"false", "true"})
+
+	var manifest struct {
+		Tool      string   `json:"tool"`
+		Files     []string `json:"files"`
+		Truncated bool     `json:"truncated"`
+	}
+	readJSON(t, path+".manifest.json", &manifest)
+	if manifest.Tool != "commit_list" || manifest.Truncated {
+		t.Errorf("マニフェスト = %+v, want truncated: false", manifest)
+	}
+}
+
+func TestCommitListUnlinkedAuthors(t *testing.T) {
+	github := newFakeGitHub(t)
+	// 削除済みアカウントや未登録のメールアドレスのコミットは author が null で返る
+	github.json("GET /repos/acme/legacy/commits", `[
+		{"sha":"4444444444444444444444444444444444444444","html_url":"https://github.example/acme/legacy/commit/4444",
+		 "commit":{"message":"Old change","author":{"name":"Dave","email":"dave@old.example.com","date":"2024-05-03T10:00:00Z"},"verification":{"verified":false,"reason":"unsigned"}},
+		 "author":null,"parents":[]},
+		{"sha":"3333333333333333333333333333333333333333","html_url":"https://github.example/acme/legacy/commit/3333",
+		 "commit":{"message":"Older change","author":{"name":"Erin","email":"erin@example.com","date":"2024-05-02T10:00:00Z"},"verification":{"verified":false,"reason":"unsigned"}},
+		 "author":{"login":"ghost"},"parents":[]}
+	]`)
+	dir := t.TempDir()
+	out := runGitHubTool(t, "commit_list", github, dir, map[string]string{"TARGET_REPOS": "app,legacy"})
+
+	rows := csvRows(t, filepath.Join(dir, "commits.csv"))
+	assertEqual(t, "作成者", column(rows, "作成者 (GitHub)"), []string{"bob", "alice", "unlinked", "ghost"})
+	// アカウントに紐付かなくても git の作成者名・メールアドレスは残す
+	assertEqual(t, "作成者名", column(rows, "作成者名"), []string{"Bob", "Alice", "Dave", "Erin"})
+	assertEqual(t, "作成者メールアドレス", column(rows, "作成者メールアドレス"), []string{
+		"bob@example.com", "alice@example.com", "dave@old.example.com", "erin@example.com",
+	})
+	if !strings.Contains(out, "(unlinked/ghost) のコミット: 2 件") {
+		t.Errorf("紐付かない作成者の件数が出力されていません:\n%s", out)
+	}
+}
+
+func TestCommitListUnknownMode(t *testing.T) {
+	github := newFakeGitHub(t)
+	dir := t.TempDir()
+	env := map[string]string{
+		"GITHUB_API_BASE": github.URL,
+		"GITHUB_TOKEN":    "test-token",
+		"GITHUB_OWNER":    "acme",
+		"TARGET_REPOS":    "app",
+		"MODE":            "pr",
+	}
+	// MODE の指定ミスはコミットの取得に切り替えずにエラーにする
+	out := runToolFailure(t, buildTool(t, "commit_list"), dir, env)
+	if !strings.Contains(out, "MODE は prs のみ指定できます (指定値: pr)") {
+		t.Errorf("MODE のエラーが出力されていません:\n%s", out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "commits.csv")); err == nil {
+		t.Error("MODE が不正なのに commits.csv が出力されています")
+	}
+}
+
+func TestCommitListTruncated(t *testing.T) {
+	github := newFakeGitHub(t)
+	dir := t.TempDir()
+	// missing のコミット一覧は 404 になり、取得できた app の分だけが出力される
+	runGitHubTool(t, "commit_list", github, dir, map[string]string{"TARGET_REPOS": "app,missing"})
+
+	path := filepath.Join(dir, "commits.csv")
+	rows := csvRows(t, path)
+	assertEqual(t, "リポジトリ", column(rows, "リポジトリ"), []string{"app", "app"})
+
+	var manifest struct {
+		Truncated        bool     `json:"truncated"`
+		TruncatedReasons []string `json:"truncatedReasons"`
+	}
+	readJSON(t, path+".manifest.json", &manifest)
+	if !manifest.Truncated || len(manifest.TruncatedReasons) != 1 || !strings.Contains(manifest.TruncatedReasons[0], "missing") {
+		t.Errorf("マニフェスト = %+v, want missing の理由付きで truncated: true", manifest)
+	}
+}
@@ -0,0 +1,236 @@
+package e2e
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ビルド済みのツール (同じツールを複数のテストで使う場合に再ビルドしない)
+var (
+	buildMu sync.Mutex
+	built   = make(map[string]string)
+	binDir  string
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "e2e-bin-")
+	if err != nil {
+		panic(err)
+	}
+	binDir = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// buildTool は、リポジトリ直下の <tool>.go をビルドしてバイナリのパスを返す
+func buildTool(t *testing.T, tool string) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("go test -short ではツールのビルドを伴うエンドツーエンドのテストを実行しない")
+	}
+
+	buildMu.Lock()
+	defer buildMu.Unlock()
+	if bin, ok := built[tool]; ok {
+		return bin
+	}
+
+	bin := filepath.Join(binDir, tool)
+	cmd := exec.Command("go", "build", "-o", bin, tool+".go")
+	cmd.Dir = ".."
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s のビルドに失敗しました: %v\n%s", tool, err, out)
+	}
+	built[tool] = bin
+	return bin
+}
+
+// runTool は、作業ディレクトリ dir でツールを実行し、標準出力と標準エラー出力を返す。
+// 実行環境の認証情報や .env を読まないよう、環境変数は env と最低限のものだけを渡す
+func runTool(t *testing.T, bin, dir string, env map[string]string) string {
+	t.Helper()
+	out, err := toolCommand(t, bin, dir, env).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s が失敗しました: %v\n%s", filepath.Base(bin), err, out)
+	}
+	return string(out)
+}
+
+// runToolFailure は runTool と同じ環境でツールを実行し、異常終了することを確認して出力を返す
+func runToolFailure(t *testing.T, bin, dir string, env map[string]string) string {
+	t.Helper()
+	out, err := toolCommand(t, bin, dir, env).CombinedOutput()
+	if err == nil {
+		t.Fatalf("%s が異常終了しませんでした\n%s", filepath.Base(bin), out)
+	}
+	return string(out)
+}
+
+// toolCommand は、dir で空の .env を読み込み env だけを環境変数に持つツールのコマンドを返す
+func toolCommand(t *testing.T, bin, dir string, env map[string]string) *exec.Cmd {
+	t.Helper()
+
+	envFile := filepath.Join(dir, ".env")
+	if err := os.WriteFile(envFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(bin)
+	cmd.Dir = dir
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + dir,
+		"ENV_FILE=" + envFile,
+	}
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	return cmd
+}
+
+// readCSV は出力された CSV を読み込む (先頭の BOM は取り除く)
+func readCSV(t *testing.T, path string) [][]string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("出力ファイルが読めません: %v", err)
+	}
+	records, err := csv.NewReader(strings.NewReader(strings.TrimPrefix(string(content), "\ufeff"))).ReadAll()
+	if err != nil {
+		t.Fatalf("%s が CSV として読めません: %v", path, err)
+	}
+	return records
+}
+
+// csvRows は、ヘッダー行の列名をキーにした map の一覧として CSV を読み込む
+func csvRows(t *testing.T, path string) []map[string]string {
+	t.Helper()
+	records := readCSV(t, path)
+	if len(records) == 0 {
+		t.Fatalf("%s にヘッダー行がありません", path)
+	}
+	rows := make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(record))
+		for i, name := range records[0] {
+			row[name] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// column は rows から列 name の値を順に取り出す
+func column(rows []map[string]string, name string) []string {
+	values := make([]string, len(rows))
+	for i, row := range rows {
+		values[i] = row[name]
+	}
+	return values
+}
+
+// readJSON は出力された JSON を out にデコードする
+func readJSON(t *testing.T, path string, out any) {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("出力ファイルが読めません: %v", err)
+	}
+	if err := json.Unmarshal(content, out); err != nil {
+		t.Fatalf("%s が JSON として読めません: %v", path, err)
+	}
+}
+
+func assertEqual(t *testing.T, name string, got, want []string) {
+	t.Helper()
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("%s = %q, want %q", name, got, want)
+	}
+}
+
+// fakeServer は、パスごとに登録した応答を返す httptest のサーバー。
+// 登録されていないパスへのリクエストは 404 を返し、テストの失敗時に確認できるよう記録する
+type fakeServer struct {
+	*httptest.Server
+	t *testing.T
+
+	mu        sync.Mutex
+	handlers  map[string]http.HandlerFunc
+	unhandled []string
+	// prefix は、handle で登録したパスの前に付く接頭辞 (GitHub Enterprise Server 形式の /api/v3 など)。
+	// 接頭辞のないパスへのリクエストは、handleRaw で登録したもの以外は未登録として扱う
+	prefix string
+	// header は、すべての応答に付けるヘッダー
+	header http.Header
+}
+
+func newFakeServer(t *testing.T, prefix string) *fakeServer {
+	s := &fakeServer{t: t, handlers: make(map[string]http.HandlerFunc), prefix: prefix}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(func() {
+		s.Close()
+		if t.Failed() && len(s.unhandled) > 0 {
+			t.Logf("未登録のリクエスト:\n  %s", strings.Join(s.unhandled, "\n  "))
+		}
+	})
+	return s
+}
+
+// handle は "GET /orgs/acme" のように、メソッドとパス (接頭辞を除く) に対する応答を登録する
+func (s *fakeServer) handle(pattern string, handler http.HandlerFunc) {
+	method, path, _ := strings.Cut(pattern, " ")
+	s.handleRaw(method+" "+s.prefix+path, handler)
+}
+
+// handleRaw は、接頭辞を付けずにメソッドとパスに対する応答を登録する
+func (s *fakeServer) handleRaw(pattern string, handler http.HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[pattern] = handler
+}
+
+// json は、メソッドとパスに対して固定の JSON を返すよう登録する
+func (s *fakeServer) json(pattern, body string) {
+	s.handle(pattern, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	})
+}
+
+func (s *fakeServer) serve(w http.ResponseWriter, r *http.Request) {
+	for key, values := range s.header {
+		w.Header()[key] = values
+	}
+	s.mu.Lock()
+	handler, ok := s.handlers[r.Method+" "+r.URL.Path]
+	if !ok {
+		s.unhandled = append(s.unhandled, r.Method+" "+r.URL.RequestURI())
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"Not Found"}`))
+		return
+	}
+	handler(w, r)
+}
+
+// unhandledRequests は、未登録のパスへのリクエストを並べ替えて返す
+func (s *fakeServer) unhandledRequests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := append([]string{}, s.unhandled...)
+	sort.Strings(requests)
+	return requests
+}
@@ -0,0 +1,66 @@
+// Package envfile は、各ツール共通の .env ファイルの探索と読み込みを行う。
+// 作業ディレクトリに .env がなくても、git と同じように親ディレクトリをさかのぼって探すため、
+// サブディレクトリから実行しても設定が失われない。
+package envfile
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/joho/godotenv"
+)
+
+// FileName は探索する設定ファイル名
+const FileName = ".env"
+
+// ErrNotFound は、作業ディレクトリから親ディレクトリまで .env が見つからなかったことを表す
+var ErrNotFound = errors.New(".env ファイルが見つかりません")
+
+// Load は、ENV_FILE で指定されたファイル、または Find で見つかった .env を読み込み、
+// 読み込んだファイルをログに出力する。既に設定されている環境変数は上書きしない。
+// .env が見つからない場合は警告のみで nil を返し、環境変数だけで動作させる。
+// ENV_FILE で明示したファイルが読めない場合や、.env の書式が不正な場合はエラーを返す
+func Load() error {
+	path := os.Getenv("ENV_FILE")
+	if path == "" {
+		found, err := Find()
+		if errors.Is(err, ErrNotFound) {
+			log.Printf("警告: %v (環境変数から読み込みます)", err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path = found
+	}
+
+	if err := godotenv.Load(path); err != nil {
+		return fmt.Errorf(".envファイルの読み込みに失敗しました (%s): %w", path, err)
+	}
+	log.Printf(".envファイルを読み込みました: %s", path)
+	return nil
+}
+
+// Find は、作業ディレクトリから親ディレクトリへ順にさかのぼり、最初に見つかった .env のパスを返す
+func Find() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("作業ディレクトリの取得に失敗しました: %w", err)
+	}
+
+	for {
+		candidate := filepath.Join(dir, FileName)
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", ErrNotFound
+		}
+		dir = parent
+	}
+}
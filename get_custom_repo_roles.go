@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/google/go-github/v63/github"
+
+	"securityhub-exporter/envfile"
+	"securityhub-exporter/githubapi"
+	"securityhub-exporter/heartbeat"
+	"securityhub-exporter/report"
+)
+
+// ロールの割り当て1件分 (割り当てのないロールは Assignee を空にして1行出力する)
+type RoleRecord struct {
+	Kind         string // "organization" (組織ロール) または "repository" (カスタムリポジトリロール)
+	Role         string
+	BaseRole     string
+	Permissions  []string
+	AssigneeType string // "User" または "Team"
+	Assignee     string
+	Repo         string // カスタムリポジトリロールの割り当て先リポジトリ
+}
+
+// ロールごとの権限と基本ロール
+type roleInfo struct {
+	BaseRole    string
+	Permissions []string
+}
+
+// listOrgRoleAssignees は、組織ロールが割り当てられたチームとユーザーを返す
+func listOrgRoleAssignees(ctx context.Context, client *github.Client, ownerName string, roleID int64) ([]RoleRecord, error) {
+	var records []RoleRecord
+
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		teams, resp, err := client.Organizations.ListTeamsAssignedToOrgRole(ctx, ownerName, roleID, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, team := range teams {
+			records = append(records, RoleRecord{AssigneeType: "Team", Assignee: team.GetSlug()})
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	opt = &github.ListOptions{PerPage: 100}
+	for {
+		users, resp, err := client.Organizations.ListUsersAssignedToOrgRole(ctx, ownerName, roleID, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			records = append(records, RoleRecord{AssigneeType: "User", Assignee: user.GetLogin()})
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+	return records, nil
+}
+
+// listRepoRoleAssignees は、リポジトリのコラボレーターとチームのうち、
+// カスタムリポジトリロール (customRoles に含まれるロール) が割り当てられたものを返す
+func listRepoRoleAssignees(ctx context.Context, client *github.Client, ownerName string, teams []*github.Team, customRoles map[string]roleInfo) ([]RoleRecord, error) {
+	var records []RoleRecord
+
+	// チームの割り当て: チームごとにアクセスできるリポジトリとロール名を取得する
+	for _, team := range teams {
+		opt := &github.ListOptions{PerPage: 100}
+		for {
+			repos, resp, err := client.Teams.ListTeamReposBySlug(ctx, ownerName, team.GetSlug(), opt)
+			if err != nil {
+				return nil, fmt.Errorf("チーム %s のリポジトリ取得に失敗しました: %w", team.GetSlug(), err)
+			}
+			for _, repo := range repos {
+				if _, ok := customRoles[repo.GetRoleName()]; ok {
+					records = append(records, RoleRecord{Role: repo.GetRoleName(), AssigneeType: "Team", Assignee: team.GetSlug(), Repo: repo.GetName()})
+				}
+			}
+			if resp.NextPage == 0 {
+				break
+			}
+			opt.Page = resp.NextPage
+		}
+	}
+
+	// ユーザーの割り当て: リポジトリごとに直接追加されたコラボレーターとロール名を取得する
+	repoOpt := &github.RepositoryListByOrgOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		repos, resp, err := client.Repositories.ListByOrg(ctx, ownerName, repoOpt)
+		if err != nil {
+			return nil, fmt.Errorf("リポジトリ一覧の取得に失敗しました: %w", err)
+		}
+		for _, repo := range repos {
+			opt := &github.ListCollaboratorsOptions{Affiliation: "direct", ListOptions: github.ListOptions{PerPage: 100}}
+			for {
+				users, resp, err := client.Repositories.ListCollaborators(ctx, ownerName, repo.GetName(), opt)
+				if err != nil {
+					// コラボレーターの参照にはリポジトリの push 以上の権限が必要
+					log.Printf("警告: リポジトリ %s のコラボレーター取得に失敗しました: %v", repo.GetName(), err)
+					break
+				}
+				for _, user := range users {
+					if _, ok := customRoles[user.GetRoleName()]; ok {
+						records = append(records, RoleRecord{Role: user.GetRoleName(), AssigneeType: "User", Assignee: user.GetLogin(), Repo: repo.GetName()})
+					}
+				}
+				if resp.NextPage == 0 {
+					break
+				}
+				opt.Page = resp.NextPage
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		repoOpt.Page = resp.NextPage
+	}
+	return records, nil
+}
+
+func main() {
+	if err := envfile.Load(); err != nil {
+		log.Fatalf("エラー: %v", err)
+	}
+
+	// HEARTBEAT_FILE が設定されていれば、外部監視用に実行状況を定期的に書き込む
+	hb := heartbeat.Start("get_custom_repo_roles")
+	defer hb.Stop()
+
+	token := os.Getenv("GITHUB_TOKEN")
+	ownerName := os.Getenv("GITHUB_OWNER")
+	outputFile := "github_custom_roles.csv"
+
+	if token == "" || ownerName == "" {
+		log.Fatal("エラー: GITHUB_TOKEN または GITHUB_OWNER が .envファイル、または環境変数で設定されていません。")
+	}
+
+	ctx := context.Background()
+	client, err := githubapi.NewClient(ctx, token)
+	if err != nil {
+		log.Fatalf("エラー: %v", err)
+	}
+	// 終了時に、今回の実行で消費した API リクエスト数と残量を表示する
+	defer func() { fmt.Println(githubapi.DefaultRateUsage.Summary()) }()
+
+	// SELF_TEST=true の場合は認証とアクセス権の確認だけを行って終了する
+	if os.Getenv("SELF_TEST") == "true" {
+		if !githubapi.SelfTest(ctx, client, ownerName, true) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := githubapi.RequireOrganization(ctx, client, ownerName); err != nil {
+		log.Fatalf("エラー: %v", err)
+	}
+
+	fmt.Printf("Organization '%s' の組織ロールとカスタムリポジトリロールを取得中...\n", ownerName)
+
+	records := []RoleRecord{}
+
+	// 1. 組織ロール (定義済みロールを含む) とその割り当て
+	orgRoles, _, err := client.Organizations.ListRoles(ctx, ownerName)
+	if err != nil {
+		log.Fatalf("組織ロールの取得に失敗しました: %v", err)
+	}
+	for _, role := range orgRoles.CustomRepoRoles {
+		assignees, err := listOrgRoleAssignees(ctx, client, ownerName, role.GetID())
+		if err != nil {
+			log.Fatalf("組織ロール %s の割り当ての取得に失敗しました: %v", role.GetName(), err)
+		}
+		if len(assignees) == 0 {
+			assignees = []RoleRecord{{}}
+		}
+		for _, assignee := range assignees {
+			assignee.Kind = "organization"
+			assignee.Role = role.GetName()
+			assignee.Permissions = role.Permissions
+			records = append(records, assignee)
+		}
+	}
+
+	// 2. カスタムリポジトリロールとその割り当て
+	repoRoles, _, err := client.Organizations.ListCustomRepoRoles(ctx, ownerName)
+	if err != nil {
+		// カスタムリポジトリロールは GitHub Enterprise Cloud でのみ利用できる
+		log.Fatalf("カスタムリポジトリロールの取得に失敗しました: %v", err)
+	}
+	customRoles := make(map[string]roleInfo)
+	for _, role := range repoRoles.CustomRepoRoles {
+		customRoles[role.GetName()] = roleInfo{BaseRole: role.GetBaseRole(), Permissions: role.Permissions}
+	}
+	fmt.Printf("-> 組織ロール %d 件、カスタムリポジトリロール %d 件\n", len(orgRoles.CustomRepoRoles), len(customRoles))
+
+	if len(customRoles) > 0 {
+		optTeam := &github.ListOptions{PerPage: 100}
+		allTeams := []*github.Team{}
+		for {
+			teams, resp, err := client.Teams.ListTeams(ctx, ownerName, optTeam)
+			if err != nil {
+				log.Fatalf("チーム一覧の取得に失敗しました: %v", err)
+			}
+			allTeams = append(allTeams, teams...)
+			if resp.NextPage == 0 {
+				break
+			}
+			optTeam.Page = resp.NextPage
+		}
+
+		assignees, err := listRepoRoleAssignees(ctx, client, ownerName, allTeams, customRoles)
+		if err != nil {
+			log.Fatalf("エラー: %v", err)
+		}
+
+		// 割り当てのないカスタムリポジトリロールも棚卸しの対象として1行出力する
+		assigned := make(map[string]bool)
+		for _, assignee := range assignees {
+			assigned[assignee.Role] = true
+		}
+		for name := range customRoles {
+			if !assigned[name] {
+				assignees = append(assignees, RoleRecord{Role: name})
+			}
+		}
+
+		for _, assignee := range assignees {
+			assignee.Kind = "repository"
+			assignee.BaseRole = customRoles[assignee.Role].BaseRole
+			assignee.Permissions = customRoles[assignee.Role].Permissions
+			records = append(records, assignee)
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Role != b.Role {
+			return a.Role < b.Role
+		}
+		if a.Repo != b.Repo {
+			return a.Repo < b.Repo
+		}
+		return a.Assignee < b.Assignee
+	})
+
+	writer, err := report.Create(outputFile, report.OptionsFromEnv())
+	if err != nil {
+		log.Fatalf("CSVファイルの作成に失敗しました: %v", err)
+	}
+	defer writer.Close()
+
+	header := []string{"Kind (種別)", "Role (ロール名)", "Base role (基本ロール)", "Permissions (権限)", "Assignee type (割り当て先種別)", "Assignee (割り当て先)", "Repository (リポジトリ)"}
+	writer.Write(header)
+
+	for _, record := range records {
+		permissions := append([]string{}, record.Permissions...)
+		sort.Strings(permissions)
+		writer.Write([]string{
+			record.Kind,
+			record.Role,
+			record.BaseRole,
+			strings.Join(permissions, ";"),
+			record.AssigneeType,
+			record.Assignee,
+			record.Repo,
+		})
+	}
+
+	if err := writer.Close(); err != nil {
+		log.Fatalf("CSVファイルの書き込みに失敗しました: %v", err)
+	}
+
+	hb.Complete()
+	fmt.Printf("\n✅ %d 件のロールの割り当てを '%s' に保存しました。\n", len(records), outputFile)
+}
@@ -2,49 +2,106 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
-	// "github.com/aws/aws-sdk-go-v2/service/iam/types" // この行を削除しました
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
-	"github.com/joho/godotenv"
+	"github.com/aws/smithy-go/middleware"
+	"golang.org/x/time/rate"
+
+	"securityhub-exporter/awsapi"
+	"securityhub-exporter/envfile"
+	"securityhub-exporter/heartbeat"
+	"securityhub-exporter/report"
 )
 
 func main() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Printf("Warning: .env file not found.")
+	if err := envfile.Load(); err != nil {
+		log.Fatalf("Error: %v", err)
 	}
 
+	// HEARTBEAT_FILE, when set, is touched periodically so external monitoring can detect stalled runs.
+	hb := heartbeat.Start("get_iam_users")
+	defer hb.Stop()
+
 	profilesStr := os.Getenv("AWS_PROFILES")
 	if profilesStr == "" {
 		log.Fatalf("Error: AWS_PROFILES is not set in .env file.")
 	}
 	profiles := strings.Split(profilesStr, ",")
 
+	// SELF_TEST=true only runs the minimal auth/permission probes for each profile
+	// and exits without creating the CSV file.
+	if os.Getenv("SELF_TEST") == "true" {
+		if !runSelfTest(profiles) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	csvFileName := "iam_users_list.csv"
-	file, err := os.Create(csvFileName)
+	writer, err := report.Create(csvFileName, report.OptionsFromEnv())
 	if err != nil {
 		log.Fatalf("Failed to create file: %v", err)
 	}
-	defer file.Close()
+	defer writer.Close()
+
+	// GROUP_SEPARATOR joins multiple groups (and policies) in one cell. The default is ";"
+	// because group and policy names may themselves contain commas.
+	groupSeparator := os.Getenv("GROUP_SEPARATOR")
+	if groupSeparator == "" {
+		groupSeparator = ";"
+	}
+
+	// FORMAT=long emits one row per user-group pair instead of a joined Groups cell.
+	longFormat := os.Getenv("FORMAT") == "long"
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	// INCLUDE_GROUP_POLICIES=true adds the union of policies granted through each user's groups.
+	includeGroupPolicies := os.Getenv("INCLUDE_GROUP_POLICIES") == "true"
 
-	header := []string{"AccountID", "ProfileName", "UserName", "UserID", "Arn", "CreateDate", "Groups"}
+	header := []string{"AccountID", "ProfileName", "UserName", "UserID", "Arn", "CreateDate", "Groups", "ConsoleAccess", "ActiveAccessKeys", "DualAccess"}
+	if includeGroupPolicies {
+		header = append(header, "EffectivePoliciesViaGroups")
+	}
 	if err := writer.Write(header); err != nil {
 		log.Fatalf("Failed to write header to CSV: %v", err)
 	}
 
-	log.Printf("Starting to fetch IAM users and groups from %d accounts...", len(profiles))
+	iamRPS, err := parseIAMRPS(os.Getenv("IAM_RPS"))
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	// WORKER_COUNT sets how many users are enriched (groups, login profile, access keys) concurrently per account.
+	workerCount := defaultWorkerCount
+	if value := os.Getenv("WORKER_COUNT"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			log.Fatalf("Error: WORKER_COUNT must be a positive integer, got %q", value)
+		}
+		workerCount = n
+	}
+
+	rpsLabel := "unlimited"
+	if iamRPS > 0 {
+		rpsLabel = strconv.FormatFloat(iamRPS, 'g', -1, 64)
+	}
+	log.Printf("Starting to fetch IAM users and groups from %d accounts (IAM_RPS: %s, workers: %d)...", len(profiles), rpsLabel, workerCount)
+
+	// Users with both a console password and an active access key, counted once per user.
+	dualAccessUsers := 0
 
 	for _, profile := range profiles {
 		profile = strings.TrimSpace(profile)
@@ -62,13 +119,34 @@ func main() {
 			continue
 		}
 
+		// The SDK resolves IAM/STS endpoints from the region, so the region (from the
+		// profile or AWS_REGION) decides which partition is targeted.
+		if cfg.Region == "" {
+			log.Printf("WARNING: No region configured for profile '%s'; set one (e.g. us-gov-west-1) to target a non-standard partition.", profile)
+		}
+		log.Printf("Partition: %s (region: %s)", awsapi.PartitionForRegion(cfg.Region), cfg.Region)
+		if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+			log.Printf("Using custom endpoint: %s", endpoint)
+		}
+
 		accountID, err := getAccountID(cfg)
 		if err != nil {
 			log.Printf("ERROR: Failed to get Account ID for profile '%s': %v. Skipping...", profile, err)
 			continue
 		}
 
-		iamClient := iam.NewFromConfig(cfg)
+		// One limiter per account, shared by every IAM call made through this client
+		// (including calls from the enrichment workers), keeps us under IAM's request rate.
+		limiter := rate.NewLimiter(rate.Limit(iamRPS), 1)
+		if iamRPS == 0 {
+			limiter = rate.NewLimiter(rate.Inf, 0)
+		}
+		iamClient := iam.NewFromConfig(cfg, func(o *iam.Options) {
+			o.APIOptions = append(o.APIOptions, withRateLimit(limiter))
+		})
+		// Group policies are fetched once per group and reused for every member.
+		groupPolicyCache := make(map[string][]string)
+
 		userPaginator := iam.NewListUsersPaginator(iamClient, &iam.ListUsersInput{})
 		for userPaginator.HasMorePages() {
 			userOutput, err := userPaginator.NextPage(context.TODO())
@@ -77,32 +155,147 @@ func main() {
 				break
 			}
 
-			for _, user := range userOutput.Users {
-				groups, err := getGroupsForUser(iamClient, user.UserName)
-				if err != nil {
+			details := enrichUsers(iamClient, userOutput.Users, workerCount)
+			for i, user := range userOutput.Users {
+				groups, access := details[i].groups, details[i].access
+				if err := details[i].groupsErr; err != nil {
 					log.Printf("WARNING: Failed to get groups for user '%s' in profile '%s': %v", *user.UserName, profile, err)
 				}
+				if err := details[i].accessErr; err != nil {
+					log.Printf("WARNING: Failed to get console/access key status for user '%s' in profile '%s': %v", *user.UserName, profile, err)
+				}
+				if access.dual() {
+					dualAccessUsers++
+				}
 				
-				row := []string{
-					accountID,
-					profile,
-					aws.ToString(user.UserName),
-					aws.ToString(user.UserId),
-					aws.ToString(user.Arn),
-					user.CreateDate.Format(time.RFC3339),
-					strings.Join(groups, ","),
+				// In long format each user-group pair becomes its own row; users without
+				// groups still get one row with an empty Groups column.
+				groupSets := [][]string{groups}
+				if longFormat && len(groups) > 0 {
+					groupSets = groupSets[:0]
+					for _, group := range groups {
+						groupSets = append(groupSets, []string{group})
+					}
 				}
-				if err := writer.Write(row); err != nil {
-					log.Printf("WARNING: Failed to write row to CSV: %v", err)
+
+				for _, groupSet := range groupSets {
+					row := []string{
+						accountID,
+						profile,
+						aws.ToString(user.UserName),
+						aws.ToString(user.UserId),
+						aws.ToString(user.Arn),
+						user.CreateDate.Format(time.RFC3339),
+						strings.Join(groupSet, groupSeparator),
+						strconv.FormatBool(access.ConsoleAccess),
+						strconv.Itoa(access.ActiveAccessKeys),
+						strconv.FormatBool(access.dual()),
+					}
+					if includeGroupPolicies {
+						policies := getPoliciesViaGroups(iamClient, groupSet, groupPolicyCache, profile)
+						row = append(row, strings.Join(policies, groupSeparator))
+					}
+					if err := writer.Write(row); err != nil {
+						log.Printf("WARNING: Failed to write row to CSV: %v", err)
+					}
 				}
 			}
 		}
 		log.Printf("Finished processing profile: %s", profile)
 	}
 
+	if err := writer.Close(); err != nil {
+		log.Fatalf("Failed to write CSV: %v", err)
+	}
+
+	log.Printf("Users with both console access and active access keys (DualAccess): %d", dualAccessUsers)
+	hb.Complete()
 	log.Printf("✅ Successfully exported IAM user and group data to %s", csvFileName)
 }
 
+// runSelfTest checks, for every profile, that the credentials resolve (STS
+// GetCallerIdentity) and that IAM users can be listed (a single ListUsers call).
+// It prints PASS/FAIL per check and reports whether all of them passed.
+func runSelfTest(profiles []string) bool {
+	log.Printf("--- Self test (no output file will be written) ---")
+	ok := true
+	for _, profile := range profiles {
+		profile = strings.TrimSpace(profile)
+		if profile == "" {
+			continue
+		}
+
+		cfg, err := config.LoadDefaultConfig(context.TODO(),
+			config.WithSharedConfigProfile(profile),
+		)
+		if err != nil {
+			log.Printf("❌ FAIL [%s] load config: %v", profile, err)
+			ok = false
+			continue
+		}
+
+		accountID, err := getAccountID(cfg)
+		if err != nil {
+			log.Printf("❌ FAIL [%s] sts:GetCallerIdentity: %v", profile, err)
+			ok = false
+			continue
+		}
+		log.Printf("✅ PASS [%s] sts:GetCallerIdentity (account: %s)", profile, accountID)
+
+		_, err = iam.NewFromConfig(cfg).ListUsers(context.TODO(), &iam.ListUsersInput{MaxItems: aws.Int32(1)})
+		if err != nil {
+			log.Printf("❌ FAIL [%s] iam:ListUsers: %v", profile, err)
+			ok = false
+			continue
+		}
+		log.Printf("✅ PASS [%s] iam:ListUsers", profile)
+	}
+
+	if ok {
+		log.Printf("✅ Self test passed")
+	} else {
+		log.Printf("❌ Self test failed")
+	}
+	return ok
+}
+
+// defaultWorkerCount is the number of users enriched concurrently per account when WORKER_COUNT is unset.
+const defaultWorkerCount = 5
+
+// userDetail holds what enrichUsers fetched for one user.
+type userDetail struct {
+	groups    []string
+	groupsErr error
+	access    userAccess
+	accessErr error
+}
+
+// enrichUsers fetches the groups and sign-in access of users with up to workerCount
+// concurrent workers and returns them in the order of users. The workers share client,
+// and with it the account's IAM_RPS limiter.
+func enrichUsers(client *iam.Client, users []types.User, workerCount int) []userDetail {
+	details := make([]userDetail, len(users))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(workerCount, len(users)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				detail := &details[i]
+				detail.groups, detail.groupsErr = getGroupsForUser(client, users[i].UserName)
+				detail.access, detail.accessErr = getUserAccess(client, users[i].UserName)
+			}
+		}()
+	}
+	for i := range users {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return details
+}
+
 func getGroupsForUser(client *iam.Client, userName *string) ([]string, error) {
 	var groups []string
 	groupPaginator := iam.NewListGroupsForUserPaginator(client, &iam.ListGroupsForUserInput{
@@ -121,6 +314,137 @@ func getGroupsForUser(client *iam.Client, userName *string) ([]string, error) {
 	return groups, nil
 }
 
+// userAccess describes how a user can sign in: with a console password (login profile)
+// and/or with active access keys.
+type userAccess struct {
+	ConsoleAccess    bool
+	ActiveAccessKeys int
+}
+
+// dual reports whether the user has both interactive and programmatic access,
+// a higher-risk pattern flagged by policy.
+func (a userAccess) dual() bool {
+	return a.ConsoleAccess && a.ActiveAccessKeys > 0
+}
+
+// getUserAccess checks for a login profile and counts the user's active access keys.
+func getUserAccess(client *iam.Client, userName *string) (userAccess, error) {
+	var access userAccess
+
+	_, err := client.GetLoginProfile(context.TODO(), &iam.GetLoginProfileInput{UserName: userName})
+	if err == nil {
+		access.ConsoleAccess = true
+	} else {
+		// Users without a console password have no login profile.
+		var notFound *types.NoSuchEntityException
+		if !errors.As(err, &notFound) {
+			return access, err
+		}
+	}
+
+	keyPaginator := iam.NewListAccessKeysPaginator(client, &iam.ListAccessKeysInput{UserName: userName})
+	for keyPaginator.HasMorePages() {
+		output, err := keyPaginator.NextPage(context.TODO())
+		if err != nil {
+			return access, err
+		}
+		for _, key := range output.AccessKeyMetadata {
+			if key.Status == types.StatusTypeActive {
+				access.ActiveAccessKeys++
+			}
+		}
+	}
+	return access, nil
+}
+
+// getPoliciesViaGroups returns the sorted union of policies attached to or inlined in
+// the given groups. Results are cached per group name in cache.
+func getPoliciesViaGroups(client *iam.Client, groups []string, cache map[string][]string, profile string) []string {
+	seen := make(map[string]bool)
+	var policies []string
+	for _, group := range groups {
+		groupPolicies, ok := cache[group]
+		if !ok {
+			var err error
+			groupPolicies, err = getGroupPolicies(client, group)
+			if err != nil {
+				log.Printf("WARNING: Failed to get policies for group '%s' in profile '%s': %v", group, profile, err)
+			}
+			cache[group] = groupPolicies
+		}
+		for _, policy := range groupPolicies {
+			if !seen[policy] {
+				seen[policy] = true
+				policies = append(policies, policy)
+			}
+		}
+	}
+	sort.Strings(policies)
+	return policies
+}
+
+// getGroupPolicies lists a group's attached managed policies by name and its inline
+// policies prefixed with "inline:".
+func getGroupPolicies(client *iam.Client, groupName string) ([]string, error) {
+	var policies []string
+
+	attachedPaginator := iam.NewListAttachedGroupPoliciesPaginator(client, &iam.ListAttachedGroupPoliciesInput{
+		GroupName: aws.String(groupName),
+	})
+	for attachedPaginator.HasMorePages() {
+		output, err := attachedPaginator.NextPage(context.TODO())
+		if err != nil {
+			return policies, err
+		}
+		for _, policy := range output.AttachedPolicies {
+			policies = append(policies, aws.ToString(policy.PolicyName))
+		}
+	}
+
+	inlinePaginator := iam.NewListGroupPoliciesPaginator(client, &iam.ListGroupPoliciesInput{
+		GroupName: aws.String(groupName),
+	})
+	for inlinePaginator.HasMorePages() {
+		output, err := inlinePaginator.NextPage(context.TODO())
+		if err != nil {
+			return policies, err
+		}
+		for _, name := range output.PolicyNames {
+			policies = append(policies, "inline:"+name)
+		}
+	}
+
+	return policies, nil
+}
+
+// parseIAMRPS reads the per-account IAM request rate from IAM_RPS.
+// Rate limiting is off (0) unless IAM_RPS is set; SDK retries still back off on throttling.
+// A set value must be a positive number.
+func parseIAMRPS(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	rps, err := strconv.ParseFloat(value, 64)
+	if err != nil || rps <= 0 || math.IsNaN(rps) {
+		return 0, fmt.Errorf("IAM_RPS must be a positive number, got %q", value)
+	}
+	return rps, nil
+}
+
+// withRateLimit adds a middleware that waits on limiter before every request attempt,
+// including SDK retries, so throttled calls don't immediately burst again.
+func withRateLimit(limiter *rate.Limiter) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("IAMRateLimit",
+			func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+				if err := limiter.Wait(ctx); err != nil {
+					return middleware.FinalizeOutput{}, middleware.Metadata{}, err
+				}
+				return next.HandleFinalize(ctx, in)
+			}), middleware.After)
+	}
+}
+
 func getAccountID(cfg aws.Config) (string, error) {
 	stsClient := sts.NewFromConfig(cfg)
 	result, err := stsClient.GetCallerIdentity(context.TODO(), &sts.GetCallerIdentityInput{})
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"golang.org/x/time/rate"
+)
+
+func TestParseIAMRPS(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    float64
+		wantErr bool
+	}{
+		{"", 0, false}, // unset: no rate limiting
+		{"2.5", 2.5, false},
+		{"0", 0, true},
+		{"-1", 0, true},
+		{"NaN", 0, true},
+		{"fast", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseIAMRPS(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseIAMRPS(%q) = (%g, %v), want (%g, error: %v)", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// fakeIAMServer answers every IAM query action with an empty result after a short delay
+// and records how many requests were in flight at once.
+type fakeIAMServer struct {
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+	requests    int
+}
+
+func (s *fakeIAMServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.inFlight++
+	s.requests++
+	s.maxInFlight = max(s.maxInFlight, s.inFlight)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	r.ParseForm()
+	action := r.PostForm.Get("Action")
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write([]byte("<" + action + "Response><" + action + "Result><IsTruncated>false</IsTruncated>" +
+		"<LoginProfile><UserName>u</UserName><CreateDate>2024-01-01T00:00:00Z</CreateDate></LoginProfile>" +
+		"</" + action + "Result></" + action + "Response>"))
+}
+
+func newTestIAMClient(t *testing.T, server *fakeIAMServer, limiter *rate.Limiter) *iam.Client {
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	return iam.New(iam.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(httpServer.URL),
+		Credentials:  aws.AnonymousCredentials{},
+	}, func(o *iam.Options) {
+		o.APIOptions = append(o.APIOptions, withRateLimit(limiter))
+	})
+}
+
+func testUsers(n int) []types.User {
+	users := make([]types.User, n)
+	for i := range users {
+		users[i] = types.User{UserName: aws.String(string(rune('a' + i)))}
+	}
+	return users
+}
+
+func TestEnrichUsersRunsConcurrently(t *testing.T) {
+	server := &fakeIAMServer{}
+	client := newTestIAMClient(t, server, rate.NewLimiter(rate.Inf, 0))
+
+	details := enrichUsers(client, testUsers(8), 4)
+	if len(details) != 8 {
+		t.Fatalf("len(details) = %d, want 8", len(details))
+	}
+	for i, detail := range details {
+		if detail.groupsErr != nil || detail.accessErr != nil || !detail.access.ConsoleAccess {
+			t.Errorf("details[%d] = %+v", i, detail)
+		}
+	}
+	if server.maxInFlight < 2 {
+		t.Errorf("max in-flight requests = %d, want the workers to call IAM concurrently", server.maxInFlight)
+	}
+}
+
+func TestEnrichUsersSharesLimiter(t *testing.T) {
+	server := &fakeIAMServer{}
+	// 20 requests/s with a burst of 1 across all workers
+	client := newTestIAMClient(t, server, rate.NewLimiter(20, 1))
+
+	start := time.Now()
+	enrichUsers(client, testUsers(4), 4)
+	elapsed := time.Since(start)
+
+	// 4 users x 3 calls (ListGroupsForUser, GetLoginProfile, ListAccessKeys) = 12 requests,
+	// which the shared limiter spreads over at least 11/20 s regardless of the worker count.
+	if server.requests != 12 {
+		t.Fatalf("requests = %d, want 12", server.requests)
+	}
+	if elapsed < 550*time.Millisecond {
+		t.Errorf("12 requests at IAM_RPS=20 took %s, want at least 550ms", elapsed)
+	}
+}
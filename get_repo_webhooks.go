@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/google/go-github/v63/github"
+
+	"securityhub-exporter/envfile"
+	"securityhub-exporter/heartbeat"
+	"securityhub-exporter/githubapi"
+	"securityhub-exporter/report"
+)
+
+// Webhook の棚卸し結果 (シークレットや URL のパス・クエリは含めない)
+type HookRecord struct {
+	Repo   string
+	ID     int64
+	Host   string
+	Events []string
+	Active bool
+}
+
+// hookHost は、Webhook の URL からホスト名のみを取り出す。
+// パスやクエリ文字列、ユーザー情報にはトークンが含まれることがあるため出力しない
+func hookHost(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "(解析不可)"
+	}
+	return u.Host
+}
+
+// listTargetRepos は TARGET_REPOS (カンマ区切り) が設定されていればそれを、
+// 未設定なら Organization の全リポジトリ名を返す
+func listTargetRepos(ctx context.Context, client *github.Client, ownerName string) ([]string, error) {
+	if reposStr := os.Getenv("TARGET_REPOS"); reposStr != "" {
+		var repos []string
+		for _, repo := range strings.Split(reposStr, ",") {
+			if repo = strings.TrimSpace(repo); repo != "" {
+				repos = append(repos, repo)
+			}
+		}
+		return repos, nil
+	}
+
+	opt := &github.RepositoryListByOrgOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	var repos []string
+	for {
+		list, resp, err := client.Repositories.ListByOrg(ctx, ownerName, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, repo := range list {
+			repos = append(repos, repo.GetName())
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+	sort.Strings(repos)
+	return repos, nil
+}
+
+func main() {
+	if err := envfile.Load(); err != nil {
+		log.Fatalf("エラー: %v", err)
+	}
+
+	// HEARTBEAT_FILE が設定されていれば、外部監視用に実行状況を定期的に書き込む
+	hb := heartbeat.Start("get_repo_webhooks")
+	defer hb.Stop()
+
+	token := os.Getenv("GITHUB_TOKEN")
+	ownerName := os.Getenv("GITHUB_OWNER")
+	outputFile := "github_repo_webhooks.csv"
+
+	if token == "" || ownerName == "" {
+		log.Fatal("エラー: GITHUB_TOKEN または GITHUB_OWNER が .envファイル、または環境変数で設定されていません。")
+	}
+
+	ctx := context.Background()
+	client, err := githubapi.NewClient(ctx, token)
+	if err != nil {
+		log.Fatalf("エラー: %v", err)
+	}
+	// 終了時に、今回の実行で消費した API リクエスト数と残量を表示する
+	defer func() { fmt.Println(githubapi.DefaultRateUsage.Summary()) }()
+
+	// SELF_TEST=true の場合は認証とアクセス権の確認だけを行って終了する
+	if os.Getenv("SELF_TEST") == "true" {
+		if !githubapi.SelfTest(ctx, client, ownerName, true) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	repos, err := listTargetRepos(ctx, client, ownerName)
+	if err != nil {
+		log.Fatalf("リポジトリ一覧の取得に失敗しました: %v", err)
+	}
+
+	fmt.Printf("Organization '%s' の %d 件のリポジトリの Webhook を取得中...\n", ownerName, len(repos))
+
+	records := []HookRecord{}
+	for _, repo := range repos {
+		opt := &github.ListOptions{PerPage: 100}
+		for {
+			hooks, resp, err := client.Repositories.ListHooks(ctx, ownerName, repo, opt)
+			if err != nil {
+				// Webhook の参照にはリポジトリの admin 権限が必要
+				log.Printf("警告: リポジトリ %s の Webhook 取得に失敗しました: %v", repo, err)
+				break
+			}
+			for _, hook := range hooks {
+				events := append([]string{}, hook.Events...)
+				sort.Strings(events)
+				records = append(records, HookRecord{
+					Repo:   repo,
+					ID:     hook.GetID(),
+					Host:   hookHost(hook.GetConfig().GetURL()), // hook.URL は Webhook 自体の API の URL のため、配信先は config.url を使う
+					Events: events,
+					Active: hook.GetActive(),
+				})
+			}
+			if resp.NextPage == 0 {
+				break
+			}
+			opt.Page = resp.NextPage
+		}
+	}
+
+	writer, err := report.Create(outputFile, report.OptionsFromEnv())
+	if err != nil {
+		log.Fatalf("CSVファイルの作成に失敗しました: %v", err)
+	}
+	defer writer.Close()
+
+	header := []string{"Repository (リポジトリ)", "Hook ID", "Host (送信先ホスト)", "Events (イベント)", "Active (有効)"}
+	writer.Write(header)
+
+	for _, record := range records {
+		active := ""
+		if record.Active {
+			active = "○"
+		}
+		writer.Write([]string{
+			record.Repo,
+			fmt.Sprintf("%d", record.ID),
+			record.Host,
+			strings.Join(record.Events, ";"),
+			active,
+		})
+	}
+
+	if err := writer.Close(); err != nil {
+		log.Fatalf("CSVファイルの書き込みに失敗しました: %v", err)
+	}
+
+	hb.Complete()
+	fmt.Printf("\n✅ %d 件の Webhook を '%s' に保存しました。\n", len(records), outputFile)
+}
@@ -3,28 +3,81 @@ package main
 import (
 	"context"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/securityhub"
 	"github.com/aws/aws-sdk-go-v2/service/securityhub/types"
-	"github.com/joho/godotenv"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+
+	"securityhub-exporter/awsapi"
+	"securityhub-exporter/envfile"
+	"securityhub-exporter/heartbeat"
+	"securityhub-exporter/report"
 )
 
 // Finding データ構造
 type FindingDetail struct {
-	Severity    string
-	ID          string
-	Description string
-	Resource    string
+	Severity      string `json:"severity"`
+	ID            string `json:"id"`
+	Description   string `json:"description"`
+	Resource      string `json:"resource"`
+	ResourceType  string `json:"resourceType"`
+	ResourceARN   string `json:"resourceArn"`
+	PriorityScore int    `json:"priorityScore"`
+	// レコード状態 (ACTIVE/ARCHIVED) とコンプライアンス状態 (PASSED/FAILED/WARNING/NOT_AVAILABLE)
+	RecordState      string `json:"recordState"`
+	ComplianceStatus string `json:"complianceStatus"`
+	// 検出結果が属するAWSアカウントとリージョン (リージョン間の集約では集約元のリージョン)
+	AccountID string `json:"accountId"`
+	Region    string `json:"region"`
+	// 検出結果を取得した (スキャンした) リージョン
+	ScanRegion string `json:"scanRegion"`
+	// リソースの ARN から求めたリージョン (IAM・S3 などリージョンを持たないリソースは global)
+	ResourceRegion string `json:"resourceRegion"`
+	// TAG_COLUMNS で指定したキーのリソースタグ (検出結果に含まれるもののみ)
+	Tags map[string]string `json:"tags,omitempty"`
+	// コントロールID (例: S3.2)
+	ControlID string `json:"controlId"`
+	// ALLOWLIST_FILE で許容済みとされたリソースとコントロールの組み合わせか
+	Accepted bool `json:"accepted"`
+	// 実行ごとに変わらない識別子 (アカウント・コントロールID・リソースから求める。stableKey を参照)
+	StableID string `json:"stableId"`
+	// インターネットから到達可能と判断したか (internetExposed を参照)
+	InternetExposed bool `json:"internetExposed"`
+	// 初回・最終の検出日時 (RFC3339、不明な場合は空文字)
+	FirstObservedAt string `json:"firstObservedAt"`
+	LastObservedAt  string `json:"lastObservedAt"`
+	// 修復手順 (推奨事項の URL、URL がない場合は説明文)
+	Remediation string `json:"remediation"`
+	// 検出元の製品 (Security Hub、GuardDuty、Inspector など) と、検出したルール・コントロールの ID
+	ProductName string `json:"productName"`
+	GeneratorID string `json:"generatorId"`
+	// 調査担当者がワークフローで付けたメモ (更新者を含む。findingNote を参照)
+	Note string `json:"note"`
+	// DEDUP_BY_CONTROL=true で同じコントロールの行をまとめた場合の、影響を受けたリソース数
+	ResourceCount int `json:"resourceCount,omitempty"`
 }
 
 // 検知内容の日本語マッピング
@@ -83,8 +136,124 @@ var findingTitleJapanese = map[string]string{
 	"Account.1 Security contact information should be provided for an AWS account": "Account.1 AWSアカウントにセキュリティ連絡先情報を提供すべきです",
 }
 
-// タイトルを日本語に変換
+// 取得・出力の対象とする重要度 (SEVERITY_LEVELS: カンマ区切り、既定は CRITICAL,HIGH)。main で設定する
+var severityLevels = []string{"CRITICAL", "HIGH"}
+
+// parseSeverityLevels は SEVERITY_LEVELS の値を重要度の順に並べて返す
+func parseSeverityLevels(value string) ([]string, error) {
+	var levels []string
+	seen := make(map[string]bool)
+	for _, level := range strings.Split(value, ",") {
+		level = strings.ToUpper(strings.TrimSpace(level))
+		if level == "" || seen[level] {
+			continue
+		}
+		if getSeverityOrder(level) == 999 {
+			return nil, fmt.Errorf("SEVERITY_LEVELS には CRITICAL, HIGH, MEDIUM, LOW, INFORMATIONAL を指定してください (指定値: %s)", level)
+		}
+		seen[level] = true
+		levels = append(levels, level)
+	}
+	if len(levels) == 0 {
+		return nil, fmt.Errorf("SEVERITY_LEVELS に重要度が指定されていません")
+	}
+	sort.Slice(levels, func(i, j int) bool { return getSeverityOrder(levels[i]) < getSeverityOrder(levels[j]) })
+	return levels, nil
+}
+
+// 取得対象のワークフロー状態 (WORKFLOW_STATUSES: カンマ区切り、既定は NEW,NOTIFIED)。main で設定する
+var workflowStatuses = []string{"NEW", "NOTIFIED"}
+
+// parseWorkflowStatuses は WORKFLOW_STATUSES の値を検証して返す
+func parseWorkflowStatuses(value string) ([]string, error) {
+	allowed := map[string]bool{"NEW": true, "NOTIFIED": true, "RESOLVED": true, "SUPPRESSED": true}
+	var statuses []string
+	seen := make(map[string]bool)
+	for _, status := range strings.Split(value, ",") {
+		status = strings.ToUpper(strings.TrimSpace(status))
+		if status == "" || seen[status] {
+			continue
+		}
+		if !allowed[status] {
+			return nil, fmt.Errorf("WORKFLOW_STATUSES には NEW, NOTIFIED, RESOLVED, SUPPRESSED を指定してください (指定値: %s)", status)
+		}
+		seen[status] = true
+		statuses = append(statuses, status)
+	}
+	if len(statuses) == 0 {
+		return nil, fmt.Errorf("WORKFLOW_STATUSES にワークフロー状態が指定されていません")
+	}
+	return statuses, nil
+}
+
+// 出力言語 (LOCALE: "ja" は日本語、"en" は英語のみ)。main で設定する
+var locale = "ja"
+
+// 出力対象のリソースタイプ (RESOURCE_TYPES: カンマ区切り)。main で設定する (nil の場合はすべて対象)
+var resourceTypes map[string]bool
+
+// 出力から除外する検出結果の Id (EXCLUDE_FINDING_IDS: カンマ区切り)。main で設定する
+var excludedFindingIDs map[string]bool
+
+// DEDUP_BY_CONTROL=true の場合に、同じコントロールの行を1行にまとめる。main で設定する
+var dedupByControl bool
+
+// STABLE_ID=true の場合に、CSV に StableID 列を出力する。main で設定する
+var stableIDColumn bool
+
+// CSV に列として出力するリソースタグのキー (TAG_COLUMNS: カンマ区切り)。main で設定する
+var tagColumns []string
+
+// resourceTags は、検出結果に含まれるリソースのタグのうち tagColumns のキーのみを返す。
+// 追加の API 呼び出しは行わず、タグが含まれない場合は nil を返す
+func resourceTags(resource types.Resource) map[string]string {
+	if len(tagColumns) == 0 || resource.Tags == nil {
+		return nil
+	}
+	tags := make(map[string]string)
+	for _, key := range tagColumns {
+		if value, ok := resource.Tags[key]; ok {
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+// 出力言語に応じて日本語または英語の文言を返す (CSVヘッダー用)
+func localize(japanese, english string) string {
+	if locale == "en" {
+		return english
+	}
+	return japanese
+}
+
+// loadTranslations は、英語タイトル -> 日本語タイトルの JSON ファイルを読み込み、
+// 組み込みの findingTitleJapanese に追加する (同じタイトルはファイルの訳で上書き)。
+// ファイルがない場合は組み込みの訳のみを使い、読み込んだ件数として 0 を返す
+func loadTranslations(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("翻訳ファイルの読み込みに失敗しました (%s): %w", path, err)
+	}
+
+	var translations map[string]string
+	if err := json.Unmarshal(data, &translations); err != nil {
+		return 0, fmt.Errorf("翻訳ファイルの形式が正しくありません (%s): %w", path, err)
+	}
+	for english, japanese := range translations {
+		findingTitleJapanese[english] = japanese
+	}
+	return len(translations), nil
+}
+
+// タイトルを日本語に変換 (LOCALE=en の場合は変換しない)
 func translateTitle(englishTitle string) string {
+	if locale == "en" {
+		return englishTitle
+	}
 	if japanese, ok := findingTitleJapanese[englishTitle]; ok {
 		return japanese
 	}
@@ -97,14 +266,211 @@ func getSeverityOrder(severity string) int {
 	order := map[string]int{
 		"CRITICAL":      0,
 		"HIGH":          1,
-		// "MEDIUM":        2,
-		// "LOW":           3,
-		// "INFORMATIONAL": 4,
+		"MEDIUM":        2,
+		"LOW":           3,
+		"INFORMATIONAL": 4,
 	}
 	if val, ok := order[severity]; ok {
 		return val
 	}
-	return 999 // CRITICAL/HIGH以外は最後尾
+	return 999 // 不明な重要度は最後尾
+}
+
+// 優先度スコアの算出式 (最大100点、高いほど優先して対応すべき)
+//   重要度:   CRITICAL=40, HIGH=30, MEDIUM=20, LOW=10, その他=0
+//   経過日数: 初回検出からの日数 ÷ 3 (上限30点、90日で頭打ち)
+//   露出度:   外部公開に関わるコントロール (publicExposureControls) なら20点
+//   件数:     同じ検知内容の行数 (上限10点)
+var severityScore = map[string]int{
+	"CRITICAL": 40,
+	"HIGH":     30,
+	"MEDIUM":   20,
+	"LOW":      10,
+}
+
+// 外部公開 (パブリックアクセス、0.0.0.0/0 の開放など) に関わるコントロールID
+var publicExposureControls = map[string]bool{
+	"EC2.2":    true,
+	"EC2.18":   true,
+	"EC2.19":   true,
+	"4.1":      true,
+	"4.3":      true,
+	"S3.1":     true,
+	"S3.2":     true,
+	"S3.8":     true,
+	"SSM.7":    true,
+	"Lambda.1": true,
+	"RDS.1":    true,
+	"RDS.2":    true,
+}
+
+// 意図的に公開しているリソースなど、許容済みとするリソースIDとコントロールIDの組み合わせ
+// (リソースID → コントロールID の集合)。ALLOWLIST_FILE から main で設定する
+var allowlist map[string]map[string]bool
+
+// loadAllowlist は、1行に「リソースID,コントロールID」を記載した CSV を読み込む。
+// 複数のコントロールを許容する場合は行を分けて記載する。# で始まる行はコメントとして無視する
+func loadAllowlist(path string) (map[string]map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("許容リストを開けませんでした: %w", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	entries := make(map[string]map[string]bool)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("許容リストの読み込みに失敗しました (%s): %w", path, err)
+		}
+		resourceID, controlID := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+		if resourceID == "" || controlID == "" {
+			return nil, fmt.Errorf("許容リストにリソースIDまたはコントロールIDが空の行があります (%s)", path)
+		}
+		if entries[resourceID] == nil {
+			entries[resourceID] = make(map[string]bool)
+		}
+		entries[resourceID][controlID] = true
+	}
+	return entries, nil
+}
+
+// タイトル先頭のコントロールID (例: "EC2.19 Security groups ..." → "EC2.19") を取り出す
+func controlIDFromTitle(title string) string {
+	if i := strings.IndexByte(title, ' '); i > 0 {
+		return title[:i]
+	}
+	return title
+}
+
+// stableKey は、検出結果と対象リソースから実行をまたいで変わらない識別子を求める。
+// 検出結果の Id にはリージョンや検出時の UUID などが含まれ、再作成されると変わるため、
+// アカウント・コントロールID・リソースID のみを "|" でつないで比較や重複排除のキーとする
+func stableKey(finding types.AwsSecurityFinding, resourceID string) string {
+	return strings.Join([]string{aws.ToString(finding.AwsAccountId), findingControlID(finding), resourceID}, "|")
+}
+
+// findingControlID は、検出結果のセキュリティ標準のコントロールID を返す。
+// 統合されたコントロールの検出結果では Compliance.SecurityControlId、それ以外は ProductFields の ControlId を使い、
+// どちらもない場合はタイトル先頭から取り出す
+func findingControlID(finding types.AwsSecurityFinding) string {
+	if finding.Compliance != nil && aws.ToString(finding.Compliance.SecurityControlId) != "" {
+		return aws.ToString(finding.Compliance.SecurityControlId)
+	}
+	if controlID := finding.ProductFields["ControlId"]; controlID != "" {
+		return controlID
+	}
+	return controlIDFromTitle(aws.ToString(finding.Title))
+}
+
+// 件数以外の要素 (重要度・経過日数・露出度) から優先度スコアを算出
+func basePriorityScore(finding types.AwsSecurityFinding, severity string, now time.Time) int {
+	score := severityScore[severity]
+
+	observedAt := finding.FirstObservedAt
+	if observedAt == nil {
+		observedAt = finding.CreatedAt
+	}
+	if observedAt != nil {
+		if t, err := time.Parse(time.RFC3339, *observedAt); err == nil {
+			days := int(now.Sub(t).Hours() / 24)
+			score += min(max(days, 0)/3, 30)
+		}
+	}
+
+	if publicExposureControls[findingControlID(finding)] {
+		score += 20
+	}
+
+	return score
+}
+
+// internetExposed は、リソースがインターネットから到達可能かを Security Hub が返す情報のみで判定する。
+// リソース詳細に 0.0.0.0/0 (::/0) からの受信許可、RDS のパブリックアクセス、
+// S3 のパブリックアクセスブロック無効が含まれる場合か、外部公開に関わるコントロールで FAILED の場合に true
+func internetExposed(finding types.AwsSecurityFinding, resource types.Resource) bool {
+	if details := resource.Details; details != nil {
+		if sg := details.AwsEc2SecurityGroup; sg != nil {
+			for _, permission := range sg.IpPermissions {
+				for _, r := range permission.IpRanges {
+					if aws.ToString(r.CidrIp) == "0.0.0.0/0" {
+						return true
+					}
+				}
+				for _, r := range permission.Ipv6Ranges {
+					if aws.ToString(r.CidrIpv6) == "::/0" {
+						return true
+					}
+				}
+			}
+		}
+		if db := details.AwsRdsDbInstance; db != nil && aws.ToBool(db.PubliclyAccessible) {
+			return true
+		}
+		if bucket := details.AwsS3Bucket; bucket != nil && s3BucketPublic(bucket.PublicAccessBlockConfiguration) {
+			return true
+		}
+	}
+
+	return finding.Compliance != nil && finding.Compliance.Status == types.ComplianceStatusFailed &&
+		publicExposureControls[findingControlID(finding)]
+}
+
+// s3BucketPublic は、バケットのパブリックアクセスブロックが公開を防いでいないかを返す。
+// ブロックが未設定 (nil) の場合と、ACL (BlockPublicAcls・IgnorePublicAcls) と
+// バケットポリシー (BlockPublicPolicy・RestrictPublicBuckets) のどちらかの経路が両方とも無効な場合に true
+func s3BucketPublic(block *types.AwsS3AccountPublicAccessBlockDetails) bool {
+	if block == nil {
+		return true
+	}
+	aclOpen := !aws.ToBool(block.BlockPublicAcls) && !aws.ToBool(block.IgnorePublicAcls)
+	policyOpen := !aws.ToBool(block.BlockPublicPolicy) && !aws.ToBool(block.RestrictPublicBuckets)
+	return aclOpen || policyOpen
+}
+
+// remediation は、検出結果の推奨事項の URL を返す。URL がない場合は説明文を返す
+func remediation(finding types.AwsSecurityFinding) string {
+	if finding.Remediation == nil || finding.Remediation.Recommendation == nil {
+		return ""
+	}
+	recommendation := finding.Remediation.Recommendation
+	if url := aws.ToString(recommendation.Url); url != "" {
+		return url
+	}
+	return aws.ToString(recommendation.Text)
+}
+
+// findingNote は、ワークフローで検出結果に付けられたメモを返す。
+// 更新者がわかる場合は末尾に "(更新者)" を付け、メモがない場合は空文字を返す
+func findingNote(finding types.AwsSecurityFinding) string {
+	if finding.Note == nil || aws.ToString(finding.Note.Text) == "" {
+		return ""
+	}
+	text := aws.ToString(finding.Note.Text)
+	if updatedBy := aws.ToString(finding.Note.UpdatedBy); updatedBy != "" {
+		text += " (" + updatedBy + ")"
+	}
+	return text
+}
+
+// formatTimestamp は、Security Hub のタイムスタンプを RFC3339 に揃える (nil の場合は空文字)
+func formatTimestamp(value *string) string {
+	if value == nil {
+		return ""
+	}
+	t, err := time.Parse(time.RFC3339, *value)
+	if err != nil {
+		return *value
+	}
+	return t.Format(time.RFC3339)
 }
 
 // リソース情報をフォーマット
@@ -132,6 +498,14 @@ func formatResource(resource types.Resource) string {
 				// S3バケットの場合
 				bucketName := *resource.Details.AwsS3Bucket.Name
 				parts = append(parts, bucketName)
+			} else if resource.Details.AwsRdsDbInstance != nil &&
+			          resource.Details.AwsRdsDbInstance.DBInstanceIdentifier != nil {
+				// RDS DBインスタンスの場合
+				parts = append(parts, *resource.Details.AwsRdsDbInstance.DBInstanceIdentifier)
+			} else if resource.Details.AwsLambdaFunction != nil &&
+			          resource.Details.AwsLambdaFunction.FunctionName != nil {
+				// Lambda関数の場合
+				parts = append(parts, *resource.Details.AwsLambdaFunction.FunctionName)
 			} else {
 				parts = append(parts, resourceID)
 			}
@@ -143,274 +517,1578 @@ func formatResource(resource types.Resource) string {
 	return strings.Join(parts, "\n")
 }
 
-// 並列処理でSecurity Hubの検出結果を取得
-func fetchFindings(ctx context.Context, client *securityhub.Client, workerCount int) ([]types.AwsSecurityFinding, error) {
-	log.Println("Security Hubから検出結果を取得中...")
-	startTime := time.Now()
-
-	input := &securityhub.GetFindingsInput{
-		Filters: &types.AwsSecurityFindingFilters{
-			WorkflowStatus: []types.StringFilter{
-				{Value: stringPtr("NEW"), Comparison: types.StringFilterComparisonEquals},
-				{Value: stringPtr("NOTIFIED"), Comparison: types.StringFilterComparisonEquals},
-			},
-			// CRITICALとHIGHのみにフィルタリング
-			SeverityLabel: []types.StringFilter{
-				{Value: stringPtr("CRITICAL"), Comparison: types.StringFilterComparisonEquals},
-				{Value: stringPtr("HIGH"), Comparison: types.StringFilterComparisonEquals},
-			},
-		},
-		MaxResults: int32Ptr(100),
+// resourceRegionFromARN は ARN (arn:partition:service:region:account:resource) からリージョンを返す。
+// IAM や S3 など ARN にリージョンを含まないリソースは global、ARN でない ID は空文字を返す
+func resourceRegionFromARN(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) < 6 || parts[0] != "arn" {
+		return ""
 	}
+	if parts[3] == "" {
+		return "global"
+	}
+	return parts[3]
+}
 
-	var allFindings []types.AwsSecurityFinding
-	var findingsMux sync.Mutex
-	var wg sync.WaitGroup
-	var fetchErr error
-	var errMux sync.Mutex
-
-	tokenQueue := make(chan *string, 1000)
-	var tokenQueueOpen sync.Mutex
-	isQueueOpen := true
-
-	tokenQueue <- nil
-
-	var activeWorkers sync.WaitGroup
-
-	for i := 0; i < workerCount; i++ {
-		wg.Add(1)
-		go func(workerID int) {
-			defer wg.Done()
-
-			for {
-				tokenQueueOpen.Lock()
-				if !isQueueOpen && len(tokenQueue) == 0 {
-					tokenQueueOpen.Unlock()
-					break
-				}
-				tokenQueueOpen.Unlock()
-
-				var token *string
-				var ok bool
-				select {
-				case token, ok = <-tokenQueue:
-					if !ok {
-						return
-					}
-				case <-time.After(2 * time.Second):
-					return
-				}
-
-				errMux.Lock()
-				if fetchErr != nil {
-					errMux.Unlock()
-					return
-				}
-				errMux.Unlock()
-
-				activeWorkers.Add(1)
-				pageInput := *input
-				pageInput.NextToken = token
+// リソースタグによる絞り込み条件 (RESOURCE_TAG=Environment=prod)
+type ResourceTagFilter struct {
+	Key   string
+	Value string
+}
 
-				resp, err := client.GetFindings(ctx, &pageInput)
-				if err != nil {
-					errMux.Lock()
-					if fetchErr == nil {
-						fetchErr = fmt.Errorf("worker %d error: %w", workerID, err)
-					}
-					errMux.Unlock()
-					activeWorkers.Done()
-					return
-				}
+// parseResourceTag は RESOURCE_TAG の値を key=value として解釈する
+func parseResourceTag(value string) (ResourceTagFilter, error) {
+	key, tagValue, found := strings.Cut(value, "=")
+	key = strings.TrimSpace(key)
+	if !found || key == "" {
+		return ResourceTagFilter{}, fmt.Errorf("RESOURCE_TAG は key=value の形式で指定してください (指定値: %s)", value)
+	}
+	return ResourceTagFilter{Key: key, Value: strings.TrimSpace(tagValue)}, nil
+}
 
-				findingsMux.Lock()
-				allFindings = append(allFindings, resp.Findings...)
-				currentCount := len(allFindings)
-				findingsMux.Unlock()
+// S3 のうち、バケットのタグの取得に使う API (テストで差し替えられるようにインターフェースにする)
+type s3TaggingAPI interface {
+	GetBucketLocation(ctx context.Context, params *s3.GetBucketLocationInput, optFns ...func(*s3.Options)) (*s3.GetBucketLocationOutput, error)
+	GetBucketTagging(ctx context.Context, params *s3.GetBucketTaggingInput, optFns ...func(*s3.Options)) (*s3.GetBucketTaggingOutput, error)
+}
 
-				log.Printf("Worker %d: 取得済み %d 件 (累計: %d 件)", workerID, len(resp.Findings), currentCount)
+// 検出結果にはリソースのタグが含まれないため、EC2/S3 の API で取得する。
+// API 呼び出しが多くなるため、同じリソース ARN の結果はキャッシュして再利用する
+type resourceTagLookup struct {
+	ec2Client ec2.DescribeTagsAPIClient
+	s3Client  s3TaggingAPI
+	cache     map[string]map[string]string
+	// バケット名 → バケットのリージョン (GetBucketLocation の結果)
+	bucketRegions map[string]string
+}
 
-				if resp.NextToken != nil {
-					tokenQueueOpen.Lock()
-					if isQueueOpen {
-						select {
-						case tokenQueue <- resp.NextToken:
-						default:
-							log.Printf("警告: トークンキューが満杯です")
-						}
-					}
-					tokenQueueOpen.Unlock()
-				}
+func newResourceTagLookup(cfg aws.Config) *resourceTagLookup {
+	return &resourceTagLookup{
+		ec2Client:     ec2.NewFromConfig(cfg),
+		s3Client:      s3.NewFromConfig(cfg),
+		cache:         make(map[string]map[string]string),
+		bucketRegions: make(map[string]string),
+	}
+}
 
-				activeWorkers.Done()
-			}
-		}(i)
+// bucketRegion はバケットのリージョンを返す。
+// S3 の ARN にはリージョンが含まれず、検出結果のリージョン (スキャンしたリージョンや集約先) とも一致するとは限らないため、
+// GetBucketLocation で求める
+func (l *resourceTagLookup) bucketRegion(ctx context.Context, bucket string) (string, error) {
+	if region, ok := l.bucketRegions[bucket]; ok {
+		return region, nil
+	}
+	output, err := l.s3Client.GetBucketLocation(ctx, &s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		return "", fmt.Errorf("バケット %s のリージョンの取得に失敗: %w", bucket, err)
 	}
+	// us-east-1 のバケットは LocationConstraint が空、古い eu-west-1 のバケットは EU になる
+	region := string(output.LocationConstraint)
+	switch region {
+	case "":
+		region = "us-east-1"
+	case "EU":
+		region = "eu-west-1"
+	}
+	l.bucketRegions[bucket] = region
+	return region, nil
+}
 
-	go func() {
-		ticker := time.NewTicker(500 * time.Millisecond)
-		defer ticker.Stop()
+// resourceTagsSupported はタグを取得できるリソースタイプかどうかを返す
+func resourceTagsSupported(resourceType string) bool {
+	return strings.HasPrefix(resourceType, "AwsEc2") || resourceType == "AwsS3Bucket"
+}
 
-		for range ticker.C {
-			activeWorkers.Wait()
+// tags は detail のリソースのタグを返す。リソースのリージョンで API を呼び出す
+// (EC2 は ARN のリージョン、S3 はバケットのリージョン)
+func (l *resourceTagLookup) tags(ctx context.Context, detail FindingDetail) (map[string]string, error) {
+	if tags, ok := l.cache[detail.ResourceARN]; ok {
+		return tags, nil
+	}
 
-			tokenQueueOpen.Lock()
-			if len(tokenQueue) == 0 && isQueueOpen {
-				isQueueOpen = false
-				close(tokenQueue)
-				tokenQueueOpen.Unlock()
-				return
+	tags := make(map[string]string)
+	if detail.ResourceType == "AwsS3Bucket" {
+		// ARN の形式: arn:aws:s3:::bucket-name
+		bucket := detail.ResourceARN[strings.LastIndex(detail.ResourceARN, ":")+1:]
+		region, err := l.bucketRegion(ctx, bucket)
+		if err != nil {
+			return nil, err
+		}
+		output, err := l.s3Client.GetBucketTagging(ctx, &s3.GetBucketTaggingInput{Bucket: aws.String(bucket)},
+			func(o *s3.Options) { o.Region = region })
+		if err != nil {
+			// タグが1つもないバケットは NoSuchTagSet エラーになる
+			var apiErr smithy.APIError
+			if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "NoSuchTagSet" {
+				return nil, err
+			}
+		} else {
+			for _, tag := range output.TagSet {
+				tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
 			}
-			tokenQueueOpen.Unlock()
 		}
-	}()
+	} else {
+		// ARN の形式: arn:aws:ec2:region:account:instance/i-xxxxxxxx
+		resourceID := detail.ResourceARN[strings.LastIndex(detail.ResourceARN, "/")+1:]
+		region := detail.ResourceRegion
+		if region == "" || region == "global" {
+			region = detail.Region
+		}
+		paginator := ec2.NewDescribeTagsPaginator(l.ec2Client, &ec2.DescribeTagsInput{
+			Filters: []ec2types.Filter{{Name: aws.String("resource-id"), Values: []string{resourceID}}},
+		})
+		for paginator.HasMorePages() {
+			output, err := paginator.NextPage(ctx, func(o *ec2.Options) { o.Region = region })
+			if err != nil {
+				return nil, err
+			}
+			for _, tag := range output.Tags {
+				tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+			}
+		}
+	}
 
-	wg.Wait()
+	l.cache[detail.ResourceARN] = tags
+	return tags, nil
+}
 
-	if fetchErr != nil {
-		return nil, fetchErr
-	}
+// filterByResourceTag は、リソースに指定のタグが付いている行だけを残す。
+// タグを取得できないリソースタイプや、取得に失敗したリソースの行は除外する
+func filterByResourceTag(ctx context.Context, details []FindingDetail, lookup *resourceTagLookup, filter ResourceTagFilter) []FindingDetail {
+	log.Printf("リソースタグ %s=%s で絞り込み中...", filter.Key, filter.Value)
 
-	elapsed := time.Since(startTime)
-	log.Printf("取得完了: %d 件 (所要時間: %s)", len(allFindings), elapsed)
-	
-	// デバッグ: 重大度別の件数を表示
-	severityCounts := make(map[string]int)
-	for _, f := range allFindings {
-		if f.Severity != nil {
-			severityCounts[string(f.Severity.Label)]++
+	filtered := make([]FindingDetail, 0, len(details))
+	unsupported := 0
+	failed := 0
+	for _, detail := range details {
+		if detail.ResourceARN == "" || !resourceTagsSupported(detail.ResourceType) {
+			unsupported++
+			continue
 		}
-	}
-	log.Println("=== 取得した検出結果の重大度別内訳 ===")
-	for _, sev := range []string{"CRITICAL", "HIGH"} { // MEDIUM, LOW, INFORMATIONALをコメントアウト
-		if count, ok := severityCounts[sev]; ok {
-			log.Printf("  %s: %d件", sev, count)
+		tags, err := lookup.tags(ctx, detail)
+		if err != nil {
+			log.Printf("警告: リソース %s のタグ取得に失敗しました: %v", detail.ResourceARN, err)
+			// 同じリソースで何度も失敗しないよう、空のタグとしてキャッシュする
+			lookup.cache[detail.ResourceARN] = map[string]string{}
+			failed++
+			continue
+		}
+		if value, ok := tags[filter.Key]; ok && value == filter.Value {
+			filtered = append(filtered, detail)
 		}
 	}
 
-	return allFindings, nil
+	log.Printf("タグ絞り込み完了: %d 行 → %d 行 (タグ取得対象外: %d 行, 取得失敗: %d 行, 参照したリソース: %d 件)",
+		len(details), len(filtered), unsupported, failed, len(lookup.cache))
+	return filtered
 }
 
-// 検出結果を変換（全件を個別に出力）
-func convertFindings(findings []types.AwsSecurityFinding) []FindingDetail {
-	log.Println("検出結果を変換中...")
+// 検出結果の取得条件 (GetFindings のフィルタとしてサーバー側で絞り込む)
+type FindingQuery struct {
+	// 特定リソースの検出結果のみ取得する場合のリソースID (ARN)
+	ResourceID string
+	// ResourceID の比較方法 (EQUALS: 完全一致、PREFIX: 前方一致)
+	ResourceIDComparison types.StringFilterComparison
+	// レコード状態 (ACTIVE: 有効な検出結果、ARCHIVED: アーカイブ済み、空の場合は絞り込まない)
+	RecordState string
+	// コンプライアンス状態 (PASSED の場合は準拠しているコントロールの検出結果を取得する)
+	ComplianceStatus string
+	// この時刻より後に更新された検出結果のみ取得する (ゼロ値の場合は絞り込まない)
+	UpdatedAfter time.Time
+	// セキュリティ標準 (cis, pci, fsbp。standardIDPrefixes を参照、空の場合は絞り込まない)
+	Standard string
+}
 
-	details := make([]FindingDetail, 0, len(findings)*2)
+// STANDARD の値ごとの、検出結果の Compliance.AssociatedStandards[].StandardsId の前方一致条件。
+// StandardsId は標準のバージョンごとに異なるため、バージョンを含まない部分で一致させる
+//   cis:  ruleset/cis-aws-foundations-benchmark/v/1.2.0、standards/cis-aws-foundations-benchmark/v/1.4.0 など
+//         (ARN は arn:aws:securityhub:::ruleset/cis-aws-foundations-benchmark/v/1.2.0、
+//          arn:aws:securityhub:<region>::standards/cis-aws-foundations-benchmark/v/1.4.0 など)
+//   pci:  standards/pci-dss/v/3.2.1 など (arn:aws:securityhub:<region>::standards/pci-dss/v/3.2.1)
+//   fsbp: standards/aws-foundational-security-best-practices/v/1.0.0
+//         (arn:aws:securityhub:<region>::standards/aws-foundational-security-best-practices/v/1.0.0)
+var standardIDPrefixes = map[string][]string{
+	"cis":  {"ruleset/cis-aws-foundations-benchmark/", "standards/cis-aws-foundations-benchmark/"},
+	"pci":  {"standards/pci-dss/"},
+	"fsbp": {"standards/aws-foundational-security-best-practices/"},
+}
 
-	for _, finding := range findings {
-		severity := ""
-		if finding.Severity != nil && finding.Severity.Label != "" {
-			severity = string(finding.Severity.Label)
-		}
+// 取得条件から GetFindings のフィルタを組み立てる
+func buildFindingFilters(query FindingQuery) *types.AwsSecurityFindingFilters {
+	filters := &types.AwsSecurityFindingFilters{}
 
-		// CRITICAL と HIGH のみ処理
-		if severity != "CRITICAL" && severity != "HIGH" {
-			continue
-		}
+	// WORKFLOW_STATUSES で指定したワークフロー状態のみにフィルタリング
+	for _, status := range workflowStatuses {
+		filters.WorkflowStatus = append(filters.WorkflowStatus, types.StringFilter{
+			Value: stringPtr(status), Comparison: types.StringFilterComparisonEquals,
+		})
+	}
 
-		id := ""
-		if finding.Id != nil {
-			id = *finding.Id
-		}
+	// SEVERITY_LEVELS で指定した重要度のみにフィルタリング
+	for _, level := range severityLevels {
+		filters.SeverityLabel = append(filters.SeverityLabel, types.StringFilter{
+			Value: stringPtr(level), Comparison: types.StringFilterComparisonEquals,
+		})
+	}
 
-		description := ""
-		if finding.Title != nil {
-			// タイトルを日本語に変換
-			description = translateTitle(*finding.Title)
+	if query.ComplianceStatus != "" {
+		filters.ComplianceStatus = []types.StringFilter{
+			{Value: stringPtr(query.ComplianceStatus), Comparison: types.StringFilterComparisonEquals},
 		}
-
-		// リソースがある場合は各リソースごとに行を作成
-		if len(finding.Resources) > 0 {
-			for _, resource := range finding.Resources {
-				resourceStr := formatResource(resource)
-				
-				details = append(details, FindingDetail{
-					Severity:    severity,
-					ID:          id,
-					Description: description,
-					Resource:    resourceStr,
-				})
-			}
-		} else {
-			// リソースがない場合も1行作成
-			details = append(details, FindingDetail{
-				Severity:    severity,
-				ID:          id,
-				Description: description,
-				Resource:    "",
-			})
+		// PASSED になった検出結果は、Security Hub が重要度を INFORMATIONAL に、
+		// ワークフローを RESOLVED に更新するため、重要度とワークフローでは絞り込まない
+		if query.ComplianceStatus == "PASSED" {
+			filters.WorkflowStatus = nil
+			filters.SeverityLabel = nil
 		}
 	}
 
-	// 重大度順にソート
-	sort.Slice(details, func(i, j int) bool {
-		severityOrderI := getSeverityOrder(details[i].Severity)
-		severityOrderJ := getSeverityOrder(details[j].Severity)
-		if severityOrderI != severityOrderJ {
-			return severityOrderI < severityOrderJ
+	if query.RecordState != "" {
+		filters.RecordState = []types.StringFilter{
+			{Value: stringPtr(query.RecordState), Comparison: types.StringFilterComparisonEquals},
 		}
-		
-		if details[i].Description != details[j].Description {
-			return details[i].Description < details[j].Description
+	}
+
+	if query.ResourceID != "" {
+		filters.ResourceId = []types.StringFilter{
+			{Value: stringPtr(query.ResourceID), Comparison: query.ResourceIDComparison},
 		}
-		
-		return details[i].ID < details[j].ID
-	})
+	}
 
-	log.Printf("変換完了: %d 件の検出結果を %d 行に展開", len(findings), len(details))
+	for _, prefix := range standardIDPrefixes[query.Standard] {
+		filters.ComplianceAssociatedStandardsId = append(filters.ComplianceAssociatedStandardsId, types.StringFilter{
+			Value: stringPtr(prefix), Comparison: types.StringFilterComparisonPrefix,
+		})
+	}
 
-	return details
+	// Security Hub のタイムスタンプはミリ秒単位のため、前回の最大値の 1 ミリ秒後から取得する
+	if !query.UpdatedAfter.IsZero() {
+		filters.UpdatedAt = []types.DateFilter{{
+			Start: stringPtr(query.UpdatedAfter.Add(time.Millisecond).UTC().Format(securityHubTimeFormat)),
+			End:   stringPtr(time.Now().UTC().Format(securityHubTimeFormat)),
+		}}
+	}
+
+	return filters
 }
 
-// CSV出力
-func exportToCSV(details []FindingDetail, outputFile string) error {
-	log.Printf("CSVファイルに出力中: %s", outputFile)
+// Security Hub の日付フィルタに指定するタイムスタンプの形式
+const securityHubTimeFormat = "2006-01-02T15:04:05.000Z"
 
-	outputDir := "/mnt/user-data/outputs"
-	if _, err := os.Stat(outputDir); os.IsNotExist(err) {
-		outputFile = "./security_hub_findings.csv"
-		log.Printf("出力先を変更: %s", outputFile)
-	}
+// 差分取得 (INCREMENTAL) の状態。前回までに取得した検出結果の UpdatedAt の最大値を保存する
+type incrementalState struct {
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+}
 
-	file, err := os.Create(outputFile)
+// loadIncrementalState は状態ファイルを読み込む。ファイルがない場合 (初回) はゼロ値を返す
+func loadIncrementalState(path string) (incrementalState, error) {
+	var state incrementalState
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
 	if err != nil {
-		return fmt.Errorf("ファイル作成エラー: %w", err)
+		return state, fmt.Errorf("状態ファイルの読み込みに失敗しました (%s): %w", path, err)
 	}
-	defer file.Close()
-
-	// UTF-8 BOMを追加
-	file.Write([]byte{0xEF, 0xBB, 0xBF})
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("状態ファイルの形式が正しくありません (%s): %w", path, err)
+	}
+	return state, nil
+}
 
-	// ヘッダー行
-	headers := []string{
-		"重要度",
-		"ID",
-		"検知内容",
-		"リソース",
+// saveIncrementalState は状態ファイルを書き込む (途中で失敗しても前回の状態は壊さない)
+func saveIncrementalState(path string, state incrementalState) error {
+	file, err := report.CreateAtomic(path)
+	if err != nil {
+		return err
 	}
-	if err := writer.Write(headers); err != nil {
-		return fmt.Errorf("ヘッダー書き込みエラー: %w", err)
+	defer file.Abort()
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(state); err != nil {
+		return fmt.Errorf("状態ファイルの書き込みに失敗しました (%s): %w", path, err)
 	}
+	return file.Commit()
+}
 
-	// データ行
-	for _, detail := range details {
-		record := []string{
-			detail.Severity,
-			detail.ID,
-			detail.Description,
-			detail.Resource,
-		}
-		if err := writer.Write(record); err != nil {
-			return fmt.Errorf("データ書き込みエラー: %w", err)
+// latestUpdatedAt は、検出結果の UpdatedAt と latest のうち最も新しい時刻を返す
+func latestUpdatedAt(findings []scannedFinding, latest time.Time) time.Time {
+	for _, finding := range findings {
+		if t, err := time.Parse(time.RFC3339, aws.ToString(finding.UpdatedAt)); err == nil && t.After(latest) {
+			latest = t
 		}
 	}
+	return latest
+}
 
-	log.Println("CSV出力完了")
+// commitIncrementalState は、正常終了時に状態ファイルを更新する
+func commitIncrementalState(path string, state incrementalState) {
+	if state.LastUpdatedAt.IsZero() {
+		return
+	}
+	if err := saveIncrementalState(path, state); err != nil {
+		log.Fatalf("❌ 状態ファイルの更新に失敗: %v", err)
+	}
+	log.Printf("状態ファイルを更新しました: %s (最終更新日時: %s)", path, state.LastUpdatedAt.UTC().Format(securityHubTimeFormat))
+}
+
+// 件数の見積もりで取得する1ページの件数 (GetFindings の上限)
+const estimatePageSize = 100
+
+// 検出結果の件数見積もり (1リージョン分)
+type findingEstimate struct {
+	FirstPage int  // 1ページ目の件数
+	More      bool // 2ページ目以降があるか (NextToken あり)
+}
+
+// LowerBound は、件数の下限を返す。
+// 続きがない場合は1ページ目の件数がそのまま確定値になる。NextToken からは残りの件数がわからないため、
+// 続きがある場合に確実に言えるのは「1ページ目の件数より多い」ことだけで、下限は1ページ目の件数 + 1 とする
+func (e findingEstimate) LowerBound() int {
+	if !e.More {
+		return e.FirstPage
+	}
+	return e.FirstPage + 1
+}
+
+// estimateFindingCount は、同じフィルタで1ページ目だけを取得して件数を見積もる。
+// Security Hub には件数取得APIがないため、追加のページは取得しない
+func estimateFindingCount(ctx context.Context, client findingsAPI, filters *types.AwsSecurityFindingFilters) (findingEstimate, error) {
+	resp, err := client.GetFindings(ctx, &securityhub.GetFindingsInput{
+		Filters:    filters,
+		MaxResults: int32Ptr(estimatePageSize),
+	})
+	if err != nil {
+		return findingEstimate{}, err
+	}
+	return findingEstimate{FirstPage: len(resp.Findings), More: resp.NextToken != nil}, nil
+}
+
+// 件数の見積もりを本取得と並行してリージョンごとに実行し、結果をログに出す (本取得は待たせない)。
+// client は regions[0] のクライアントで、他のリージョンはそれぞれクライアントを作成する
+func logFindingEstimate(ctx context.Context, client *securityhub.Client, regions []string, filters *types.AwsSecurityFindingFilters) {
+	estimateCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	for i, region := range regions {
+		regionClient := client
+		if i > 0 {
+			cfg, err := loadAWSConfig(estimateCtx, region)
+			if err != nil {
+				log.Printf("件数の見積もりをスキップしました (リージョン %s): %v", region, err)
+				continue
+			}
+			regionClient = securityhub.NewFromConfig(cfg)
+		}
+
+		estimate, err := estimateFindingCount(estimateCtx, regionClient, filters)
+		if err != nil {
+			log.Printf("件数の見積もりをスキップしました (リージョン %s): %v", region, err)
+			continue
+		}
+		if estimate.More {
+			log.Printf("見積もり (下限): リージョン %s: %d 件以上 (1ページ目 %d 件、続きのページあり)", region, estimate.LowerBound(), estimate.FirstPage)
+		} else {
+			log.Printf("見積もり: リージョン %s: %d 件 (1ページで確定)", region, estimate.LowerBound())
+		}
+	}
+}
+
+// WORKER_COUNT で指定できるワーカー数の範囲
+const (
+	minWorkerCount = 1
+	maxWorkerCount = 50
+)
+
+// clampWorkerCount は、ワーカー数を [minWorkerCount, maxWorkerCount] の範囲に収め、
+// 範囲外だったかどうかを返す。0 以下のワーカー数では取得が始まらず、実行が止まってしまう
+func clampWorkerCount(n int) (int, bool) {
+	switch {
+	case n < minWorkerCount:
+		return minWorkerCount, true
+	case n > maxWorkerCount:
+		return maxWorkerCount, true
+	}
+	return n, false
+}
+
+// スロットリングがこの回数に達するごとに、以降の実行で使うワーカー数を半分に減らす
+const throttleDownshiftThreshold = 3
+
+// ワーカー数が1になってからも、この回数スロットリングされた場合は取得を中止する
+const maxSerialThrottles = 10
+
+// isThrottleError は、SDK の再試行を使い切ってもスロットリングが解消しなかったエラーかを返す
+func isThrottleError(err error) bool {
+	return retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) == aws.TrueTernary
+}
+
+// retryBudget は、実行全体で共有する再試行回数の上限 (RETRY_BUDGET)。
+// SDK の再試行とスロットリング時の再取得の両方で消費し、使い切った後は再試行せずにエラーとする。
+// SDK の標準リトライヤーの RateLimiter として使うため retry.RateLimiter を実装する
+type retryBudget struct {
+	remaining atomic.Int64
+	exhausted atomic.Bool
+}
+
+// 実行全体の再試行の上限。main で RETRY_BUDGET が指定された場合のみ設定する (nil の場合は上限なし)
+var runRetryBudget *retryBudget
+
+var errRetryBudgetExhausted = errors.New("RETRY_BUDGET で指定した再試行回数を使い切りました")
+
+func newRetryBudget(limit int64) *retryBudget {
+	b := &retryBudget{}
+	b.remaining.Store(limit)
+	return b
+}
+
+// take は再試行を1回分消費し、上限に達していれば false を返す
+func (b *retryBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	if b.remaining.Add(-1) >= 0 {
+		return true
+	}
+	if !b.exhausted.Swap(true) {
+		log.Printf("⚠️ 再試行の上限 (RETRY_BUDGET) に達したため、以降は再試行しません")
+	}
+	return false
+}
+
+// GetToken は SDK が再試行する前に呼び出される。成功時に返却される分は加算しない
+func (b *retryBudget) GetToken(ctx context.Context, cost uint) (func() error, error) {
+	if !b.take() {
+		return nil, errRetryBudgetExhausted
+	}
+	return func() error { return nil }, nil
+}
+
+// AddTokens は成功した呼び出しの分を払い戻す。予算は実行全体の上限のため何もしない
+func (b *retryBudget) AddTokens(uint) error {
+	return nil
+}
+
+// findingsAPI は、検出結果の取得に使う Security Hub の API (*securityhub.Client が実装する)
+type findingsAPI interface {
+	GetFindings(ctx context.Context, params *securityhub.GetFindingsInput, optFns ...func(*securityhub.Options)) (*securityhub.GetFindingsOutput, error)
+}
+
+// 並列処理でSecurity Hubの検出結果を取得
+// スロットリングが続く場合は、ワーカー数を段階的に減らして最終的に1ワーカーでの逐次取得に切り替える。
+// onPage を指定した場合は取得したページを保持せずに onPage に渡し (呼び出しは直列化される)、
+// 戻り値の検出結果は空になる。
+// ctx がキャンセルされた場合 (Ctrl-C) は新しいページの取得を止め、それまでに取得した検出結果をエラーなしで返す。
+// 未取得のページが残った場合は truncated が true になる
+func fetchFindings(ctx context.Context, client findingsAPI, filters *types.AwsSecurityFindingFilters, workerCount int, onPage func([]types.AwsSecurityFinding) error) ([]types.AwsSecurityFinding, bool, error) {
+	log.Println("Security Hubから検出結果を取得中...")
+	startTime := time.Now()
+
+	input := &securityhub.GetFindingsInput{
+		Filters:    filters,
+		MaxResults: int32Ptr(100),
+	}
+
+	var allFindings []types.AwsSecurityFinding
+	fetchedCount := 0
+	// 重大度別の件数 (onPage を指定した場合は allFindings が空になるため、ページごとに集計する)
+	severityCounts := make(map[string]int)
+	var findingsMux sync.Mutex
+	var wg sync.WaitGroup
+
+	// ページ送りの状態はすべて mu で保護する。
+	// 未取得のトークン (pending) と取得中のページ数 (inFlight) がともに 0 になった時点で全ページの取得が完了する。
+	// 取得中のページは次のトークンを返す可能性があるため、pending が空でも inFlight が残っていればワーカーは待機する
+	var mu sync.Mutex
+	cond := sync.NewCond(&mu)
+	pending := []*string{nil} // 先頭ページのトークンは nil
+	inFlight := 0
+	var fetchErr error
+
+	// スロットリングの発生回数と、現在有効なワーカー数 (ID がこれ以上のワーカーは終了する)
+	throttleCount := 0
+	effectiveWorkers := workerCount
+
+	// finishPage は取得中のページを完了とし、次のトークンがあれば pending に追加する
+	finishPage := func(next *string) {
+		mu.Lock()
+		if next != nil {
+			pending = append(pending, next)
+		}
+		inFlight--
+		cond.Broadcast()
+		mu.Unlock()
+	}
+
+	// fail は最初のエラーを記録し、待機中のワーカーを終了させる
+	fail := func(err error) {
+		mu.Lock()
+		if fetchErr == nil {
+			fetchErr = err
+		}
+		inFlight--
+		cond.Broadcast()
+		mu.Unlock()
+	}
+
+	// キャンセルされたら、待機中のワーカーを起こして終了させる
+	stopWake := context.AfterFunc(ctx, func() {
+		mu.Lock()
+		cond.Broadcast()
+		mu.Unlock()
+	})
+	defer stopWake()
+
+	for i := 0; i < workerCount; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+
+			for {
+				mu.Lock()
+				for len(pending) == 0 && inFlight > 0 && fetchErr == nil && workerID < effectiveWorkers && ctx.Err() == nil {
+					cond.Wait()
+				}
+				// エラー発生時、キャンセル時、全ページの取得完了時、ワーカー数を減らした場合は、トークンを持たないこの時点で終了する
+				if fetchErr != nil || ctx.Err() != nil || len(pending) == 0 || workerID >= effectiveWorkers {
+					mu.Unlock()
+					return
+				}
+				token := pending[0]
+				pending = pending[1:]
+				inFlight++
+				mu.Unlock()
+
+				pageInput := *input
+				pageInput.NextToken = token
+
+				resp, err := client.GetFindings(ctx, &pageInput)
+				if err != nil && ctx.Err() != nil {
+					// キャンセルにより中断されたページは取得済みとして扱わず、未取得のページとして残す
+					mu.Lock()
+					pending = append(pending, token)
+					inFlight--
+					cond.Broadcast()
+					mu.Unlock()
+					return
+				}
+				if err != nil && isThrottleError(err) {
+					mu.Lock()
+					throttleCount++
+					giveUp := effectiveWorkers == 1 && throttleCount >= maxSerialThrottles
+					if effectiveWorkers > 1 && throttleCount >= throttleDownshiftThreshold {
+						effectiveWorkers = max(effectiveWorkers/2, 1)
+						throttleCount = 0
+						if effectiveWorkers == 1 {
+							log.Printf("⚠️ スロットリングが続くため、1ワーカーでの逐次取得に切り替えます")
+						} else {
+							log.Printf("⚠️ スロットリングが続くため、ワーカー数を %d に減らします", effectiveWorkers)
+						}
+					}
+					mu.Unlock()
+
+					if !giveUp && runRetryBudget.take() {
+						// 同じページを後で取得し直せるよう、トークンを pending に戻してから待機する
+						log.Printf("Worker %d: スロットリングされたため、待機して再取得します", workerID)
+						select {
+						case <-time.After(time.Second):
+						case <-ctx.Done():
+						}
+						mu.Lock()
+						pending = append(pending, token)
+						inFlight--
+						cond.Broadcast()
+						mu.Unlock()
+						continue
+					}
+				}
+				if err != nil {
+					fail(fmt.Errorf("worker %d error: %w", workerID, err))
+					return
+				}
+
+				findingsMux.Lock()
+				fetchedCount += len(resp.Findings)
+				currentCount := fetchedCount
+				for _, f := range resp.Findings {
+					if f.Severity != nil {
+						severityCounts[string(f.Severity.Label)]++
+					}
+				}
+				var pageErr error
+				if onPage != nil {
+					pageErr = onPage(resp.Findings)
+				} else {
+					allFindings = append(allFindings, resp.Findings...)
+				}
+				findingsMux.Unlock()
+
+				if pageErr != nil {
+					fail(fmt.Errorf("worker %d output error: %w", workerID, pageErr))
+					return
+				}
+
+				log.Printf("Worker %d: 取得済み %d 件 (累計: %d 件)", workerID, len(resp.Findings), currentCount)
+				finishPage(resp.NextToken)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if fetchErr != nil {
+		return nil, false, fetchErr
+	}
+
+	// すべてのワーカーが終了した後に未取得のページが残っていれば、全件を取得できていない
+	truncated := len(pending) > 0
+	elapsed := time.Since(startTime)
+	if truncated {
+		log.Printf("⚠️ 取得を中断しました: それまでに取得した %d 件を出力します (truncated: true、所要時間: %s)", fetchedCount, elapsed)
+	} else {
+		log.Printf("取得完了: %d 件 (所要時間: %s)", fetchedCount, elapsed)
+	}
+	
+	// デバッグ: 重大度別の件数を表示
+	log.Println("=== 取得した検出結果の重大度別内訳 ===")
+	for _, sev := range severityLevels {
+		if count, ok := severityCounts[sev]; ok {
+			log.Printf("  %s: %d件", sev, count)
+		}
+	}
+
+	return allFindings, truncated, nil
+}
+
+// 複数リージョンから取得する場合に、同時に取得するリージョン数の上限
+const maxConcurrentRegions = 4
+
+// scannedFinding は、取得した検出結果と、それを取得したリージョン。
+// リージョン間の集約を有効にしていると検出結果の Region は集約元のリージョンになるため、取得したリージョンは別に持つ
+type scannedFinding struct {
+	types.AwsSecurityFinding
+	ScanRegion string
+}
+
+// scannedIn は、リージョン region から取得した検出結果に取得したリージョンを付ける
+func scannedIn(region string, findings []types.AwsSecurityFinding) []scannedFinding {
+	scanned := make([]scannedFinding, len(findings))
+	for i, finding := range findings {
+		scanned[i] = scannedFinding{AwsSecurityFinding: finding, ScanRegion: region}
+	}
+	return scanned
+}
+
+// fetchFindingsInRegions は、各リージョンの Security Hub から並行して検出結果を取得して結合する。
+// リージョン間の集約を有効にしていると同じ検出結果が複数のリージョンから返るため、Id が同じものは最初の1件のみ残す。
+// onPage を指定した場合の呼び出しは、リージョンをまたいで直列化される。
+// 中断により全件を取得できなかったリージョンがあれば truncated が true になる
+func fetchFindingsInRegions(ctx context.Context, regions []string, filters *types.AwsSecurityFindingFilters, workerCount int, onPage func([]scannedFinding) error) ([]scannedFinding, bool, error) {
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	var allFindings []scannedFinding
+	var truncated atomic.Bool
+
+	// addPage は重複を除いたページを onPage に渡すか、結果に追加する
+	addPage := func(region string, findings []types.AwsSecurityFinding) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		page := make([]scannedFinding, 0, len(findings))
+		for _, finding := range scannedIn(region, findings) {
+			id := aws.ToString(finding.Id)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			// 検出結果に Region が含まれない場合は、取得したリージョンとする
+			if finding.Region == nil {
+				finding.Region = aws.String(region)
+			}
+			page = append(page, finding)
+		}
+		if onPage != nil {
+			return onPage(page)
+		}
+		allFindings = append(allFindings, page...)
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	var errMux sync.Mutex
+	var fetchErr error
+	semaphore := make(chan struct{}, maxConcurrentRegions)
+
+	for _, region := range regions {
+		wg.Add(1)
+		go func(region string) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			err := func() error {
+				cfg, err := loadAWSConfig(ctx, region)
+				if err != nil {
+					return err
+				}
+				client := securityhub.NewFromConfig(cfg)
+				_, regionTruncated, err := fetchFindings(ctx, client, filters, workerCount, func(findings []types.AwsSecurityFinding) error {
+					return addPage(region, findings)
+				})
+				if regionTruncated {
+					truncated.Store(true)
+				}
+				return err
+			}()
+			if err != nil && ctx.Err() == nil {
+				errMux.Lock()
+				if fetchErr == nil {
+					fetchErr = fmt.Errorf("リージョン %s: %w", region, err)
+				}
+				errMux.Unlock()
+				return
+			}
+			if ctx.Err() != nil {
+				// 中断により設定の読み込みなどが失敗したリージョンは、取得していないものとして扱う
+				if err != nil {
+					truncated.Store(true)
+				}
+				return
+			}
+			log.Printf("リージョン %s の取得が完了しました", region)
+		}(region)
+	}
+
+	wg.Wait()
+
+	if fetchErr != nil {
+		return nil, false, fetchErr
+	}
+	log.Printf("全リージョンの取得完了: %d リージョン、%d 件 (重複を除く)", len(regions), len(seen))
+	return allFindings, truncated.Load(), nil
+}
+
+// findingRows は1件の検出結果を、影響を受けたリソースごとの行に展開する。
+// 重要度が severities に含まれない場合は nil を返す (severities が nil の場合はすべて対象)。
+// 同じ検知内容の件数による加点と許容リストは、全件を揃えてから convertFindings で反映する
+func findingRows(scanned scannedFinding, severities map[string]bool, now time.Time) []FindingDetail {
+	finding := scanned.AwsSecurityFinding
+	severity := ""
+	if finding.Severity != nil && finding.Severity.Label != "" {
+		severity = string(finding.Severity.Label)
+	}
+
+	// 対象の重要度のみ処理
+	if severities != nil && !severities[severity] {
+		return nil
+	}
+
+	id := ""
+	if finding.Id != nil {
+		id = *finding.Id
+	}
+
+	description := ""
+	if finding.Title != nil {
+		// タイトルを日本語に変換
+		description = translateTitle(*finding.Title)
+	}
+
+	// コンプライアンス状態 (Compliance は検出結果によっては nil)
+	complianceStatus := ""
+	if finding.Compliance != nil {
+		complianceStatus = string(finding.Compliance.Status)
+	}
+
+	base := FindingDetail{
+		Severity:         severity,
+		ID:               id,
+		Description:      description,
+		RecordState:      string(finding.RecordState),
+		ComplianceStatus: complianceStatus,
+		AccountID:        aws.ToString(finding.AwsAccountId),
+		Region:           aws.ToString(finding.Region),
+		ScanRegion:       scanned.ScanRegion,
+		PriorityScore:    basePriorityScore(finding, severity, now),
+		ControlID:        findingControlID(finding),
+		FirstObservedAt:  formatTimestamp(finding.FirstObservedAt),
+		LastObservedAt:   formatTimestamp(finding.LastObservedAt),
+		Remediation:      remediation(finding),
+		ProductName:      aws.ToString(finding.ProductName),
+		GeneratorID:      aws.ToString(finding.GeneratorId),
+		Note:             findingNote(finding),
+	}
+
+	// RESOURCE_TYPES が指定されている場合は、対象のリソースタイプのみ残す
+	resources := finding.Resources
+	if resourceTypes != nil {
+		resources = nil
+		for _, resource := range finding.Resources {
+			if resourceTypes[aws.ToString(resource.Type)] {
+				resources = append(resources, resource)
+			}
+		}
+		// 対象のリソースが残らない検出結果は出力しない
+		if len(resources) == 0 {
+			return nil
+		}
+	}
+
+	// リソースがない場合も1行作成
+	if len(resources) == 0 {
+		base.StableID = stableKey(finding, "")
+		base.InternetExposed = internetExposed(finding, types.Resource{})
+		return []FindingDetail{base}
+	}
+
+	// リソースがある場合は各リソースごとに行を作成
+	rows := make([]FindingDetail, 0, len(resources))
+	for _, resource := range resources {
+		detail := base
+		detail.Resource = formatResource(resource)
+		detail.ResourceType = aws.ToString(resource.Type)
+		detail.ResourceARN = aws.ToString(resource.Id)
+		detail.ResourceRegion = resourceRegionFromARN(detail.ResourceARN)
+		detail.Tags = resourceTags(resource)
+		detail.StableID = stableKey(finding, detail.ResourceARN)
+		detail.InternetExposed = internetExposed(finding, resource)
+		rows = append(rows, detail)
+	}
+	return rows
+}
+
+// applyAllowlist は、許容リストに一致する行を対応不要として accepted とし、優先度を最低にする。
+// 一致した場合は true を返す
+func applyAllowlist(detail *FindingDetail) bool {
+	if !allowlist[detail.ResourceARN][detail.ControlID] {
+		return false
+	}
+	detail.Accepted = true
+	detail.PriorityScore = 0
+	return true
+}
+
+// 検出結果を変換（全件を個別に出力）
+// sortBy が "priority" の場合は優先度スコアの高い順に、"exposure" の場合はインターネットから到達可能な行を先に並べる
+// severities に含まれる重要度の検出結果のみを変換する (nil の場合はすべて変換する)
+func convertFindings(findings []scannedFinding, severities map[string]bool, sortBy string) []FindingDetail {
+	log.Println("検出結果を変換中...")
+
+	details := make([]FindingDetail, 0, len(findings)*2)
+	now := time.Now()
+
+	excluded := 0
+	for _, finding := range findings {
+		// EXCLUDE_FINDING_IDS で指定された誤検知は、Id の完全一致で除外する
+		if excludedFindingIDs[aws.ToString(finding.Id)] {
+			excluded++
+			continue
+		}
+		details = append(details, findingRows(finding, severities, now)...)
+	}
+	if excludedFindingIDs != nil {
+		log.Printf("EXCLUDE_FINDING_IDS に一致: %d 件の検出結果を除外", excluded)
+	}
+
+	// 同じ検知内容の行数をスコアに加算
+	controlCounts := make(map[string]int)
+	for _, detail := range details {
+		controlCounts[detail.Description]++
+	}
+	for i := range details {
+		details[i].PriorityScore += min(controlCounts[details[i].Description], 10)
+	}
+
+	// 許容リストに一致する行は対応不要として accepted とし、優先度を最低にする
+	accepted := 0
+	for i := range details {
+		if applyAllowlist(&details[i]) {
+			accepted++
+		}
+	}
+	if allowlist != nil {
+		log.Printf("許容リストに一致: %d 行を accepted として出力", accepted)
+	}
+
+	// 重大度順にソート
+	sort.Slice(details, func(i, j int) bool {
+		if sortBy == "priority" && details[i].PriorityScore != details[j].PriorityScore {
+			return details[i].PriorityScore > details[j].PriorityScore
+		}
+		if sortBy == "exposure" && details[i].InternetExposed != details[j].InternetExposed {
+			return details[i].InternetExposed
+		}
+
+		severityOrderI := getSeverityOrder(details[i].Severity)
+		severityOrderJ := getSeverityOrder(details[j].Severity)
+		if severityOrderI != severityOrderJ {
+			return severityOrderI < severityOrderJ
+		}
+		
+		if details[i].Description != details[j].Description {
+			return details[i].Description < details[j].Description
+		}
+		
+		if details[i].ID != details[j].ID {
+			return details[i].ID < details[j].ID
+		}
+
+		// 複数アカウント・リージョンの結果を統合しても実行ごとに同じ順序になるよう、
+		// リソース・アカウント・リージョンで最終的な順序を決める
+		if details[i].Resource != details[j].Resource {
+			return details[i].Resource < details[j].Resource
+		}
+		if details[i].AccountID != details[j].AccountID {
+			return details[i].AccountID < details[j].AccountID
+		}
+		if details[i].Region != details[j].Region {
+			return details[i].Region < details[j].Region
+		}
+		return details[i].ScanRegion < details[j].ScanRegion
+	})
+
+	log.Printf("変換完了: %d 件の検出結果を %d 行に展開", len(findings), len(details))
+
+	if dedupByControl {
+		details = collapseByControl(details)
+		log.Printf("検知内容ごとに集約: %d 行", len(details))
+	}
+
+	return details
+}
+
+// collapseByControl は、同じコントロールID (findingControlID) の行を1行にまとめ、リソースを改行区切りで列挙する。
+// 翻訳の有無やセキュリティ標準によってタイトルが異なっても、同じコントロールの行はまとめる。
+// 並び順は各コントロールの最初の行の位置を保ち、優先度スコアは最大値、インターネット公開はいずれかが該当すれば true、
+// 許容済みはすべてが該当する場合のみ true とする。複数の検出結果をまとめた行のため ID は空とし、
+// リソースごとの値 (タグ・StableID) も空にする
+func collapseByControl(details []FindingDetail) []FindingDetail {
+	var collapsed []FindingDetail
+	index := make(map[string]int)
+	seenResources := make(map[string]map[string]bool)
+	seenARNs := make(map[string]map[string]bool)
+	seenRegions := make(map[string]map[string]bool)
+
+	// appendUnique は values に value を追加する (空文字と追加済みの値は除く)
+	appendUnique := func(seen map[string]bool, values, value string) string {
+		if value == "" || seen[value] {
+			return values
+		}
+		seen[value] = true
+		if values == "" {
+			return value
+		}
+		return values + "\n" + value
+	}
+
+	for _, detail := range details {
+		key := detail.ControlID
+		if key == "" {
+			key = detail.Description
+		}
+		i, ok := index[key]
+		if !ok {
+			i = len(collapsed)
+			index[key] = i
+			seenResources[key] = make(map[string]bool)
+			seenARNs[key] = make(map[string]bool)
+			seenRegions[key] = make(map[string]bool)
+
+			row := detail
+			row.ID = ""
+			row.Resource, row.ResourceARN, row.ResourceRegion = "", "", ""
+			row.Tags = nil
+			row.StableID = ""
+			collapsed = append(collapsed, row)
+		}
+
+		row := &collapsed[i]
+		row.Resource = appendUnique(seenResources[key], row.Resource, detail.Resource)
+		row.ResourceARN = appendUnique(seenARNs[key], row.ResourceARN, detail.ResourceARN)
+		row.ResourceRegion = appendUnique(seenRegions[key], row.ResourceRegion, detail.ResourceRegion)
+		row.ResourceCount = max(len(seenResources[key]), len(seenARNs[key]))
+		row.PriorityScore = max(row.PriorityScore, detail.PriorityScore)
+		row.InternetExposed = row.InternetExposed || detail.InternetExposed
+		row.Accepted = row.Accepted && detail.Accepted
+	}
+	return collapsed
+}
+
+// 影響を受けたユニークなリソース数・リソースタイプ数と、検知内容ごとの行数/リソース数を表示
+// (1つのリソースが複数のコントロールに該当するため、行数とリソース数は一致しない)
+func logResourceSummary(details []FindingDetail) {
+	resources := make(map[string]bool)
+	resourceTypes := make(map[string]bool)
+	rowsByControl := make(map[string]int)
+	resourcesByControl := make(map[string]map[string]bool)
+
+	for _, detail := range details {
+		if detail.Resource != "" {
+			resources[detail.Resource] = true
+		}
+		if detail.ResourceType != "" {
+			resourceTypes[detail.ResourceType] = true
+		}
+		rowsByControl[detail.Description]++
+		if resourcesByControl[detail.Description] == nil {
+			resourcesByControl[detail.Description] = make(map[string]bool)
+		}
+		if detail.Resource != "" {
+			resourcesByControl[detail.Description][detail.Resource] = true
+		}
+	}
+
+	controls := make([]string, 0, len(rowsByControl))
+	for control := range rowsByControl {
+		controls = append(controls, control)
+	}
+	sort.Slice(controls, func(i, j int) bool {
+		ci, cj := len(resourcesByControl[controls[i]]), len(resourcesByControl[controls[j]])
+		if ci != cj {
+			return ci > cj
+		}
+		return controls[i] < controls[j]
+	})
+
+	log.Println("=== 影響を受けたリソースの集計 ===")
+	log.Printf("  ユニークなリソース: %d件", len(resources))
+	log.Printf("  ユニークなリソースタイプ: %d種類", len(resourceTypes))
+	log.Println("=== 検知内容別の行数 / ユニークなリソース数 ===")
+	for _, control := range controls {
+		log.Printf("  %s: %d行 / %dリソース", control, rowsByControl[control], len(resourcesByControl[control]))
+	}
+}
+
+// リソースタイプ別の集計結果
+type ResourceTypeCount struct {
+	ResourceType string
+	Findings     int // 行数 (検出結果×リソース)
+	Resources    int // ユニークなリソース数
+}
+
+// リソースタイプ別に行数とユニークなリソース数を集計し、行数の多い順に返す
+func summarizeByResourceType(details []FindingDetail) []ResourceTypeCount {
+	rows := make(map[string]int)
+	resources := make(map[string]map[string]bool)
+	for _, detail := range details {
+		resourceType := detail.ResourceType
+		rows[resourceType]++
+		if resources[resourceType] == nil {
+			resources[resourceType] = make(map[string]bool)
+		}
+		if detail.Resource != "" {
+			resources[resourceType][detail.Resource] = true
+		}
+	}
+
+	counts := make([]ResourceTypeCount, 0, len(rows))
+	for resourceType, count := range rows {
+		counts = append(counts, ResourceTypeCount{
+			ResourceType: resourceType,
+			Findings:     count,
+			Resources:    len(resources[resourceType]),
+		})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Findings != counts[j].Findings {
+			return counts[i].Findings > counts[j].Findings
+		}
+		return counts[i].ResourceType < counts[j].ResourceType
+	})
+	return counts
+}
+
+// リソースタイプ別集計のCSV出力
+func exportResourceTypeSummary(details []FindingDetail, outputFile string) error {
+	log.Printf("リソースタイプ別集計を出力中: %s", outputFile)
+
+	writer, err := report.Create(outputFile, report.OptionsFromEnv())
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	headers := []string{
+		localize("リソースタイプ", "ResourceType"),
+		localize("件数", "Findings"),
+		localize("リソース数", "Resources"),
+	}
+	if err := writer.Write(headers); err != nil {
+		return fmt.Errorf("ヘッダー書き込みエラー: %w", err)
+	}
+
+	for _, count := range summarizeByResourceType(details) {
+		resourceType := count.ResourceType
+		if resourceType == "" {
+			resourceType = localize("(不明)", "(unknown)")
+		}
+		record := []string{resourceType, strconv.Itoa(count.Findings), strconv.Itoa(count.Resources)}
+		if err := writer.Write(record); err != nil {
+			return fmt.Errorf("データ書き込みエラー: %w", err)
+		}
+	}
+
+	return writer.Close()
+}
+
+// summarizeByControl は、検知内容ごとに影響を受けたリソースの行数を集計する
+func summarizeByControl(details []FindingDetail) map[string]int {
+	counts := make(map[string]int)
+	for _, detail := range details {
+		counts[detail.Description]++
+	}
+	return counts
+}
+
+// 検知内容別集計のCSV出力 (件数の多い順)
+func exportControlSummary(details []FindingDetail, outputFile string) error {
+	log.Printf("検知内容別集計を出力中: %s", outputFile)
+
+	counts := summarizeByControl(details)
+	descriptions := make([]string, 0, len(counts))
+	for description := range counts {
+		descriptions = append(descriptions, description)
+	}
+	sort.Slice(descriptions, func(i, j int) bool {
+		if counts[descriptions[i]] != counts[descriptions[j]] {
+			return counts[descriptions[i]] > counts[descriptions[j]]
+		}
+		return descriptions[i] < descriptions[j]
+	})
+
+	writer, err := report.Create(outputFile, report.OptionsFromEnv())
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	headers := []string{
+		localize("検知内容", "Title"),
+		localize("件数", "Findings"),
+	}
+	if err := writer.Write(headers); err != nil {
+		return fmt.Errorf("ヘッダー書き込みエラー: %w", err)
+	}
+
+	for _, description := range descriptions {
+		if err := writer.Write([]string{description, strconv.Itoa(counts[description])}); err != nil {
+			return fmt.Errorf("データ書き込みエラー: %w", err)
+		}
+	}
+
+	return writer.Close()
+}
+
+// ヒートマップの列として出力する重要度 (出力対象外の重要度も列の並びを固定するため含める)
+var heatmapSeverities = []string{"CRITICAL", "HIGH", "MEDIUM", "LOW", "INFORMATIONAL"}
+
+// コントロールID別・重要度別の集計結果
+type ControlSeverityCount struct {
+	ControlID string
+	Counts    map[string]int // 重要度 -> 行数
+	Total     int
+}
+
+// summarizeByControlSeverity は行数をコントロールID×重要度で集計し、合計の多い順に返す
+func summarizeByControlSeverity(details []FindingDetail) []ControlSeverityCount {
+	rows := make(map[string]*ControlSeverityCount)
+	for _, detail := range details {
+		row, ok := rows[detail.ControlID]
+		if !ok {
+			row = &ControlSeverityCount{ControlID: detail.ControlID, Counts: make(map[string]int)}
+			rows[detail.ControlID] = row
+		}
+		row.Counts[detail.Severity]++
+		row.Total++
+	}
+
+	counts := make([]ControlSeverityCount, 0, len(rows))
+	for _, row := range rows {
+		counts = append(counts, *row)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Total != counts[j].Total {
+			return counts[i].Total > counts[j].Total
+		}
+		return counts[i].ControlID < counts[j].ControlID
+	})
+	return counts
+}
+
+// コントロールID (行) × 重要度 (列) の件数をヒートマップ用のCSVに出力
+func exportControlSeverityHeatmap(details []FindingDetail, outputFile string) error {
+	log.Printf("コントロール×重要度のヒートマップを出力中: %s", outputFile)
+
+	writer, err := report.Create(outputFile, report.OptionsFromEnv())
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	headers := []string{localize("コントロールID", "ControlID")}
+	headers = append(headers, heatmapSeverities...)
+	headers = append(headers, localize("合計", "Total"))
+	if err := writer.Write(headers); err != nil {
+		return fmt.Errorf("ヘッダー書き込みエラー: %w", err)
+	}
+
+	for _, count := range summarizeByControlSeverity(details) {
+		controlID := count.ControlID
+		if controlID == "" {
+			controlID = localize("(不明)", "(unknown)")
+		}
+		record := []string{controlID}
+		for _, severity := range heatmapSeverities {
+			record = append(record, strconv.Itoa(count.Counts[severity]))
+		}
+		record = append(record, strconv.Itoa(count.Total))
+		if err := writer.Write(record); err != nil {
+			return fmt.Errorf("データ書き込みエラー: %w", err)
+		}
+	}
+
+	return writer.Close()
+}
+
+// セキュリティ標準のコントロールの有効/無効状態
+// (無効化されたコントロールは検出結果を一切生成しないため、検出結果とは別に確認が必要)
+type ControlStatus struct {
+	Standard       string
+	ControlID      string
+	Title          string
+	Status         string
+	DisabledReason string
+}
+
+// 有効化されている全セキュリティ標準について、各コントロールの状態を取得
+func fetchControlStatuses(ctx context.Context, client *securityhub.Client) ([]ControlStatus, error) {
+	log.Println("セキュリティ標準のコントロール状態を取得中...")
+
+	var statuses []ControlStatus
+	standardsPaginator := securityhub.NewGetEnabledStandardsPaginator(client, &securityhub.GetEnabledStandardsInput{})
+	for standardsPaginator.HasMorePages() {
+		standardsOutput, err := standardsPaginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("有効なセキュリティ標準の取得に失敗: %w", err)
+		}
+
+		for _, subscription := range standardsOutput.StandardsSubscriptions {
+			standard := aws.ToString(subscription.StandardsArn)
+			controlsPaginator := securityhub.NewDescribeStandardsControlsPaginator(client, &securityhub.DescribeStandardsControlsInput{
+				StandardsSubscriptionArn: subscription.StandardsSubscriptionArn,
+			})
+			for controlsPaginator.HasMorePages() {
+				controlsOutput, err := controlsPaginator.NextPage(ctx)
+				if err != nil {
+					return nil, fmt.Errorf("コントロールの取得に失敗 (%s): %w", standard, err)
+				}
+				for _, control := range controlsOutput.Controls {
+					statuses = append(statuses, ControlStatus{
+						Standard:       standard,
+						ControlID:      aws.ToString(control.ControlId),
+						Title:          aws.ToString(control.Title),
+						Status:         string(control.ControlStatus),
+						DisabledReason: aws.ToString(control.DisabledReason),
+					})
+				}
+			}
+		}
+	}
+
+	// 無効なコントロールを先頭に、標準・コントロールID順に並べる
+	sort.Slice(statuses, func(i, j int) bool {
+		disabledI := statuses[i].Status == string(types.ControlStatusDisabled)
+		disabledJ := statuses[j].Status == string(types.ControlStatusDisabled)
+		if disabledI != disabledJ {
+			return disabledI
+		}
+		if statuses[i].Standard != statuses[j].Standard {
+			return statuses[i].Standard < statuses[j].Standard
+		}
+		return statuses[i].ControlID < statuses[j].ControlID
+	})
+
+	return statuses, nil
+}
+
+// コントロール状態のCSV出力
+func exportControlsToCSV(statuses []ControlStatus, outputFile string) error {
+	log.Printf("コントロール状態をCSVファイルに出力中: %s", outputFile)
+
+	writer, err := report.Create(outputFile, report.OptionsFromEnv())
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	headers := []string{
+		localize("セキュリティ標準", "Standard"),
+		localize("コントロールID", "ControlID"),
+		localize("タイトル", "Title"),
+		localize("状態", "Status"),
+		localize("無効化の理由", "DisabledReason"),
+	}
+	if err := writer.Write(headers); err != nil {
+		return fmt.Errorf("ヘッダー書き込みエラー: %w", err)
+	}
+
+	disabledCount := 0
+	for _, status := range statuses {
+		if status.Status == string(types.ControlStatusDisabled) {
+			disabledCount++
+		}
+		record := []string{
+			status.Standard,
+			status.ControlID,
+			status.Title,
+			status.Status,
+			status.DisabledReason,
+		}
+		if err := writer.Write(record); err != nil {
+			return fmt.Errorf("データ書き込みエラー: %w", err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("コントロール状態の出力完了: 全 %d 件 (無効: %d 件)", len(statuses), disabledCount)
+	return nil
+}
+
+// outputDir (OUTPUT_DIR) が指定されている場合は、ディレクトリがなければ作成してその下に出力する。
+// 未指定で既定の出力ディレクトリが存在しない場合はカレントディレクトリに出力先を変更
+func resolveOutputFile(outputFile, outputDir string) (string, error) {
+	if outputDir != "" {
+		if err := os.MkdirAll(outputDir, 0755); err != nil {
+			return "", fmt.Errorf("出力ディレクトリの作成に失敗しました (%s): %w", outputDir, err)
+		}
+		return filepath.Join(outputDir, filepath.Base(outputFile)), nil
+	}
+
+	defaultDir := "/mnt/user-data/outputs"
+	if _, err := os.Stat(defaultDir); os.IsNotExist(err) {
+		outputFile = "./security_hub_findings.csv"
+		log.Printf("出力先を変更: %s", outputFile)
+	}
+	return outputFile, nil
+}
+
+// csvHeaders は検出結果の CSV のヘッダー行を返す
+func csvHeaders() []string {
+	headers := []string{
+		localize("重要度", "Severity"),
+		"ID",
+		localize("検知内容", "Title"),
+		localize("リソース", "Resource"),
+		localize("リソースARN", "ResourceARN"),
+		localize("優先度スコア", "PriorityScore"),
+		localize("レコード状態", "RecordState"),
+		localize("コンプライアンス状態", "ComplianceStatus"),
+		localize("コントロールID", "ControlID"),
+		localize("アカウントID", "AccountID"),
+		localize("スキャンリージョン", "ScanRegion"),
+		localize("リソースリージョン", "ResourceRegion"),
+		localize("インターネット公開", "InternetExposed"),
+		localize("初回検出日時", "FirstObservedAt"),
+		localize("最終検出日時", "LastObservedAt"),
+		localize("修復手順", "Remediation"),
+		localize("検出元製品", "ProductName"),
+		"GeneratorId",
+		localize("メモ", "Note"),
+	}
+	for _, key := range tagColumns {
+		headers = append(headers, localize("タグ:", "Tag:")+key)
+	}
+	if allowlist != nil {
+		headers = append(headers, localize("例外", "Exception"))
+	}
+	if stableIDColumn {
+		headers = append(headers, "StableID")
+	}
+	if dedupByControl {
+		headers = append(headers, localize("リソース数", "ResourceCount"))
+	}
+	return headers
+}
+
+// csvRecord は1行分の検出結果を CSV のデータ行に変換する (列の並びは csvHeaders と同じ)
+func csvRecord(detail FindingDetail) []string {
+	record := []string{
+		detail.Severity,
+		detail.ID,
+		detail.Description,
+		detail.Resource,
+		detail.ResourceARN,
+		strconv.Itoa(detail.PriorityScore),
+		detail.RecordState,
+		detail.ComplianceStatus,
+		detail.ControlID,
+		detail.AccountID,
+		detail.ScanRegion,
+		detail.ResourceRegion,
+		strconv.FormatBool(detail.InternetExposed),
+		detail.FirstObservedAt,
+		detail.LastObservedAt,
+		detail.Remediation,
+		detail.ProductName,
+		detail.GeneratorID,
+		detail.Note,
+	}
+	for _, key := range tagColumns {
+		record = append(record, detail.Tags[key]) // タグがない場合は空欄
+	}
+	if allowlist != nil {
+		exception := ""
+		if detail.Accepted {
+			exception = "accepted"
+		}
+		record = append(record, exception)
+	}
+	if stableIDColumn {
+		record = append(record, detail.StableID)
+	}
+	if dedupByControl {
+		record = append(record, strconv.Itoa(detail.ResourceCount))
+	}
+	return record
+}
+
+// findingStream は STREAM=true の場合に、取得したページの検出結果をそのまま書き出す。
+// 全件を保持しないためメモリ使用量は一定だが、ワーカーの取得順に書き出されるため出力は並べ替えられない。
+// 同じ検知内容の件数による優先度の加点も、全件が揃わないと計算できないため行わない。
+// 並べ替えが必要な場合は、出力したファイルを表計算ソフトやデータベースで並べ替える
+type findingStream struct {
+	severities map[string]bool
+	now        time.Time
+	csv        *report.Writer
+	jsonl      *report.AtomicFile
+	encoder    *json.Encoder
+	paths      []string
+	rows       int
+}
+
+// newFindingStream は formats に応じて CSV と JSON Lines (拡張子 .jsonl) の出力先を作成する
+func newFindingStream(outputFile string, formats []string, severities map[string]bool) (*findingStream, error) {
+	fs := &findingStream{severities: severities, now: time.Now()}
+	for _, format := range formats {
+		switch format {
+		case "csv":
+			writer, err := report.Create(outputFile, report.OptionsFromEnv())
+			if err != nil {
+				fs.Abort()
+				return nil, err
+			}
+			if err := writer.Write(csvHeaders()); err != nil {
+				writer.Close()
+				fs.Abort()
+				return nil, fmt.Errorf("ヘッダー書き込みエラー: %w", err)
+			}
+			fs.csv = writer
+			fs.paths = append(fs.paths, outputFile)
+		case "json":
+			jsonlFile := outputPathForFormat(outputFile, "jsonl")
+			file, err := report.CreateAtomic(jsonlFile)
+			if err != nil {
+				fs.Abort()
+				return nil, err
+			}
+			fs.jsonl = file
+			fs.encoder = json.NewEncoder(file)
+			fs.paths = append(fs.paths, jsonlFile)
+		}
+	}
+	log.Printf("逐次出力を開始: %s", strings.Join(fs.paths, ", "))
+	return fs, nil
+}
+
+// writePage は1ページ分の検出結果を行に展開して書き出す
+func (fs *findingStream) writePage(findings []scannedFinding) error {
+	for _, finding := range findings {
+		if excludedFindingIDs[aws.ToString(finding.Id)] {
+			continue
+		}
+		for _, detail := range findingRows(finding, fs.severities, fs.now) {
+			applyAllowlist(&detail)
+			if fs.csv != nil {
+				if err := fs.csv.Write(csvRecord(detail)); err != nil {
+					return fmt.Errorf("データ書き込みエラー: %w", err)
+				}
+			}
+			if fs.encoder != nil {
+				if err := fs.encoder.Encode(detail); err != nil {
+					return fmt.Errorf("JSONエンコードエラー: %w", err)
+				}
+			}
+			fs.rows++
+		}
+	}
+	return nil
+}
+
+// Close はすべての出力先を確定させる
+func (fs *findingStream) Close() error {
+	if fs.csv != nil {
+		if err := fs.csv.Close(); err != nil {
+			return err
+		}
+	}
+	if fs.jsonl != nil {
+		if err := fs.jsonl.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Abort は書き込み途中の出力を破棄する
+func (fs *findingStream) Abort() {
+	if fs.csv != nil {
+		// Close は書き込み済みの行を確定させるため、一時ファイルごと破棄する
+		fs.csv.Abort()
+	}
+	if fs.jsonl != nil {
+		fs.jsonl.Abort()
+	}
+}
 
-	// 統計情報を表示
+// CSV出力
+func exportToCSV(details []FindingDetail, outputFile string) error {
+	log.Printf("CSVファイルに出力中: %s", outputFile)
+
+	// BOM付きで作成 (report パッケージの既定)
+	writer, err := report.Create(outputFile, report.OptionsFromEnv())
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	// ヘッダー行
+	if err := writer.Write(csvHeaders()); err != nil {
+		return fmt.Errorf("ヘッダー書き込みエラー: %w", err)
+	}
+
+	// データ行
+	for _, detail := range details {
+		record := csvRecord(detail)
+		if err := writer.Write(record); err != nil {
+			return fmt.Errorf("データ書き込みエラー: %w", err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	log.Println("CSV出力完了")
+	logSeverityCounts(details)
+	return nil
+}
+
+// logSeverityCounts は出力した行の重大度別件数とユニークな検知内容の数を表示する
+func logSeverityCounts(details []FindingDetail) {
 	severityCounts := make(map[string]int)
 	titleCounts := make(map[string]int)
 	
@@ -420,23 +2098,180 @@ func exportToCSV(details []FindingDetail, outputFile string) error {
 	}
 
 	log.Println("\n=== CSV出力の重大度別件数 ===")
-	for _, severity := range []string{"CRITICAL", "HIGH"} { // MEDIUM, LOW, INFORMATIONALをコメントアウト
+	for _, severity := range severityLevels {
 		if count, exists := severityCounts[severity]; exists {
 			log.Printf("  %s: %d件", severity, count)
 		}
 	}
 	log.Printf("  合計: %d件", len(details))
 	log.Printf("  ユニークな検知内容: %d種類\n", len(titleCounts))
+}
+
+// exportToCSVBySeverity は、重要度ごとに "<ファイル名>_<重要度>.csv" へ分けて出力し、出力したファイルを返す。
+// 該当する行がない重要度のファイルは作成しない
+func exportToCSVBySeverity(details []FindingDetail, outputFile string) ([]string, error) {
+	groups := make(map[string][]FindingDetail)
+	for _, detail := range details {
+		groups[detail.Severity] = append(groups[detail.Severity], detail)
+	}
+
+	severities := make([]string, 0, len(groups))
+	for severity := range groups {
+		severities = append(severities, severity)
+	}
+	sort.Slice(severities, func(i, j int) bool { return getSeverityOrder(severities[i]) < getSeverityOrder(severities[j]) })
+
+	ext := filepath.Ext(outputFile)
+	var files []string
+	for _, severity := range severities {
+		file := strings.TrimSuffix(outputFile, ext) + "_" + severity + ext
+		if err := exportToCSV(groups[severity], file); err != nil {
+			return files, err
+		}
+		files = append(files, file)
+	}
 
+	// 分割した全ファイルを合わせた件数
+	logSeverityCounts(details)
+	return files, nil
+}
+
+// uploadToS3 は、ローカルに出力したファイルを uri (s3://bucket/key) に text/csv としてアップロードし、
+// アップロード先の URI を返す。キーが空または "/" で終わる場合は、ローカルのファイル名をキーの末尾に付ける
+func uploadToS3(ctx context.Context, cfg aws.Config, uri, localPath string) (string, error) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(uri, "s3://"), "/")
+	if !strings.HasPrefix(uri, "s3://") || bucket == "" {
+		return "", fmt.Errorf("OUTPUT_S3_URI は s3://bucket/key の形式で指定してください (指定値: %s)", uri)
+	}
+	if key == "" || strings.HasSuffix(key, "/") {
+		key += filepath.Base(localPath)
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return "", fmt.Errorf("アップロードするファイルを開けません (%s): %w", localPath, err)
+	}
+	defer file.Close()
+
+	_, err = s3.NewFromConfig(cfg).PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        file,
+		ContentType: aws.String("text/csv"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("S3 へのアップロードに失敗しました (s3://%s/%s): %w", bucket, key, err)
+	}
+	return "s3://" + bucket + "/" + key, nil
+}
+
+// JSON出力 (FindingDetail の配列)
+func exportToJSON(details []FindingDetail, outputFile string) error {
+	log.Printf("JSONファイルに出力中: %s", outputFile)
+
+	file, err := report.CreateAtomic(outputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Abort()
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(details); err != nil {
+		return fmt.Errorf("JSONエンコードエラー: %w", err)
+	}
+
+	if err := file.Commit(); err != nil {
+		return err
+	}
+
+	log.Println("JSON出力完了")
 	return nil
 }
 
-// AWS認証情報を設定からロード
-func loadAWSConfig(ctx context.Context, region string) (aws.Config, error) {
-	if err := godotenv.Load(); err != nil {
-		log.Printf("警告: .envファイルが見つかりません（環境変数から読み込みます）: %v", err)
+// OUTPUT_FORMAT (カンマ区切り、例: "csv,json") を解釈する。未指定時は CSV のみ
+func parseOutputFormats(value string) ([]string, error) {
+	if value == "" {
+		return []string{"csv"}, nil
+	}
+
+	var formats []string
+	seen := make(map[string]bool)
+	for _, format := range strings.Split(value, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if format == "" || seen[format] {
+			continue
+		}
+		if format != "csv" && format != "json" {
+			return nil, fmt.Errorf("未対応の出力形式です: %s (csv または json を指定してください)", format)
+		}
+		seen[format] = true
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
+
+// 出力形式に応じて拡張子を差し替えたファイルパスを返す
+func outputPathForFormat(outputFile, format string) string {
+	return strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + "." + format
+}
+
+// 検出結果の生データを JSON Lines 形式 (1行1検出結果、Id をキーとして利用可能) で出力
+func exportRawJSONL(findings []scannedFinding, outputFile string) error {
+	log.Printf("生データを出力中: %s", outputFile)
+
+	file, err := report.CreateAtomic(outputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Abort()
+
+	encoder := json.NewEncoder(file)
+	for _, finding := range findings {
+		if err := encoder.Encode(finding.AwsSecurityFinding); err != nil {
+			return fmt.Errorf("JSONエンコードエラー (%s): %w", aws.ToString(finding.Id), err)
+		}
+	}
+
+	if err := file.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("生データ出力完了: %d 件", len(findings))
+	return nil
+}
+
+// runSelfTest は STS GetCallerIdentity と 1 件だけの GetFindings を呼び出し、
+// 認証情報と Security Hub の参照権限を確認する。チェックごとに成否を表示し、すべて成功したら true を返す
+func runSelfTest(ctx context.Context, cfg aws.Config, client *securityhub.Client) bool {
+	log.Println("--- セルフテスト (出力ファイルは作成しません) ---")
+	ok := true
+
+	identity, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		log.Printf("❌ 失敗: sts:GetCallerIdentity: %v", err)
+		ok = false
+	} else {
+		log.Printf("✅ 成功: sts:GetCallerIdentity (アカウント: %s, ARN: %s)", aws.ToString(identity.Account), aws.ToString(identity.Arn))
+	}
+
+	if _, err := client.GetFindings(ctx, &securityhub.GetFindingsInput{MaxResults: int32Ptr(1)}); err != nil {
+		log.Printf("❌ 失敗: securityhub:GetFindings: %v", err)
+		ok = false
+	} else {
+		log.Println("✅ 成功: securityhub:GetFindings")
+	}
+
+	if ok {
+		log.Println("✅ セルフテストに成功しました")
+	} else {
+		log.Println("❌ セルフテストに失敗しました")
 	}
+	return ok
+}
 
+// AWS認証情報を設定からロード
+func loadAWSConfig(ctx context.Context, region string) (aws.Config, error) {
 	accessKeyID := os.Getenv("AWS_ACCESS_KEY_ID")
 	secretAccessKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
 	sessionToken := os.Getenv("AWS_SESSION_TOKEN")
@@ -444,6 +2279,16 @@ func loadAWSConfig(ctx context.Context, region string) (aws.Config, error) {
 	var cfg aws.Config
 	var err error
 
+	// RETRY_BUDGET が指定されている場合は、標準のリトライヤーの再試行を実行全体の上限で制限する
+	var retryOptions []func(*config.LoadOptions) error
+	if runRetryBudget != nil {
+		retryOptions = append(retryOptions, config.WithRetryer(func() aws.Retryer {
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				o.RateLimiter = runRetryBudget
+			})
+		}))
+	}
+
 	if accessKeyID != "" && secretAccessKey != "" {
 		log.Println("環境変数からAWS認証情報を読み込みました")
 
@@ -453,21 +2298,35 @@ func loadAWSConfig(ctx context.Context, region string) (aws.Config, error) {
 			sessionToken,
 		)
 
-		cfg, err = config.LoadDefaultConfig(ctx,
+		cfg, err = config.LoadDefaultConfig(ctx, append(retryOptions,
 			config.WithRegion(region),
 			config.WithCredentialsProvider(credsProvider),
-		)
+		)...)
 	} else {
 		log.Println("デフォルトのAWS認証情報プロバイダーを使用します")
-		cfg, err = config.LoadDefaultConfig(ctx,
+		cfg, err = config.LoadDefaultConfig(ctx, append(retryOptions,
 			config.WithRegion(region),
-		)
+		)...)
 	}
 
 	if err != nil {
 		return aws.Config{}, fmt.Errorf("AWS設定のロードに失敗: %w", err)
 	}
 
+	// AWS_ROLE_ARN が指定されている場合は、上記の認証情報でロールを引き受ける (別アカウントの検出結果の参照用)。
+	// AWS_WEB_IDENTITY_TOKEN_FILE もある場合は、SDK の既定のプロバイダーが Web ID でロールを引き受けるため何もしない
+	if roleARN := os.Getenv("AWS_ROLE_ARN"); roleARN != "" && os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") == "" {
+		sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+		if sessionName == "" {
+			sessionName = "securityhub-exporter"
+		}
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), roleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = sessionName
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+		log.Printf("ロールを引き受けます: %s (セッション名: %s)", roleARN, sessionName)
+	}
+
 	creds, err := cfg.Credentials.Retrieve(ctx)
 	if err != nil {
 		return aws.Config{}, fmt.Errorf("AWS認証情報の取得に失敗: %w", err)
@@ -479,6 +2338,12 @@ func loadAWSConfig(ctx context.Context, region string) (aws.Config, error) {
 	}
 	log.Printf("AWS認証情報: %s", maskedKey)
 
+	// パーティションはリージョンから決まり、SDKのエンドポイント解決もこれに従う
+	log.Printf("AWSパーティション: %s (リージョン: %s)", awsapi.PartitionForRegion(cfg.Region), cfg.Region)
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		log.Printf("カスタムエンドポイントを使用: %s", endpoint)
+	}
+
 	return cfg, nil
 }
 
@@ -487,28 +2352,297 @@ func main() {
 
 	ctx := context.Background()
 
+	// 以降の設定値を .env からも読めるよう、最初に読み込む
+	if err := envfile.Load(); err != nil {
+		log.Fatalf("❌ エラー: %v", err)
+	}
+
+	// HEARTBEAT_FILE が設定されていれば、外部監視用に実行状況を定期的に書き込む
+	hb := heartbeat.Start("get_security_hub_list")
+	defer hb.Stop()
+
 	region := os.Getenv("AWS_REGION")
 	if region == "" {
 		region = "ap-northeast-1"
 	}
 
+	// AWS_REGIONS=ap-northeast-1,us-east-1 のように複数指定すると、各リージョンの検出結果を1つの出力にまとめる。
+	// 自己診断、MODE=controls、件数の見積もりは先頭のリージョンのみを対象とする
+	regions := []string{region}
+	if value := os.Getenv("AWS_REGIONS"); value != "" {
+		regions = nil
+		for _, r := range strings.Split(value, ",") {
+			if r = strings.TrimSpace(r); r != "" {
+				regions = append(regions, r)
+			}
+		}
+		if len(regions) == 0 {
+			log.Fatal("❌ エラー: AWS_REGIONS にリージョンが指定されていません")
+		}
+		region = regions[0]
+	}
+
 	workerCount := 10
 	if count := os.Getenv("WORKER_COUNT"); count != "" {
 		fmt.Sscanf(count, "%d", &workerCount)
+		if clamped, ok := clampWorkerCount(workerCount); ok {
+			log.Printf("⚠️ WORKER_COUNT=%d は範囲外のため %d に補正します (指定できる範囲: %d〜%d)", workerCount, clamped, minWorkerCount, maxWorkerCount)
+			workerCount = clamped
+		}
+	}
+
+	// RETRY_BUDGET で、実行全体での再試行回数の上限を指定する (未指定時は上限なし)
+	if value := os.Getenv("RETRY_BUDGET"); value != "" {
+		budget, err := strconv.Atoi(value)
+		if err != nil || budget < 0 {
+			log.Fatalf("❌ エラー: RETRY_BUDGET は0以上の整数を指定してください (指定値: %s)", value)
+		}
+		runRetryBudget = newRetryBudget(int64(budget))
+		log.Printf("再試行の上限: %d 回 (実行全体)", budget)
 	}
 
 	outputFile := os.Getenv("OUTPUT_FILE")
 	if outputFile == "" {
 		outputFile = "/mnt/user-data/outputs/security_hub_findings.csv"
 	}
+	// OUTPUT_DIR を指定すると、OUTPUT_FILE のファイル名をそのディレクトリの下に出力する (なければ作成する)
+	outputDir := os.Getenv("OUTPUT_DIR")
+
+	// ALLOWLIST_FILE で、リソースとコントロールの組み合わせ単位で許容済み (accepted) として扱う
+	if path := os.Getenv("ALLOWLIST_FILE"); path != "" {
+		entries, err := loadAllowlist(path)
+		if err != nil {
+			log.Fatalf("❌ エラー: %v", err)
+		}
+		allowlist = entries
+		log.Printf("許容リストを読み込みました: %s (%d リソース)", path, len(allowlist))
+	}
+
+	// TAG_COLUMNS=CostCenter,Owner で、検出結果に含まれるリソースタグを列として出力する
+	for _, key := range strings.Split(os.Getenv("TAG_COLUMNS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			tagColumns = append(tagColumns, key)
+		}
+	}
+
+	// RESOURCE_TYPES=AwsS3Bucket,AwsEc2SecurityGroup で、指定したリソースタイプの行のみ出力する
+	for _, resourceType := range strings.Split(os.Getenv("RESOURCE_TYPES"), ",") {
+		if resourceType = strings.TrimSpace(resourceType); resourceType != "" {
+			if resourceTypes == nil {
+				resourceTypes = make(map[string]bool)
+			}
+			resourceTypes[resourceType] = true
+		}
+	}
+
+	// EXCLUDE_FINDING_IDS で、抑制ルールを作成するまでの間、個別の誤検知を Id 指定で除外する
+	for _, id := range strings.Split(os.Getenv("EXCLUDE_FINDING_IDS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			if excludedFindingIDs == nil {
+				excludedFindingIDs = make(map[string]bool)
+			}
+			excludedFindingIDs[id] = true
+		}
+	}
+
+	// DEDUP_BY_CONTROL=true で、同じコントロールの行をリソースを列挙した1行にまとめる
+	dedupByControl = os.Getenv("DEDUP_BY_CONTROL") == "true"
+
+	// STABLE_ID=true で、実行をまたいで変わらない識別子 (StableID) の列を出力する
+	stableIDColumn = os.Getenv("STABLE_ID") == "true"
+
+	// LOCALE=en で検知内容の翻訳を行わず、CSVヘッダーも英語にする (既定は ja)
+	switch value := os.Getenv("LOCALE"); value {
+	case "", "ja":
+	case "en":
+		locale = value
+	default:
+		log.Fatalf("❌ エラー: LOCALE は ja または en を指定してください (指定値: %s)", value)
+	}
+
+	// TRANSLATIONS_FILE (既定は ./translations.json) の訳を、組み込みの訳に追加する
+	translationsFile := os.Getenv("TRANSLATIONS_FILE")
+	if translationsFile == "" {
+		translationsFile = "./translations.json"
+	}
+	if loaded, err := loadTranslations(translationsFile); err != nil {
+		log.Fatalf("❌ エラー: %v", err)
+	} else if loaded == 0 {
+		log.Printf("翻訳ファイル %s がないため、組み込みの訳 (%d 件) を使用します", translationsFile, len(findingTitleJapanese))
+	} else {
+		log.Printf("翻訳ファイルを読み込みました: %s (%d 件、組み込みの訳と合わせて %d 件)", translationsFile, loaded, len(findingTitleJapanese))
+	}
+
+	// MODE=controls の場合は検出結果の代わりに、セキュリティ標準のコントロールの有効/無効状態を出力
+	mode := os.Getenv("MODE")
+	if mode != "" && mode != "controls" {
+		log.Fatalf("❌ エラー: MODE は controls のみ指定できます (指定値: %s)", mode)
+	}
+
+	// OUTPUT_FORMAT=csv,json のように複数指定すると、1回の取得結果を各形式で出力する
+	outputFormats, err := parseOutputFormats(os.Getenv("OUTPUT_FORMAT"))
+	if err != nil {
+		log.Fatalf("❌ エラー: %v", err)
+	}
+	// ENCODING などの CSV 出力設定は、取得を始める前に検証しておく
+	if err := report.OptionsFromEnv().Check(); err != nil {
+		log.Fatalf("❌ エラー: %v", err)
+	}
+
+	// SORT_BY=priority で優先度スコア順、SORT_BY=exposure でインターネット公開の行を先に並べる (未指定時は重大度順)
+	sortBy := os.Getenv("SORT_BY")
+
+	// RESOURCE_ID で特定リソースの検出結果のみを取得 (RESOURCE_ID_COMPARISON=PREFIX で前方一致)
+	query := FindingQuery{
+		ResourceID:           os.Getenv("RESOURCE_ID"),
+		ResourceIDComparison: types.StringFilterComparisonEquals,
+	}
+	switch comparison := os.Getenv("RESOURCE_ID_COMPARISON"); comparison {
+	case "", "EQUALS":
+	case "PREFIX":
+		query.ResourceIDComparison = types.StringFilterComparisonPrefix
+	default:
+		log.Fatalf("❌ エラー: RESOURCE_ID_COMPARISON は EQUALS または PREFIX を指定してください (指定値: %s)", comparison)
+	}
+
+	// STANDARD=cis/pci/fsbp で、指定したセキュリティ標準の検出結果のみを取得
+	if standard := strings.ToLower(os.Getenv("STANDARD")); standard != "" {
+		if _, ok := standardIDPrefixes[standard]; !ok {
+			log.Fatalf("❌ エラー: STANDARD は cis、pci、fsbp のいずれかを指定してください (指定値: %s)", standard)
+		}
+		query.Standard = standard
+	}
+
+	// RECORD_STATE で ACTIVE (既定) または ARCHIVED の検出結果を取得 (ALL の場合はレコード状態で絞り込まない)
+	switch recordState := os.Getenv("RECORD_STATE"); recordState {
+	case "", "ACTIVE":
+		query.RecordState = "ACTIVE"
+	case "ARCHIVED":
+		query.RecordState = recordState
+	case "ALL":
+		query.RecordState = ""
+	default:
+		log.Fatalf("❌ エラー: RECORD_STATE は ACTIVE、ARCHIVED、ALL のいずれかを指定してください (指定値: %s)", recordState)
+	}
+
+	// INCREMENTAL=1 で、前回の実行以降に更新された検出結果のみを取得する。
+	// 状態ファイル (INCREMENTAL_STATE_FILE、既定は security_hub_state.json) は正常終了時のみ更新する
+	incremental := os.Getenv("INCREMENTAL") == "1" || os.Getenv("INCREMENTAL") == "true"
+	stateFile := os.Getenv("INCREMENTAL_STATE_FILE")
+	if stateFile == "" {
+		stateFile = "security_hub_state.json"
+	}
+	var state incrementalState
+	if incremental {
+		state, err = loadIncrementalState(stateFile)
+		if err != nil {
+			log.Fatalf("❌ エラー: %v", err)
+		}
+		query.UpdatedAfter = state.LastUpdatedAt
+	}
+
+	// SEVERITY_LEVELS=CRITICAL,HIGH,MEDIUM のように、取得・出力の対象とする重要度を指定する
+	if value := os.Getenv("SEVERITY_LEVELS"); value != "" {
+		levels, err := parseSeverityLevels(value)
+		if err != nil {
+			log.Fatalf("❌ エラー: %v", err)
+		}
+		severityLevels = levels
+	}
+
+	// WORKFLOW_STATUSES=NEW,NOTIFIED,SUPPRESSED のように、取得対象のワークフロー状態を指定する
+	if value := os.Getenv("WORKFLOW_STATUSES"); value != "" {
+		statuses, err := parseWorkflowStatuses(value)
+		if err != nil {
+			log.Fatalf("❌ エラー: %v", err)
+		}
+		workflowStatuses = statuses
+	}
+
+	// 出力対象の重要度
+	severities := make(map[string]bool)
+	for _, level := range severityLevels {
+		severities[level] = true
+	}
+
+	// STREAM=true で、取得したページごとに逐次書き出す (CSV、または OUTPUT_FORMAT=json の場合は JSON Lines)。
+	// メモリ使用量を抑えられる代わりに、出力は並べ替えられず、件数による優先度の加点や集計も行わない
+	stream := os.Getenv("STREAM") == "true"
+
+	// DRY_RUN=true で、取得と変換のみ行って件数を表示し、ファイルは出力しない
+	dryRun := os.Getenv("DRY_RUN") == "true"
+
+	// INCLUDE_PASSED=true の場合は、未対応の検出結果に加えて PASSED の検出結果を別ファイルに出力
+	includePassed := os.Getenv("INCLUDE_PASSED") == "true"
+
+	// RESOURCE_TAG=key=value の場合は、リソースのタグを取得して一致する検出結果のみ出力する
+	// (リソースごとに API を呼び出すため、指定時のみ有効)
+	var resourceTag *ResourceTagFilter
+	if value := os.Getenv("RESOURCE_TAG"); value != "" {
+		filter, err := parseResourceTag(value)
+		if err != nil {
+			log.Fatalf("❌ エラー: %v", err)
+		}
+		resourceTag = &filter
+	}
 
 	log.Println("==========================================")
-	log.Println("Security Hub 検出結果エクスポートツール (CRITICAL/HIGH のみ)")
+	log.Printf("Security Hub 検出結果エクスポートツール (%s のみ)", strings.Join(severityLevels, "/"))
 	log.Println("==========================================")
-	log.Printf("リージョン: %s", region)
+	log.Printf("リージョン: %s", strings.Join(regions, ","))
+	log.Printf("ワークフロー状態: %s", strings.Join(workflowStatuses, ","))
+	if query.Standard != "" {
+		log.Printf("セキュリティ標準: %s", query.Standard)
+	}
 	log.Printf("並列ワーカー数: %d", workerCount)
 	log.Printf("出力ファイル: %s", outputFile)
-	log.Println("==========================================\n")
+	if outputDir != "" {
+		log.Printf("出力ディレクトリ: %s", outputDir)
+	}
+	log.Printf("出力形式: %s", strings.Join(outputFormats, ","))
+	log.Printf("出力言語: %s", locale)
+	if mode != "" {
+		log.Printf("モード: %s", mode)
+	}
+	if sortBy != "" {
+		log.Printf("並び順: %s", sortBy)
+	}
+	log.Printf("レコード状態: %s", query.RecordState)
+	if query.ResourceID != "" {
+		log.Printf("対象リソース: %s (%s)", query.ResourceID, query.ResourceIDComparison)
+	}
+	if resourceTag != nil {
+		log.Printf("リソースタグ: %s=%s (EC2/S3 のみ)", resourceTag.Key, resourceTag.Value)
+	}
+	if includePassed {
+		log.Println("PASSED の検出結果: security_hub_passed.csv に出力")
+	}
+	if len(tagColumns) > 0 {
+		log.Printf("タグ列: %s", strings.Join(tagColumns, ","))
+	}
+	if incremental {
+		if state.LastUpdatedAt.IsZero() {
+			log.Printf("差分取得: 状態ファイル %s がないため全件を取得します", stateFile)
+		} else {
+			log.Printf("差分取得: %s より後に更新された検出結果のみ取得します", state.LastUpdatedAt.UTC().Format(securityHubTimeFormat))
+		}
+	}
+	if dryRun {
+		log.Println("ドライラン: 有効 (ファイルは出力しません)")
+		if stream {
+			log.Fatal("❌ エラー: DRY_RUN と STREAM は併用できません")
+		}
+	}
+	if stream {
+		log.Println("逐次出力: 有効 (並べ替え・件数による加点・集計・追加出力は行いません)")
+		if resourceTag != nil {
+			log.Fatal("❌ エラー: STREAM と RESOURCE_TAG は併用できません")
+		}
+		if dedupByControl {
+			log.Fatal("❌ エラー: STREAM と DEDUP_BY_CONTROL は併用できません")
+		}
+	}
+	log.Println("==========================================")
 
 	cfg, err := loadAWSConfig(ctx, region)
 	if err != nil {
@@ -517,27 +2651,252 @@ func main() {
 
 	client := securityhub.NewFromConfig(cfg)
 
-	findings, err := fetchFindings(ctx, client, workerCount)
+	// SELF_TEST=true の場合は認証と権限の最小限の確認だけを行い、出力ファイルは作成しない
+	if os.Getenv("SELF_TEST") == "true" {
+		if !runSelfTest(ctx, cfg, client) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if mode == "controls" {
+		statuses, err := fetchControlStatuses(ctx, client)
+		if err != nil {
+			log.Fatalf("❌ コントロール状態の取得に失敗: %v", err)
+		}
+		resolved, err := resolveOutputFile(outputFile, outputDir)
+		if err != nil {
+			log.Fatalf("❌ エラー: %v", err)
+		}
+		controlsFile := filepath.Join(filepath.Dir(resolved), "security_hub_controls.csv")
+		if err := exportControlsToCSV(statuses, controlsFile); err != nil {
+			log.Fatalf("❌ CSV出力に失敗: %v", err)
+		}
+		hb.Complete()
+		log.Printf("✅ 処理完了! 出力ファイル: %s", controlsFile)
+		return
+	}
+
+	filters := buildFindingFilters(query)
+	go logFindingEstimate(ctx, client, regions, filters)
+
+	// 複数リージョンを指定した場合は、リージョンごとに並行して取得して結合する
+	// Ctrl-C (SIGINT) で取得を中断した場合は、それまでに取得した検出結果を出力する
+	fetchCtx, stopSignal := signal.NotifyContext(ctx, os.Interrupt)
+	defer stopSignal()
+	fetch := func(filters *types.AwsSecurityFindingFilters, onPage func([]scannedFinding) error) ([]scannedFinding, bool, error) {
+		if len(regions) > 1 {
+			return fetchFindingsInRegions(fetchCtx, regions, filters, workerCount, onPage)
+		}
+		var regionOnPage func([]types.AwsSecurityFinding) error
+		if onPage != nil {
+			regionOnPage = func(findings []types.AwsSecurityFinding) error {
+				return onPage(scannedIn(region, findings))
+			}
+		}
+		findings, truncated, err := fetchFindings(fetchCtx, client, filters, workerCount, regionOnPage)
+		return scannedIn(region, findings), truncated, err
+	}
+
+	// STREAM=true の場合は、取得したページごとに書き出して全件をメモリに保持しない
+	if stream {
+		resolved, err := resolveOutputFile(outputFile, outputDir)
+		if err != nil {
+			log.Fatalf("❌ エラー: %v", err)
+		}
+		fs, err := newFindingStream(resolved, outputFormats, severities)
+		if err != nil {
+			log.Fatalf("❌ 出力ファイルの作成に失敗: %v", err)
+		}
+		onPage := fs.writePage
+		if incremental {
+			// onPage の呼び出しは直列化されるため、ロックせずに最大値を更新できる
+			onPage = func(findings []scannedFinding) error {
+				state.LastUpdatedAt = latestUpdatedAt(findings, state.LastUpdatedAt)
+				return fs.writePage(findings)
+			}
+		}
+		_, truncated, err := fetch(filters, onPage)
+		if err != nil {
+			fs.Abort()
+			log.Fatalf("❌ 検出結果の取得に失敗: %v", err)
+		}
+		if err := fs.Close(); err != nil {
+			log.Fatalf("❌ 出力に失敗: %v", err)
+		}
+		writeFindingsManifest(resolved, fs.paths, truncated)
+		// 中断した場合は、取得しなかった検出結果を次回取得できるよう状態ファイルを更新しない
+		if incremental && !truncated {
+			commitIncrementalState(stateFile, state)
+		}
+
+		log.Println("==========================================")
+		if truncated {
+			log.Println("⚠️ 取得を中断したため、出力は途中までの結果です")
+		}
+		hb.Complete()
+		log.Printf("✅ 処理完了! %d 行を出力 (取得順、並べ替えなし): %s", fs.rows, strings.Join(fs.paths, ", "))
+		log.Println("==========================================")
+		return
+	}
+
+	findings, truncated, err := fetch(filters, nil)
 	if err != nil {
 		log.Fatalf("❌ 検出結果の取得に失敗: %v", err)
 	}
+	state.LastUpdatedAt = latestUpdatedAt(findings, state.LastUpdatedAt)
 
 	if len(findings) == 0 {
-		log.Println("⚠️  CRITICAL/HIGH の検出結果が見つかりませんでした")
+		log.Printf("⚠️  %s の検出結果が見つかりませんでした", strings.Join(severityLevels, "/"))
+		hb.Complete()
 		return
 	}
 
-	details := convertFindings(findings)
+	details := convertFindings(findings, severities, sortBy)
+	tagLookup := newResourceTagLookup(cfg)
+	if resourceTag != nil {
+		details = filterByResourceTag(ctx, details, tagLookup, *resourceTag)
+	}
+	logResourceSummary(details)
+
+	// DRY_RUN=true の場合は件数の表示のみ行い、ファイル (状態ファイルを含む) は作成しない
+	if dryRun {
+		logSeverityCounts(details)
+		log.Println("==========================================")
+		hb.Complete()
+		log.Println("✅ dry run: no file written (ファイルは出力していません)")
+		log.Println("==========================================")
+		return
+	}
+
+	outputFile, err = resolveOutputFile(outputFile, outputDir)
+	if err != nil {
+		log.Fatalf("❌ エラー: %v", err)
+	}
+	var outputFiles []string
+	for _, format := range outputFormats {
+		switch format {
+		case "csv":
+			// SPLIT_BY_SEVERITY=true の場合は、重要度ごとに別のファイルに出力する
+			csvFiles := []string{outputFile}
+			splitBySeverity := os.Getenv("SPLIT_BY_SEVERITY") == "true"
+			if splitBySeverity {
+				files, err := exportToCSVBySeverity(details, outputFile)
+				if err != nil {
+					log.Fatalf("❌ CSV出力に失敗: %v", err)
+				}
+				csvFiles = files
+			} else if err := exportToCSV(details, outputFile); err != nil {
+				log.Fatalf("❌ CSV出力に失敗: %v", err)
+			}
+			outputFiles = append(outputFiles, csvFiles...)
+
+			// OUTPUT_S3_URI=s3://bucket/path/findings.csv の場合は、出力した CSV を S3 にもアップロードする。
+			// 重要度ごとに分割した場合は、指定したキーと同じ階層に各ファイル名でアップロードする
+			if uri := os.Getenv("OUTPUT_S3_URI"); uri != "" {
+				if i := strings.LastIndex(uri, "/"); splitBySeverity && i >= len("s3://") {
+					uri = uri[:i+1]
+				}
+				for _, file := range csvFiles {
+					dest, err := uploadToS3(ctx, cfg, uri, file)
+					if err != nil {
+						log.Fatalf("❌ %v", err)
+					}
+					log.Printf("S3 にアップロードしました: %s", dest)
+				}
+			}
+		case "json":
+			jsonFile := outputPathForFormat(outputFile, "json")
+			if err := exportToJSON(details, jsonFile); err != nil {
+				log.Fatalf("❌ JSON出力に失敗: %v", err)
+			}
+			outputFiles = append(outputFiles, jsonFile)
+		}
+	}
+
+	// INCLUDE_PASSED=true の場合は、準拠しているコントロールの検出結果 (PASSED) を
+	// 対応済みの証跡として security_hub_passed.csv に出力する
+	if includePassed && !truncated {
+		passedQuery := query
+		passedQuery.ComplianceStatus = "PASSED"
+		passedFindings, passedTruncated, err := fetch(buildFindingFilters(passedQuery), nil)
+		if err != nil {
+			log.Fatalf("❌ PASSED の検出結果の取得に失敗: %v", err)
+		}
+		truncated = truncated || passedTruncated
+		passedDetails := convertFindings(passedFindings, nil, sortBy)
+		if resourceTag != nil {
+			passedDetails = filterByResourceTag(ctx, passedDetails, tagLookup, *resourceTag)
+		}
+		passedFile := filepath.Join(filepath.Dir(outputFile), "security_hub_passed.csv")
+		if err := exportToCSV(passedDetails, passedFile); err != nil {
+			log.Fatalf("❌ CSV出力に失敗: %v", err)
+		}
+		outputFiles = append(outputFiles, passedFile)
+	}
+
+	// RESOURCE_TYPE_SUMMARY=true の場合は、リソースタイプ別の件数を別ファイルに出力
+	if os.Getenv("RESOURCE_TYPE_SUMMARY") == "true" {
+		summaryFile := filepath.Join(filepath.Dir(outputFile), "security_hub_by_resource_type.csv")
+		if err := exportResourceTypeSummary(details, summaryFile); err != nil {
+			log.Fatalf("❌ リソースタイプ別集計の出力に失敗: %v", err)
+		}
+		outputFiles = append(outputFiles, summaryFile)
+	}
+
+	// SUMMARY=true の場合は、検知内容ごとの件数を別ファイルに出力
+	if os.Getenv("SUMMARY") == "true" {
+		summaryFile := filepath.Join(filepath.Dir(outputFile), "security_hub_summary.csv")
+		if err := exportControlSummary(details, summaryFile); err != nil {
+			log.Fatalf("❌ 検知内容別集計の出力に失敗: %v", err)
+		}
+		outputFiles = append(outputFiles, summaryFile)
+	}
+
+	// HEATMAP=true の場合は、ダッシュボード用にコントロールID×重要度の件数を別ファイルに出力
+	if os.Getenv("HEATMAP") == "true" {
+		heatmapFile := filepath.Join(filepath.Dir(outputFile), "security_hub_heatmap.csv")
+		if err := exportControlSeverityHeatmap(details, heatmapFile); err != nil {
+			log.Fatalf("❌ ヒートマップの出力に失敗: %v", err)
+		}
+		outputFiles = append(outputFiles, heatmapFile)
+	}
 
-	if err := exportToCSV(details, outputFile); err != nil {
-		log.Fatalf("❌ CSV出力に失敗: %v", err)
+	// INCLUDE_RAW=true の場合は、要約列に含まれない項目も追えるよう生データを併せて出力
+	if os.Getenv("INCLUDE_RAW") == "true" {
+		rawFile := filepath.Join(filepath.Dir(outputFile), "findings_raw.jsonl")
+		if err := exportRawJSONL(findings, rawFile); err != nil {
+			log.Fatalf("❌ 生データ出力に失敗: %v", err)
+		}
+	}
+
+	writeFindingsManifest(outputFile, outputFiles, truncated)
+	if incremental && !truncated {
+		commitIncrementalState(stateFile, state)
 	}
 
 	log.Println("==========================================")
-	log.Printf("✅ 処理完了! 出力ファイル: %s", outputFile)
+	if truncated {
+		log.Println("⚠️ 取得を中断したため、出力は途中までの結果です")
+	}
+	hb.Complete()
+	log.Printf("✅ 処理完了! 出力ファイル: %s", strings.Join(outputFiles, ", "))
 	log.Println("==========================================")
 }
 
+// writeFindingsManifest は、出力ファイルのマニフェスト (<出力ファイル>.manifest.json) を書き出す。
+// 中断により未取得のページが残った場合は truncated: true を記録する
+func writeFindingsManifest(outputFile string, files []string, truncated bool) {
+	var reasons []string
+	if truncated {
+		reasons = append(reasons, "取得を中断したため、未取得のページがあります")
+	}
+	if err := report.WriteManifest(outputFile, report.Manifest{Tool: "get_security_hub_list", Files: files, TruncatedReasons: reasons}); err != nil {
+		log.Fatalf("❌ マニフェストの書き込みに失敗: %v", err)
+	}
+	log.Printf("マニフェストを書き出しました: %s (truncated: %t)", report.ManifestPath(outputFile), truncated)
+}
+
 func stringPtr(s string) *string {
 	return &s
 }
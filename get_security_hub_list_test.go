@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/securityhub"
+	"github.com/aws/aws-sdk-go-v2/service/securityhub/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeFindingsAPI は、ページ番号ごとの検出結果を返す findingsAPI の代替。
+// NextToken にはページ番号を使い、errPage のページではエラーを返す
+type fakeFindingsAPI struct {
+	pages   [][]types.AwsSecurityFinding
+	errPage int // 1 始まり。0 の場合はエラーを返さない
+	// cancelPage のページを取得する際に cancel を呼び出し、中断 (Ctrl-C) を再現する
+	cancelPage int
+	cancel     context.CancelFunc
+
+	mu        sync.Mutex
+	requested []int
+}
+
+func (f *fakeFindingsAPI) GetFindings(ctx context.Context, params *securityhub.GetFindingsInput, optFns ...func(*securityhub.Options)) (*securityhub.GetFindingsOutput, error) {
+	page := 1
+	if params.NextToken != nil {
+		fmt.Sscanf(*params.NextToken, "page-%d", &page)
+	}
+	f.mu.Lock()
+	f.requested = append(f.requested, page)
+	f.mu.Unlock()
+
+	if page == f.errPage {
+		return nil, fmt.Errorf("page %d: internal error", page)
+	}
+	if page == f.cancelPage {
+		f.cancel()
+		return nil, ctx.Err()
+	}
+	out := &securityhub.GetFindingsOutput{Findings: f.pages[page-1]}
+	if page < len(f.pages) {
+		out.NextToken = aws.String(fmt.Sprintf("page-%d", page+1))
+	}
+	return out, nil
+}
+
+// testFinding は Id と重大度だけを持つ検出結果を返す
+func testFinding(id, severity string) types.AwsSecurityFinding {
+	return types.AwsSecurityFinding{
+		Id:       aws.String(id),
+		Severity: &types.Severity{Label: types.SeverityLabel(severity)},
+	}
+}
+
+// testPages は pageCount ページ、各 perPage 件の検出結果を作成する。偶数番目は CRITICAL、奇数番目は HIGH とする
+func testPages(pageCount, perPage int) [][]types.AwsSecurityFinding {
+	pages := make([][]types.AwsSecurityFinding, pageCount)
+	n := 0
+	for p := range pages {
+		for i := 0; i < perPage; i++ {
+			severity := "HIGH"
+			if n%2 == 0 {
+				severity = "CRITICAL"
+			}
+			pages[p] = append(pages[p], testFinding(fmt.Sprintf("finding-%03d", n), severity))
+			n++
+		}
+	}
+	return pages
+}
+
+func findingIDs(findings []types.AwsSecurityFinding) []string {
+	ids := make([]string, len(findings))
+	for i, f := range findings {
+		ids[i] = aws.ToString(f.Id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// captureLog はテスト中のログ出力を返すバッファに切り替える
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestFetchFindingsMultiPage(t *testing.T) {
+	captureLog(t)
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			api := &fakeFindingsAPI{pages: testPages(5, 3)}
+			findings, truncated, err := fetchFindings(context.Background(), api, nil, workers, nil)
+			if err != nil {
+				t.Fatalf("fetchFindings: %v", err)
+			}
+			if truncated {
+				t.Error("全ページを取得したのに truncated になっています")
+			}
+			if got, want := findingIDs(findings), findingIDs(flatten(api.pages)); strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("取得した検出結果 = %v, want %v", got, want)
+			}
+			if len(api.requested) != 5 {
+				t.Errorf("GetFindings の呼び出し回数 = %d, want 5 (%v)", len(api.requested), api.requested)
+			}
+		})
+	}
+}
+
+func flatten(pages [][]types.AwsSecurityFinding) []types.AwsSecurityFinding {
+	var all []types.AwsSecurityFinding
+	for _, page := range pages {
+		all = append(all, page...)
+	}
+	return all
+}
+
+func TestFetchFindingsErrorOnPageN(t *testing.T) {
+	captureLog(t)
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			api := &fakeFindingsAPI{pages: testPages(5, 3), errPage: 3}
+			findings, _, err := fetchFindings(context.Background(), api, nil, workers, nil)
+			if err == nil {
+				t.Fatal("3ページ目のエラーが返されていません")
+			}
+			if !strings.Contains(err.Error(), "page 3") {
+				t.Errorf("エラー = %v, want page 3 のエラー", err)
+			}
+			if findings != nil {
+				t.Errorf("エラー時に %d 件の検出結果が返されています", len(findings))
+			}
+			// エラーのページ以降は取得しない
+			for _, page := range api.requested {
+				if page > 3 {
+					t.Errorf("エラー後に %d ページ目を取得しています", page)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchFindingsStreamsPages(t *testing.T) {
+	logs := captureLog(t)
+	api := &fakeFindingsAPI{pages: testPages(4, 5)}
+
+	var streamed []types.AwsSecurityFinding
+	var active, overlapped atomic.Int32
+	onPage := func(page []types.AwsSecurityFinding) error {
+		if active.Add(1) > 1 {
+			overlapped.Store(1)
+		}
+		defer active.Add(-1)
+		streamed = append(streamed, page...)
+		return nil
+	}
+
+	findings, _, err := fetchFindings(context.Background(), api, nil, 4, onPage)
+	if err != nil {
+		t.Fatalf("fetchFindings: %v", err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("onPage 指定時に %d 件の検出結果が返されています", len(findings))
+	}
+	if overlapped.Load() != 0 {
+		t.Error("onPage が並行して呼び出されています")
+	}
+	if got, want := findingIDs(streamed), findingIDs(flatten(api.pages)); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("onPage に渡された検出結果 = %v, want %v", got, want)
+	}
+	// 重大度別の内訳は、検出結果を保持しない場合もページごとに集計される
+	for _, want := range []string{"CRITICAL: 10件", "HIGH: 10件"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("重大度別の内訳に %q が出力されていません:\n%s", want, logs.String())
+		}
+	}
+}
+
+func TestFetchFindingsInterruptedIsTruncated(t *testing.T) {
+	captureLog(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	api := &fakeFindingsAPI{pages: testPages(4, 2), cancelPage: 3, cancel: cancel}
+
+	findings, truncated, err := fetchFindings(ctx, api, nil, 1, nil)
+	if err != nil {
+		t.Fatalf("中断はエラーにしない: %v", err)
+	}
+	if !truncated {
+		t.Error("中断したのに truncated になっていません")
+	}
+	// 中断前に取得した 2 ページ分は返す
+	if got, want := findingIDs(findings), findingIDs(flatten(api.pages[:2])); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("取得した検出結果 = %v, want %v", got, want)
+	}
+}
+
+func TestFetchFindingsStreamError(t *testing.T) {
+	captureLog(t)
+	api := &fakeFindingsAPI{pages: testPages(3, 2)}
+	errOutput := errors.New("disk full")
+	calls := 0
+	_, _, err := fetchFindings(context.Background(), api, nil, 1, func([]types.AwsSecurityFinding) error {
+		calls++
+		return errOutput
+	})
+	if !errors.Is(err, errOutput) {
+		t.Fatalf("エラー = %v, want %v", err, errOutput)
+	}
+	if calls != 1 || len(api.requested) != 1 {
+		t.Errorf("出力エラー後も取得が続いています (onPage %d 回, GetFindings %d 回)", calls, len(api.requested))
+	}
+}
+
+// regionFinding は、指定したリージョンの検出結果を1件作成する
+func regionFinding(id, region, severity, title, resourceARN string) types.AwsSecurityFinding {
+	finding := testFinding(id, severity)
+	finding.Region = aws.String(region)
+	finding.AwsAccountId = aws.String("111111111111")
+	finding.Title = aws.String(title)
+	finding.Resources = []types.Resource{{Id: aws.String(resourceARN), Type: aws.String("AwsS3Bucket")}}
+	return finding
+}
+
+// rowOrder は出力行の順序を比較しやすい文字列にする
+func rowOrder(details []FindingDetail) []string {
+	order := make([]string, len(details))
+	for i, d := range details {
+		order[i] = d.Region + " " + d.ID + " " + d.ResourceARN
+	}
+	return order
+}
+
+func TestConvertFindingsStableOrderAcrossRegions(t *testing.T) {
+	captureLog(t)
+	findings := []types.AwsSecurityFinding{
+		regionFinding("f-1", "ap-northeast-1", "CRITICAL", "S3.1 block public access", "arn:aws:s3:::bucket-a"),
+		regionFinding("f-1", "us-east-1", "CRITICAL", "S3.1 block public access", "arn:aws:s3:::bucket-a"),
+		regionFinding("f-2", "ap-northeast-1", "HIGH", "S3.5 require SSL", "arn:aws:s3:::bucket-b"),
+		regionFinding("f-2", "us-east-1", "HIGH", "S3.5 require SSL", "arn:aws:s3:::bucket-b"),
+		regionFinding("f-3", "us-east-1", "HIGH", "S3.5 require SSL", "arn:aws:s3:::bucket-c"),
+		regionFinding("f-4", "ap-northeast-1", "CRITICAL", "EC2.19 open ports", "arn:aws:s3:::bucket-d"),
+	}
+	// 取得順 (リージョンの完了順やページの順序) によらず同じ順序になること
+	shuffles := [][]int{
+		{0, 1, 2, 3, 4, 5},
+		{5, 4, 3, 2, 1, 0},
+		{1, 3, 5, 0, 2, 4},
+		{4, 0, 3, 1, 5, 2},
+	}
+
+	tests := []struct {
+		sortBy string
+		want   []string
+	}{
+		{"", []string{
+			"ap-northeast-1 f-4 arn:aws:s3:::bucket-d",
+			"ap-northeast-1 f-1 arn:aws:s3:::bucket-a",
+			"us-east-1 f-1 arn:aws:s3:::bucket-a",
+			"ap-northeast-1 f-2 arn:aws:s3:::bucket-b",
+			"us-east-1 f-2 arn:aws:s3:::bucket-b",
+			"us-east-1 f-3 arn:aws:s3:::bucket-c",
+		}},
+		{"priority", nil},
+		{"exposure", nil},
+	}
+	for _, tt := range tests {
+		t.Run("sortBy="+tt.sortBy, func(t *testing.T) {
+			var first []string
+			for _, shuffle := range shuffles {
+				input := make([]scannedFinding, len(shuffle))
+				for i, j := range shuffle {
+					input[i] = scannedFinding{AwsSecurityFinding: findings[j], ScanRegion: aws.ToString(findings[j].Region)}
+				}
+				got := rowOrder(convertFindings(input, nil, tt.sortBy))
+				if first == nil {
+					first = got
+					if tt.want != nil && strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+						t.Fatalf("順序 =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+					}
+					continue
+				}
+				if strings.Join(got, "\n") != strings.Join(first, "\n") {
+					t.Errorf("入力順 %v で順序が変わりました:\n%s\nwant\n%s", shuffle, strings.Join(got, "\n"), strings.Join(first, "\n"))
+				}
+			}
+		})
+	}
+}
+
+func TestStableKey(t *testing.T) {
+	newFinding := func(id, updatedAt string, resourceARNs ...string) types.AwsSecurityFinding {
+		finding := types.AwsSecurityFinding{
+			Id:           aws.String(id),
+			AwsAccountId: aws.String("111111111111"),
+			Title:        aws.String("S3.1 S3 general purpose buckets should have block public access settings enabled"),
+			Compliance:   &types.Compliance{SecurityControlId: aws.String("S3.1")},
+			UpdatedAt:    aws.String(updatedAt),
+		}
+		for _, arn := range resourceARNs {
+			finding.Resources = append(finding.Resources, types.Resource{Id: aws.String(arn), Type: aws.String("AwsS3Bucket")})
+		}
+		return finding
+	}
+	stableIDs := func(finding types.AwsSecurityFinding) map[string]string {
+		ids := make(map[string]string)
+		for _, row := range findingRows(scannedFinding{AwsSecurityFinding: finding}, nil, time.Now()) {
+			ids[row.ResourceARN] = row.StableID
+		}
+		return ids
+	}
+
+	// 前回の実行: 検出結果の Id は再作成のたびに変わる UUID を含む
+	previous := newFinding("arn:aws:securityhub:ap-northeast-1:111111111111:subscription/aws-foundational/v/1.0.0/S3.1/finding/0b1c", "2026-10-01T00:00:00Z",
+		"arn:aws:s3:::bucket-a", "arn:aws:s3:::bucket-b")
+	// 今回の実行: Id・更新日時が変わり、リソースの並びも逆になっている
+	current := newFinding("arn:aws:securityhub:us-east-1:111111111111:security-control/S3.1/finding/9f8e", "2026-10-17T00:00:00Z",
+		"arn:aws:s3:::bucket-b", "arn:aws:s3:::bucket-a")
+
+	want := map[string]string{
+		"arn:aws:s3:::bucket-a": "111111111111|S3.1|arn:aws:s3:::bucket-a",
+		"arn:aws:s3:::bucket-b": "111111111111|S3.1|arn:aws:s3:::bucket-b",
+	}
+	for name, finding := range map[string]types.AwsSecurityFinding{"previous": previous, "current": current} {
+		got := stableIDs(finding)
+		if len(got) != len(want) {
+			t.Fatalf("%s: StableID = %v, want %v", name, got, want)
+		}
+		for arn, id := range want {
+			if got[arn] != id {
+				t.Errorf("%s: %s の StableID = %q, want %q", name, arn, got[arn], id)
+			}
+		}
+	}
+
+	// コントロールID が ProductFields にしかない検出結果でも同じキーになる
+	legacy := newFinding("legacy", "2026-10-17T00:00:00Z")
+	legacy.Compliance = nil
+	legacy.ProductFields = map[string]string{"ControlId": "S3.1"}
+	if got, want := stableKey(legacy, "arn:aws:s3:::bucket-a"), want["arn:aws:s3:::bucket-a"]; got != want {
+		t.Errorf("stableKey(ProductFields) = %q, want %q", got, want)
+	}
+}
+
+func TestCollapseByControl(t *testing.T) {
+	details := []FindingDetail{
+		{ID: "f-1", ControlID: "S3.1", Description: "S3.1 ブロックパブリックアクセス", ResourceARN: "arn:aws:s3:::a", Resource: "a", PriorityScore: 5},
+		{ID: "f-2", ControlID: "EC2.19", Description: "EC2.19 高リスクポート", ResourceARN: "arn:aws:ec2:sg-1", Resource: "sg-1", PriorityScore: 7},
+		// 同じコントロールでも、セキュリティ標準によってタイトルが異なる
+		{ID: "f-3", ControlID: "S3.1", Description: "S3.1 S3 general purpose buckets should have block public access settings enabled", ResourceARN: "arn:aws:s3:::b", Resource: "b", PriorityScore: 9, InternetExposed: true},
+		{ID: "f-4", ControlID: "S3.1", Description: "S3.1 ブロックパブリックアクセス", ResourceARN: "arn:aws:s3:::a", Resource: "a", PriorityScore: 1},
+	}
+
+	got := collapseByControl(details)
+	if len(got) != 2 {
+		t.Fatalf("%d 行に集約されました, want 2: %+v", len(got), got)
+	}
+	s3 := got[0]
+	if s3.ControlID != "S3.1" || got[1].ControlID != "EC2.19" {
+		t.Errorf("並び順 = %s, %s, want S3.1, EC2.19", s3.ControlID, got[1].ControlID)
+	}
+	if s3.ID != "" || got[1].ID != "" {
+		t.Errorf("集約した行の ID = %q, %q, want 空", s3.ID, got[1].ID)
+	}
+	if s3.ResourceARN != "arn:aws:s3:::a\narn:aws:s3:::b" || s3.ResourceCount != 2 {
+		t.Errorf("リソース = %q (%d 件), want a と b の 2 件", s3.ResourceARN, s3.ResourceCount)
+	}
+	if s3.PriorityScore != 9 || !s3.InternetExposed {
+		t.Errorf("優先度 = %d, インターネット公開 = %v, want 9, true", s3.PriorityScore, s3.InternetExposed)
+	}
+}
+
+func TestClampWorkerCount(t *testing.T) {
+	tests := []struct {
+		in          int
+		want        int
+		wantClamped bool
+	}{
+		{0, 1, true},
+		{-3, 1, true},
+		{1, 1, false},
+		{10, 10, false},
+		{50, 50, false},
+		{51, 50, true},
+	}
+	for _, tt := range tests {
+		got, clamped := clampWorkerCount(tt.in)
+		if got != tt.want || clamped != tt.wantClamped {
+			t.Errorf("clampWorkerCount(%d) = (%d, %v), want (%d, %v)", tt.in, got, clamped, tt.want, tt.wantClamped)
+		}
+	}
+}
+
+func TestEstimateFindingCountLowerBound(t *testing.T) {
+	tests := []struct {
+		name  string
+		pages [][]types.AwsSecurityFinding
+		want  findingEstimate
+		lower int
+	}{
+		{"1ページで確定", testPages(1, 37), findingEstimate{FirstPage: 37}, 37},
+		// 100 件 + 続きのページ: 確実に言えるのは 101 件以上であること (200 件などの固定値ではない)
+		{"続きのページあり", append(testPages(1, 100), []types.AwsSecurityFinding{testFinding("last", "HIGH")}), findingEstimate{FirstPage: 100, More: true}, 101},
+		{"0件", [][]types.AwsSecurityFinding{nil}, findingEstimate{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := estimateFindingCount(context.Background(), &fakeFindingsAPI{pages: tt.pages}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("estimateFindingCount = %+v, want %+v", got, tt.want)
+			}
+			if lower := got.LowerBound(); lower != tt.lower {
+				t.Errorf("LowerBound() = %d, want %d", lower, tt.lower)
+			}
+		})
+	}
+}
+
+func TestFindingRowsScanRegion(t *testing.T) {
+	// リージョン間の集約: us-east-1 から取得した検出結果の Region は集約元の ap-northeast-1 になる
+	finding := regionFinding("f-1", "ap-northeast-1", "HIGH", "S3.5 require SSL", "arn:aws:s3:::bucket-a")
+	rows := findingRows(scannedFinding{AwsSecurityFinding: finding, ScanRegion: "us-east-1"}, nil, time.Now())
+	if len(rows) != 1 {
+		t.Fatalf("行数 = %d, want 1", len(rows))
+	}
+	if rows[0].Region != "ap-northeast-1" || rows[0].ScanRegion != "us-east-1" {
+		t.Errorf("Region = %q, ScanRegion = %q, want ap-northeast-1, us-east-1", rows[0].Region, rows[0].ScanRegion)
+	}
+
+	column := -1
+	for i, header := range csvHeaders() {
+		if header == localize("スキャンリージョン", "ScanRegion") {
+			column = i
+		}
+	}
+	if got := csvRecord(rows[0])[column]; got != "us-east-1" {
+		t.Errorf("スキャンリージョン列 = %q, want us-east-1", got)
+	}
+}
+
+// fakeTagAPIs は、リソースのリージョンに送られた呼び出しにだけタグを返す S3・EC2 の代替。
+// 別のリージョンに送られた S3 の呼び出しは、実際の S3 と同じくリダイレクトのエラーになる
+type fakeTagAPIs struct {
+	bucketLocations map[string]s3types.BucketLocationConstraint
+	// "<リージョン>/<バケット名またはリソースID>" → タグ
+	tags map[string]map[string]string
+}
+
+func (f *fakeTagAPIs) GetBucketLocation(ctx context.Context, params *s3.GetBucketLocationInput, optFns ...func(*s3.Options)) (*s3.GetBucketLocationOutput, error) {
+	return &s3.GetBucketLocationOutput{LocationConstraint: f.bucketLocations[aws.ToString(params.Bucket)]}, nil
+}
+
+func (f *fakeTagAPIs) GetBucketTagging(ctx context.Context, params *s3.GetBucketTaggingInput, optFns ...func(*s3.Options)) (*s3.GetBucketTaggingOutput, error) {
+	var o s3.Options
+	for _, fn := range optFns {
+		fn(&o)
+	}
+	tags, ok := f.tags[o.Region+"/"+aws.ToString(params.Bucket)]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "PermanentRedirect", Message: "the bucket is in another region"}
+	}
+	output := &s3.GetBucketTaggingOutput{}
+	for key, value := range tags {
+		output.TagSet = append(output.TagSet, s3types.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return output, nil
+}
+
+func (f *fakeTagAPIs) DescribeTags(ctx context.Context, params *ec2.DescribeTagsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeTagsOutput, error) {
+	var o ec2.Options
+	for _, fn := range optFns {
+		fn(&o)
+	}
+	output := &ec2.DescribeTagsOutput{}
+	for key, value := range f.tags[o.Region+"/"+params.Filters[0].Values[0]] {
+		output.Tags = append(output.Tags, ec2types.TagDescription{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return output, nil
+}
+
+func TestFilterByResourceTagCrossRegion(t *testing.T) {
+	captureLog(t)
+	prod := map[string]string{"Environment": "prod"}
+	apis := &fakeTagAPIs{
+		bucketLocations: map[string]s3types.BucketLocationConstraint{
+			"eu-bucket":     "eu-west-1",
+			"legacy-bucket": "EU",
+			"us-bucket":     "",
+		},
+		tags: map[string]map[string]string{
+			"eu-west-1/eu-bucket":     prod,
+			"eu-west-1/legacy-bucket": prod,
+			"us-east-1/us-bucket":     prod,
+			"us-west-2/i-west":        prod,
+			"ap-northeast-1/i-dev":    {"Environment": "dev"},
+		},
+	}
+	lookup := &resourceTagLookup{ec2Client: apis, s3Client: apis, cache: make(map[string]map[string]string), bucketRegions: make(map[string]string)}
+
+	// 検出結果はいずれも ap-northeast-1 (集約先) のもので、リソースは別のリージョンにある
+	bucket := func(name string) FindingDetail {
+		return FindingDetail{ResourceType: "AwsS3Bucket", ResourceARN: "arn:aws:s3:::" + name, Region: "ap-northeast-1", ResourceRegion: "global"}
+	}
+	instance := func(region, id string) FindingDetail {
+		arn := "arn:aws:ec2:" + region + ":111111111111:instance/" + id
+		return FindingDetail{ResourceType: "AwsEc2Instance", ResourceARN: arn, Region: "ap-northeast-1", ResourceRegion: resourceRegionFromARN(arn)}
+	}
+	details := []FindingDetail{
+		bucket("eu-bucket"),
+		bucket("legacy-bucket"),
+		bucket("us-bucket"),
+		instance("us-west-2", "i-west"),
+		instance("ap-northeast-1", "i-dev"),
+	}
+
+	var got []string
+	for _, detail := range filterByResourceTag(context.Background(), details, lookup, ResourceTagFilter{Key: "Environment", Value: "prod"}) {
+		got = append(got, detail.ResourceARN)
+	}
+	want := []string{
+		"arn:aws:s3:::eu-bucket",
+		"arn:aws:s3:::legacy-bucket",
+		"arn:aws:s3:::us-bucket",
+		"arn:aws:ec2:us-west-2:111111111111:instance/i-west",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("絞り込み結果 =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -2,112 +2,94 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
 	"fmt"
 	"log"
 	"os"
 	"sort"
 
 	"github.com/google/go-github/v63/github"
-	"golang.org/x/oauth2"
-	"github.com/joho/godotenv" // 追加
+
+	"securityhub-exporter/envfile"
+	"securityhub-exporter/heartbeat"
+	"securityhub-exporter/githubapi"
+	"securityhub-exporter/report"
 )
 
 func main() {
 	// .envファイルを読み込み
-	if err := godotenv.Load(); err != nil {
-		log.Printf("警告: .envファイルが見つからないか、読み込めませんでした: %v", err)
+	if err := envfile.Load(); err != nil {
+		log.Fatalf("エラー: %v", err)
 	}
 
+	// HEARTBEAT_FILE が設定されていれば、外部監視用に実行状況を定期的に書き込む
+	hb := heartbeat.Start("get_team_repo_matrix")
+	defer hb.Stop()
+
 	token := os.Getenv("GITHUB_TOKEN")
 	ownerName := os.Getenv("GITHUB_OWNER") // .envから読み込み
 	outputFile := "github_user_team_matrix.csv"
+	teamsFile := "teams.csv"
+
+	// FORMAT=long の場合は、マトリクスの代わりに1所属1行の縦持ちの表を出力する
+	longFormat := os.Getenv("FORMAT") == "long"
+	if longFormat {
+		outputFile = "github_user_team_long.csv"
+	}
 
 	if token == "" || ownerName == "" {
 		log.Fatal("エラー: GITHUB_TOKEN または GITHUB_OWNER が .envファイル、または環境変数で設定されていません。")
 	}
 
 	ctx := context.Background()
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: token},
-	)
-	tc := oauth2.NewClient(ctx, ts)
-	client := github.NewClient(tc)
-
-	// CSVファイル作成
-	file, err := os.Create(outputFile)
+	client, err := githubapi.NewClient(ctx, token)
 	if err != nil {
-		log.Fatalf("CSVファイルの作成に失敗しました: %v", err)
+		log.Fatalf("エラー: %v", err)
 	}
-	defer file.Close()
+	// 終了時に、今回の実行で消費した API リクエスト数と残量を表示する
+	defer func() { fmt.Println(githubapi.DefaultRateUsage.Summary()) }()
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
-	fmt.Printf("Organization '%s' のユーザーとチームの所属情報を取得中...\n", ownerName)
-
-	// 1. 全メンバーと全チームを取得
-	optList := &github.ListOptions{PerPage: 100}
-	allUsers := []*github.User{}
-	allTeams := []*github.Team{}
-
-	// 全ユーザー
-	for {
-		members, resp, err := client.Organizations.ListMembers(ctx, ownerName, optList) // ownerNameを使用
-		if err != nil {
-			log.Fatalf("メンバー一覧の取得に失敗しました: %v", err)
-		}
-		allUsers = append(allUsers, members...)
-		if resp.NextPage == 0 {
-			break
+	// SELF_TEST=true の場合は認証とアクセス権の確認だけを行って終了する
+	if os.Getenv("SELF_TEST") == "true" {
+		if !githubapi.SelfTest(ctx, client, ownerName, true) {
+			os.Exit(1)
 		}
-		optList.Page = resp.NextPage
+		return
 	}
 
-	// 全チーム
-	optList.Page = 1 
-	for {
-		teams, resp, err := client.Teams.ListTeams(ctx, ownerName, optList) // ownerNameを使用
-		if err != nil {
-			log.Fatalf("チーム一覧の取得に失敗しました: %v", err)
-		}
-		allTeams = append(allTeams, teams...)
-		if resp.NextPage == 0 {
-			break
-		}
-		optList.Page = resp.NextPage
+	if err := githubapi.RequireOrganization(ctx, client, ownerName); err != nil {
+		log.Fatalf("エラー: %v", err)
 	}
 
-	// 2. ユーザーごとの所属チーム情報を収集
-	userTeamMap := make(map[string]map[string]bool) 
+	fmt.Printf("Organization '%s' のユーザーとチームの所属情報を取得中...\n", ownerName)
 
-	for _, user := range allUsers {
-		userTeamMap[user.GetLogin()] = make(map[string]bool)
+	// API=graphql の場合は、メンバー・チーム・所属を GraphQL API でまとめて取得する (既定は REST API)
+	userTeamMap, allTeams, err := githubapi.FetchUserTeamMapFromEnv(ctx, client, ownerName)
+	if err != nil {
+		log.Fatalf("エラー: %v", err)
 	}
 
-	for _, team := range allTeams {
-		fmt.Printf("  チーム: %s のメンバーを取得...\n", team.GetName())
-		optList.Page = 1 
-
-		for {
-			// ownerNameを使用
-			members, resp, err := client.Teams.ListTeamMembersBySlug(ctx, ownerName, team.GetSlug(), &github.TeamListTeamMembersOptions{ListOptions: *optList}) 
-			if err != nil {
-				log.Printf("チーム %s のメンバー取得に失敗しました: %v", team.GetName(), err)
-				break
-			}
-			for _, member := range members {
-				if _, ok := userTeamMap[member.GetLogin()]; ok {
-					userTeamMap[member.GetLogin()][team.GetName()] = true
-				}
-			}
+	if longFormat {
+		rows, err := writeLongCSV(userTeamMap, outputFile)
+		if err != nil {
+			log.Fatalf("CSVファイルの書き込みに失敗しました: %v", err)
+		}
+		fmt.Printf("\n✅ %d 件のチーム所属を '%s' に保存しました。\n", rows, outputFile)
 
-			if resp.NextPage == 0 {
-				break
-			}
-			optList.Page = resp.NextPage
+		// ロング形式でも各チームのメタ情報はサイドカーに出力する
+		if err := writeTeamsCSV(allTeams, teamsFile); err != nil {
+			log.Fatalf("チーム情報の出力に失敗しました: %v", err)
 		}
+		fmt.Printf("✅ チームのメタ情報を '%s' に保存しました。\n", teamsFile)
+		hb.Complete()
+		return
+	}
+
+	// CSVファイル作成
+	writer, err := report.Create(outputFile, report.OptionsFromEnv())
+	if err != nil {
+		log.Fatalf("CSVファイルの作成に失敗しました: %v", err)
 	}
+	defer writer.Close()
 
 	// 3. CSVに書き出し (以降は変更なし)
 	userLogins := []string{}
@@ -130,7 +112,7 @@ func main() {
 		teamsBelonging := userTeamMap[login]
 		for _, teamName := range teamNames {
 			is_member := ""
-			if teamsBelonging[teamName] {
+			if teamsBelonging[teamName] != "" {
 				is_member = "Yes"
 			}
 			row = append(row, is_member)
@@ -138,5 +120,72 @@ func main() {
 		writer.Write(row)
 	}
 
+	if err := writer.Close(); err != nil {
+		log.Fatalf("CSVファイルの書き込みに失敗しました: %v", err)
+	}
+
 	fmt.Printf("\n✅ ユーザー → チームのマトリクスを '%s' に保存しました。\n", outputFile)
+
+	if err := writeTeamsCSV(allTeams, teamsFile); err != nil {
+		log.Fatalf("チーム情報の出力に失敗しました: %v", err)
+	}
+	fmt.Printf("✅ チームのメタ情報を '%s' に保存しました。\n", teamsFile)
+	hb.Complete()
+}
+
+// writeTeamsCSV は、マトリクスの各列が表すチームのメタ情報 (スラッグ、説明、公開範囲、親チーム) を
+// サイドカーの CSV に書き出す
+func writeTeamsCSV(teams []*github.Team, path string) error {
+	sorted := append([]*github.Team{}, teams...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+
+	writer, err := report.Create(path, report.OptionsFromEnv())
+	if err != nil {
+		return fmt.Errorf("チーム情報CSVの作成に失敗しました: %w", err)
+	}
+	defer writer.Close()
+
+	writer.Write([]string{"Team (チーム名)", "Slug", "Description (説明)", "Privacy (公開範囲)", "Parent (親チーム)"})
+	for _, team := range sorted {
+		writer.Write([]string{
+			team.GetName(),
+			team.GetSlug(),
+			team.GetDescription(),
+			team.GetPrivacy(), // "secret" または "closed"
+			team.GetParent().GetName(),
+		})
+	}
+	return writer.Close()
+}
+
+// writeLongCSV は、userTeamMap を1所属1行の縦持ち (ログイン名、チーム名、ロール) の CSV に書き出す。
+// マトリクスと違い列がチーム数に依存しないため、データベースや BI ツールに取り込みやすい
+func writeLongCSV(userTeamMap map[string]map[string]string, path string) (int, error) {
+	writer, err := report.Create(path, report.OptionsFromEnv())
+	if err != nil {
+		return 0, fmt.Errorf("CSVファイルの作成に失敗しました: %w", err)
+	}
+	defer writer.Close()
+
+	userLogins := []string{}
+	for login := range userTeamMap {
+		userLogins = append(userLogins, login)
+	}
+	sort.Strings(userLogins)
+
+	writer.Write([]string{"Login (ユーザー名)", "Team (チーム名)", "Role (ロール)"})
+	rows := 0
+	for _, login := range userLogins {
+		teamNames := []string{}
+		for teamName := range userTeamMap[login] {
+			teamNames = append(teamNames, teamName)
+		}
+		sort.Strings(teamNames)
+
+		for _, teamName := range teamNames {
+			writer.Write([]string{login, teamName, userTeamMap[login][teamName]})
+			rows++
+		}
+	}
+	return rows, writer.Close()
 }
\ No newline at end of file
@@ -3,14 +3,24 @@ package main
 import (
 	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/go-github/v63/github"
-	"golang.org/x/oauth2"
-	"github.com/joho/godotenv"
+
+	"securityhub-exporter/envfile"
+	"securityhub-exporter/heartbeat"
+	"securityhub-exporter/githubapi"
+	"securityhub-exporter/report"
 )
 
 // 過去のユーザーデータ構造体
@@ -19,30 +29,52 @@ type OldUserData struct {
 	Email string
 }
 
-// 過去のCSVからLoginとName, Emailのマップを作成する関数
-func loadOldUsers(filename string) map[string]OldUserData {
+// 過去のCSVからLoginとName, Emailのマップを作成する関数。
+// 複数のファイルを指定した場合は、後のファイルの空でない値で前のファイルの値を上書きする
+// (古い順に指定すると、ユーザーごとに最新の氏名・メールアドレスが残る)。
+// 氏名・メールアドレスがともに空の行も含め、過去のCSVに存在したすべての Login の集合もあわせて返す
+func loadOldUsers(filenames []string) (map[string]OldUserData, map[string]bool) {
 	oldUsers := make(map[string]OldUserData)
+	oldLogins := make(map[string]bool)
+	for _, filename := range filenames {
+		logins, count := loadOldUsersFile(filename, oldUsers)
+		for login := range logins {
+			oldLogins[login] = true
+		}
+		log.Printf("過去のCSVファイル '%s' から %d 件の氏名/メールアドレス情報を読み込みました。", filename, count)
+	}
+	if len(filenames) > 1 {
+		log.Printf("過去のCSVファイル %d 件を統合し、%d 人分の氏名/メールアドレス情報を読み込みました。", len(filenames), len(oldUsers))
+	}
+	return oldUsers, oldLogins
+}
+
+// loadOldUsersFile は、1つの過去のCSVの氏名・メールアドレスを oldUsers に統合し、
+// このファイルに存在したすべての Login の集合と、氏名・メールアドレスを読み込んだ件数を返す
+func loadOldUsersFile(filename string, oldUsers map[string]OldUserData) (map[string]bool, int) {
 	file, err := os.Open(filename)
 	if err != nil {
-		log.Printf("警告: 過去のCSVファイル '%s' の読み込みに失敗しました。自動埋め込みはスキップされます。", filename)
-		return oldUsers
+		log.Printf("警告: 過去のCSVファイル '%s' の読み込みに失敗しました。このファイルからの自動埋め込みはスキップされます。", filename)
+		return nil, 0
 	}
 	defer file.Close()
 
 	reader := csv.NewReader(file)
 	// ヘッダー行をスキップ
 	if _, err := reader.Read(); err != nil {
-		log.Printf("警告: 過去のCSVファイルからヘッダーの読み込みに失敗しました。")
-		return oldUsers
+		log.Printf("警告: 過去のCSVファイル '%s' からヘッダーの読み込みに失敗しました。", filename)
+		return nil, 0
 	}
 
+	logins := make(map[string]bool)
+	count := 0
 	for {
 		record, err := reader.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			log.Printf("警告: 過去のCSVファイルのレコード読み込み中にエラーが発生しました: %v", err)
+			log.Printf("警告: 過去のCSVファイル '%s' のレコード読み込み中にエラーが発生しました: %v", filename, err)
 			continue
 		}
 		
@@ -51,56 +83,250 @@ func loadOldUsers(filename string) map[string]OldUserData {
 			login := record[0] 
 			name := record[1]  // 氏名 (インデックス 1)
 			email := record[2] // メールアドレス (インデックス 2)
-			
 			if login != "" {
-				// 氏名かメールアドレスの少なくとも一方があれば記録
-				if name != "" || email != "" {
-					oldUsers[login] = OldUserData{Name: name, Email: email}
+				logins[login] = true
+			}
+
+			// 氏名かメールアドレスの少なくとも一方があれば記録 (空の項目は前のファイルの値を残す)
+			if login != "" && (name != "" || email != "") {
+				data := oldUsers[login]
+				if name != "" {
+					data.Name = name
+				}
+				if email != "" {
+					data.Email = email
 				}
+				oldUsers[login] = data
+				count++
 			}
 		}
 	}
-	log.Printf("過去のCSVファイルから %d 件の氏名/メールアドレス情報を読み込みました。", len(oldUsers))
-	return oldUsers
+	return logins, count
+}
+
+// writeRemovedUsers は、過去のCSVに存在し (oldLogins) 現在の Organization にいないユーザーを、
+// 過去の氏名・メールアドレスとともに Login の順に書き出し、件数を返す (退職者・離任者の確認用)。
+// 氏名・メールアドレスが空のユーザーも対象とする
+func writeRemovedUsers(path string, oldLogins map[string]bool, oldUserMap map[string]OldUserData, currentUsers []*github.User) (int, error) {
+	current := make(map[string]bool, len(currentUsers))
+	for _, user := range currentUsers {
+		current[user.GetLogin()] = true
+	}
+
+	removed := []string{}
+	for login := range oldLogins {
+		if !current[login] {
+			removed = append(removed, login)
+		}
+	}
+	sort.Strings(removed)
+
+	writer, err := report.Create(path, report.OptionsFromEnv())
+	if err != nil {
+		return 0, fmt.Errorf("CSVファイルの作成に失敗しました: %w", err)
+	}
+	defer writer.Close()
+
+	writer.Write([]string{"Login (ユーザー名)", "Name (氏名)", "Email"})
+	for _, login := range removed {
+		writer.Write([]string{login, oldUserMap[login].Name, oldUserMap[login].Email})
+	}
+	return len(removed), writer.Close()
+}
+
+// fetchTwoFactorDisabled は、2要素認証を有効にしていないメンバーの Login の集合を返す。
+// この絞り込みは Organization のオーナーのトークンでのみ利用できる
+func fetchTwoFactorDisabled(ctx context.Context, client *github.Client, ownerName string) (map[string]bool, *github.Response, error) {
+	disabled := make(map[string]bool)
+	opt := &github.ListMembersOptions{Filter: "2fa_disabled", ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		members, resp, err := client.Organizations.ListMembers(ctx, ownerName, opt)
+		if err != nil {
+			return nil, resp, err
+		}
+		for _, member := range members {
+			disabled[member.GetLogin()] = true
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+	return disabled, nil, nil
+}
+
+// 検索 API で取得できる結果の上限 (total_count がこれを超える分は、ページを進めても取得できない)
+const searchResultCap = 1000
+
+// inferEmail は、ユーザーが作成した公開コミットを新しい順に検索し、
+// noreply 以外の作成者メールアドレスが見つかればそれを返す (見つからない場合は空文字)。
+// 検索 API のレート制限 (1分あたり30回) にかかった場合は、解除を待って1回だけ再試行する。
+// 見つからなかった場合に、検索がタイムアウトした (incomplete_results) ときや結果が上限を超えたときは、
+// 「メールアドレスなし」と区別できるよう警告を出す
+func inferEmail(ctx context.Context, client *github.Client, login string) (string, error) {
+	opt := &github.SearchOptions{Sort: "author-date", Order: "desc", ListOptions: github.ListOptions{PerPage: 30}}
+	result, _, err := client.Search.Commits(ctx, "author:"+login, opt)
+	var rateErr *github.RateLimitError
+	if errors.As(err, &rateErr) {
+		wait := max(time.Until(rateErr.Rate.Reset.Time)+time.Second, time.Second)
+		log.Printf("検索 API のレート制限のため %s 待機します", wait.Round(time.Second))
+		time.Sleep(wait)
+		result, _, err = client.Search.Commits(ctx, "author:"+login, opt)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	for _, commit := range result.Commits {
+		email := commit.GetCommit().GetAuthor().GetEmail()
+		if email == "" || isNoreplyEmail(email) {
+			continue
+		}
+		return email, nil
+	}
+	if result.GetIncompleteResults() {
+		log.Printf("警告: ユーザー %s のコミット検索がタイムアウトしたため、結果が不完全です (incomplete_results)。メールアドレスを推定できなかった可能性があります", login)
+	} else if result.GetTotal() > searchResultCap {
+		log.Printf("警告: ユーザー %s のコミットは %d 件あり、検索 API の上限 (%d 件) を超えています。新しい順の先頭 %d 件からはメールアドレスを推定できませんでした", login, result.GetTotal(), searchResultCap, len(result.Commits))
+	}
+	return "", nil
+}
+
+// isNoreplyEmail は、GitHub が発行する返信不可のメールアドレスかを返す
+func isNoreplyEmail(email string) bool {
+	email = strings.ToLower(email)
+	return email == "noreply@github.com" || strings.HasSuffix(email, "@users.noreply.github.com")
+}
+
+// 同時にユーザーの詳細情報を取得する数の既定値 (GitHub の二次レート制限にかからない程度に抑える)
+const defaultWorkerCount = 5
+
+// メンバー1人分の詳細情報
+type UserDetail struct {
+	User *github.User
+	Role string // Organization でのロール (owner、member、billing_manager。取得できない場合は空)
+}
+
+// fetchUserDetails は、メンバーごとの詳細情報 (Users.Get) と Organization でのロールを
+// workerCount 並列で取得し、Login の順に並べて返す。詳細情報の取得に失敗したユーザーは警告を出して除外する
+func fetchUserDetails(ctx context.Context, client *github.Client, ownerName string, members []*github.User, workerCount int) []UserDetail {
+	results := make([]*UserDetail, len(members))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workerCount; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				login := members[i].GetLogin()
+				user, _, err := client.Users.Get(ctx, login)
+				if err != nil {
+					log.Printf("ユーザー %s の詳細情報の取得に失敗しました: %v", login, err)
+					continue
+				}
+				detail := &UserDetail{User: user}
+
+				membership, _, err := client.Organizations.GetOrgMembership(ctx, login, ownerName)
+				if err != nil {
+					log.Printf("警告: ユーザー %s のロールの取得に失敗しました: %v", login, err)
+				} else {
+					detail.Role = orgRoleLabel(membership.GetRole())
+				}
+				results[i] = detail
+			}
+		}()
+	}
+	for i := range members {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	details := []UserDetail{}
+	for _, detail := range results {
+		if detail != nil {
+			details = append(details, *detail)
+		}
+	}
+	sort.Slice(details, func(i, j int) bool { return details[i].User.GetLogin() < details[j].User.GetLogin() })
+	return details
+}
+
+// orgRoleLabel は、API のロール名を画面上の表記に合わせる (API の "admin" は画面上の Owner)
+func orgRoleLabel(role string) string {
+	if role == "admin" {
+		return "owner"
+	}
+	return role
 }
 
 func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Printf("警告: .envファイルが見つからないか、読み込めませんでした: %v", err)
+	if err := envfile.Load(); err != nil {
+		log.Fatalf("エラー: %v", err)
 	}
 
+	// HEARTBEAT_FILE が設定されていれば、外部監視用に実行状況を定期的に書き込む
+	hb := heartbeat.Start("get_users")
+	defer hb.Stop()
+
 	token := os.Getenv("GITHUB_TOKEN")
 	ownerName := os.Getenv("GITHUB_OWNER") 
 	outputFile := "github_user_list.csv"
+	removedFile := "removed_users.csv"
 	
-	const oldCsvFile = "old_user_list.csv" 
+	// OLD_CSV_FILES で、過去のCSVを古い順にカンマ区切りで複数指定できる (未指定時は old_user_list.csv)
+	oldCsvFiles := []string{"old_user_list.csv"}
+	if value := os.Getenv("OLD_CSV_FILES"); value != "" {
+		oldCsvFiles = nil
+		for _, file := range strings.Split(value, ",") {
+			if file = strings.TrimSpace(file); file != "" {
+				oldCsvFiles = append(oldCsvFiles, file)
+			}
+		}
+	}
 	
 	// 過去のユーザーデータを読み込み
-	oldUserMap := loadOldUsers(oldCsvFile)
+	oldUserMap, oldLogins := loadOldUsers(oldCsvFiles)
 
 	if token == "" || ownerName == "" { 
 		log.Fatal("エラー: GITHUB_TOKEN または GITHUB_OWNER が .envファイル、または環境変数で設定されていません。")
 	}
 
 	ctx := context.Background()
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: token},
-	)
-	tc := oauth2.NewClient(ctx, ts)
-	client := github.NewClient(tc)
+	client, err := githubapi.NewClient(ctx, token)
+	if err != nil {
+		log.Fatalf("エラー: %v", err)
+	}
+	// 終了時に、今回の実行で消費した API リクエスト数と残量を表示する
+	defer func() { fmt.Println(githubapi.DefaultRateUsage.Summary()) }()
+
+	// SELF_TEST=true の場合は認証とアクセス権の確認だけを行って終了する
+	if os.Getenv("SELF_TEST") == "true" {
+		if !githubapi.SelfTest(ctx, client, ownerName, true) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := githubapi.RequireOrganization(ctx, client, ownerName); err != nil {
+		log.Fatalf("エラー: %v", err)
+	}
 
 	// CSVファイル作成
-	file, err := os.Create(outputFile)
+	writer, err := report.Create(outputFile, report.OptionsFromEnv())
 	if err != nil {
 		log.Fatalf("CSVファイルの作成に失敗しました: %v", err)
 	}
-	defer file.Close()
+	defer writer.Close()
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	// FETCH_TEAMS=true の場合は、ユーザーごとの所属チームを ";" 区切りの列として加える
+	fetchTeams := os.Getenv("FETCH_TEAMS") == "true"
 
 	// ヘッダーを書き込み
-	header := []string{"Login (ユーザー名)", "ID", "Name (氏名)", "Email", "Type"}
+	header := []string{"Login (ユーザー名)", "ID", "Name (氏名)", "Email", "Type", "Company (所属)", "Location (所在地)", "2FA", "Role (ロール)"}
+	if fetchTeams {
+		header = append(header, "Teams (所属チーム)")
+	}
 	writer.Write(header)
 
 	fmt.Printf("Organization '%s' のメンバーを取得中...\n", ownerName)
@@ -121,14 +347,52 @@ func main() {
 		opt.Page = resp.NextPage
 	}
 
-	// 各ユーザーの詳細情報を取得し、CSVに書き込む
-	for _, member := range allUsers {
-		user, _, err := client.Users.Get(ctx, member.GetLogin())
+	// 前回の出力以降に Organization から外れたユーザーを書き出す
+	removed, err := writeRemovedUsers(removedFile, oldLogins, oldUserMap, allUsers)
+	if err != nil {
+		log.Fatalf("削除されたユーザーの出力に失敗しました: %v", err)
+	}
+	fmt.Printf("-> 過去のCSVに存在し、現在の Organization にいないユーザー: %d 件 ('%s' に保存)\n", removed, removedFile)
+
+	// 所属チームは、チームのマトリクスを出力するツールと同じ userTeamMap (ログイン名 → チーム名 → ロール) から求める。
+	// 取得方法もマトリクスと同じく API=graphql の場合は GraphQL API、それ以外は REST API とする
+	var userTeamMap map[string]map[string]string
+	if fetchTeams {
+		userTeamMap, _, err = githubapi.FetchUserTeamMapFromEnv(ctx, client, ownerName)
 		if err != nil {
-			log.Printf("ユーザー %s の詳細情報の取得に失敗しました: %v", member.GetLogin(), err)
-			continue
+			log.Fatalf("チームの所属の取得に失敗しました: %v", err)
 		}
-		
+	}
+
+	// INFER_EMAIL=true の場合は、メールアドレスが空のユーザーについて公開コミットの作成者メールアドレスで補う
+	inferEmailEnabled := os.Getenv("INFER_EMAIL") == "true"
+
+	// 2要素認証を無効にしているメンバー (取得できない場合は 2FA 列を空欄にする)
+	twoFactorDisabled, resp, err := fetchTwoFactorDisabled(ctx, client, ownerName)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusForbidden {
+			log.Printf("警告: 2要素認証の状態を取得できませんでした。Organization のオーナー権限を持つトークンが必要です: %v", err)
+		} else {
+			log.Printf("警告: 2要素認証の状態の取得に失敗しました: %v", err)
+		}
+	} else {
+		fmt.Printf("-> 2要素認証が無効なメンバー: %d 人\n", len(twoFactorDisabled))
+	}
+
+	// WORKER_COUNT で、ユーザーの詳細情報を同時に取得する数を指定する
+	workerCount := defaultWorkerCount
+	if value := os.Getenv("WORKER_COUNT"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			log.Fatalf("エラー: WORKER_COUNT は1以上の整数を指定してください (指定値: %s)", value)
+		}
+		workerCount = n
+	}
+
+	// 各ユーザーの詳細情報を並行して取得し、Login の順に CSV に書き込む
+	fmt.Printf("-> %d 人のメンバーの詳細情報を取得中 (並列数: %d)\n", len(allUsers), workerCount)
+	for _, detail := range fetchUserDetails(ctx, client, ownerName, allUsers, workerCount) {
+		user := detail.User
 		login := user.GetLogin()
 		githubName := user.GetName() 
 		githubEmail := user.GetEmail() // GitHubから取得したメールアドレス
@@ -148,6 +412,15 @@ func main() {
 			}
 		} 
 		
+		// INFER_EMAIL=true の場合、GitHub、過去データ共にメールアドレスが空なら公開コミットから補う
+		if finalEmail == "" && inferEmailEnabled {
+			email, err := inferEmail(ctx, client, login)
+			if err != nil {
+				log.Printf("警告: ユーザー %s のコミットからのメールアドレスの推定に失敗しました: %v", login, err)
+			}
+			finalEmail = email
+		}
+
 		// GitHub、過去データ共に名前/メールが空の場合は空文字を維持
 		if finalName == "" {
 			finalName = "" 
@@ -156,16 +429,42 @@ func main() {
 			finalEmail = ""
 		}
 		
+		// 2要素認証の状態 (取得できなかった場合は空欄)
+		twoFactor := ""
+		if twoFactorDisabled != nil {
+			twoFactor = "有効"
+			if twoFactorDisabled[login] {
+				twoFactor = "無効"
+			}
+		}
+
 		row := []string{
 			login,
 			fmt.Sprintf("%d", user.GetID()),
 			finalName, 
 			finalEmail, // 埋め込まれたメールアドレスを使用
 			user.GetType(),
+			user.GetCompany(),  // 未設定の場合は空欄
+			user.GetLocation(), // 未設定の場合は空欄
+			twoFactor,
+			detail.Role,
+		}
+		if fetchTeams {
+			teams := []string{}
+			for team := range userTeamMap[login] {
+				teams = append(teams, team)
+			}
+			sort.Strings(teams)
+			row = append(row, strings.Join(teams, ";"))
 		}
 		writer.Write(row)
 		fmt.Printf("  取得: %s (氏名: %s, Email: %s)\n", login, finalName, finalEmail)
 	}
 
+	if err := writer.Close(); err != nil {
+		log.Fatalf("CSVファイルの書き込みに失敗しました: %v", err)
+	}
+
+	hb.Complete()
 	fmt.Printf("\n✅ ユーザー一覧を '%s' に保存しました。過去データに基づき氏名とメールアドレスが自動埋め込みされました。\n", outputFile)
 }
\ No newline at end of file
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v63/github"
+)
+
+func TestWriteRemovedUsersIncludesBlankRows(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	dir := t.TempDir()
+	older := filepath.Join(dir, "users_old.csv")
+	newer := filepath.Join(dir, "users_new.csv")
+	writeFile := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(older, "Login,Name,Email\nalice,Alice,alice@example.com\nbob,,\n")
+	// carol は氏名・メールアドレスがともに空で、dave は後のファイルにのみ存在する
+	writeFile(newer, "Login,Name,Email\nalice,,\ncarol,,\ndave,Dave,\n")
+
+	oldUserMap, oldLogins := loadOldUsers([]string{older, newer})
+	for _, login := range []string{"alice", "bob", "carol", "dave"} {
+		if !oldLogins[login] {
+			t.Errorf("過去のCSVの Login に %s が含まれていません", login)
+		}
+	}
+	if oldUserMap["alice"].Name != "Alice" {
+		t.Errorf("空欄の値で過去の氏名が上書きされています: %+v", oldUserMap["alice"])
+	}
+
+	current := []*github.User{{Login: github.String("alice")}, {Login: github.String("dave")}}
+	removedPath := filepath.Join(dir, "removed_users.csv")
+	removed, err := writeRemovedUsers(removedPath, oldLogins, oldUserMap, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("削除されたユーザー = %d 件, want 2", removed)
+	}
+
+	content, err := os.ReadFile(removedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(strings.NewReader(strings.TrimPrefix(string(content), "\ufeff"))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logins []string
+	for _, record := range records[1:] {
+		logins = append(logins, record[0])
+	}
+	if got, want := strings.Join(logins, ","), "bob,carol"; got != want {
+		t.Errorf("removed_users.csv の Login = %s, want %s", got, want)
+	}
+}
+
+func TestInferEmailWarnsOnIncompleteSearch(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	responses := map[string]string{
+		"found":      `{"total_count":2,"incomplete_results":false,"items":[{"commit":{"author":{"email":"1+found@users.noreply.github.com"}}},{"commit":{"author":{"email":"found@example.com"}}}]}`,
+		"incomplete": `{"total_count":5,"incomplete_results":true,"items":[{"commit":{"author":{"email":"2+incomplete@users.noreply.github.com"}}}]}`,
+		"capped":     `{"total_count":4321,"incomplete_results":false,"items":[{"commit":{"author":{"email":"3+capped@users.noreply.github.com"}}}]}`,
+		"none":       `{"total_count":0,"incomplete_results":false,"items":[]}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		login := strings.TrimPrefix(r.URL.Query().Get("q"), "author:")
+		fmt.Fprint(w, responses[login])
+	}))
+	defer server.Close()
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+
+	tests := []struct {
+		login    string
+		want     string
+		wantWarn string
+	}{
+		{"found", "found@example.com", ""},
+		{"incomplete", "", "incomplete_results"},
+		{"capped", "", "上限 (1000 件)"},
+		{"none", "", ""},
+	}
+	for _, tt := range tests {
+		logs.Reset()
+		got, err := inferEmail(context.Background(), client, tt.login)
+		if err != nil {
+			t.Fatalf("inferEmail(%s): %v", tt.login, err)
+		}
+		if got != tt.want {
+			t.Errorf("inferEmail(%s) = %q, want %q", tt.login, got, tt.want)
+		}
+		if tt.wantWarn == "" && logs.Len() > 0 {
+			t.Errorf("inferEmail(%s) で警告が出ています: %s", tt.login, logs.String())
+		}
+		if tt.wantWarn != "" && !strings.Contains(logs.String(), tt.wantWarn) {
+			t.Errorf("inferEmail(%s) の警告に %q が含まれていません: %s", tt.login, tt.wantWarn, logs.String())
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Package githubapi は、GitHub を扱う各ツールで共通の API クライアント設定をまとめたもの。
+// go-github のクライアントと、直接 HTTP を叩くツールの両方で同じ API バージョンを使うようにする。
+package githubapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/google/go-github/v63/github"
+	"golang.org/x/oauth2"
+)
+
+// DefaultAPIVersion は GITHUB_API_VERSION 未指定時に使う REST API のバージョン
+const DefaultAPIVersion = "2022-11-28"
+
+// APIVersionHeader は REST API のバージョンを指定するヘッダー名
+const APIVersionHeader = "X-GitHub-Api-Version"
+
+// APIVersion は GITHUB_API_VERSION の値 (未指定時は DefaultAPIVersion) を返す
+func APIVersion() string {
+	if version := os.Getenv("GITHUB_API_VERSION"); version != "" {
+		return version
+	}
+	return DefaultAPIVersion
+}
+
+// versionTransport は全リクエストに API バージョンのヘッダーを付与する
+type versionTransport struct {
+	base    http.RoundTripper
+	version string
+}
+
+func (t *versionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTripper は受け取ったリクエストを変更してはならないため複製してから設定する
+	r := req.Clone(req.Context())
+	r.Header.Set(APIVersionHeader, t.version)
+	return t.base.RoundTrip(r)
+}
+
+// NewClient は、トークン認証と API バージョンのヘッダーを設定した go-github のクライアントを返す。
+// GITHUB_API_BASE が指定されていれば、その URL (GitHub Enterprise Server など) の API を使う。
+// API の使用量は DefaultRateUsage に記録される
+func NewClient(ctx context.Context, token string) (*github.Client, error) {
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: token},
+	)
+	tc := oauth2.NewClient(ctx, ts)
+	tc.Transport = &rateTransport{
+		base:  &versionTransport{base: tc.Transport, version: APIVersion()},
+		usage: DefaultRateUsage,
+	}
+	client := github.NewClient(tc)
+
+	base := strings.TrimSuffix(os.Getenv("GITHUB_API_BASE"), "/")
+	if base == "" || base == "https://api.github.com" {
+		return client, nil
+	}
+	client, err := client.WithEnterpriseURLs(base, base)
+	if err != nil {
+		return nil, fmt.Errorf("GITHUB_API_BASE が不正です: %w", err)
+	}
+	return client, nil
+}
+
+// RequireOrganization は owner が Organization であることを確認する。
+// 個人アカウントにはメンバーやチームが存在しないため、Organization 専用の機能は利用できない
+func RequireOrganization(ctx context.Context, client *github.Client, owner string) error {
+	account, _, err := client.Users.Get(ctx, owner)
+	if err != nil {
+		return fmt.Errorf("GITHUB_OWNER '%s' の情報取得に失敗しました: %w", owner, err)
+	}
+	if account.GetType() != "Organization" {
+		return &NotOrganizationError{Owner: owner, Type: account.GetType()}
+	}
+	return nil
+}
+
+// NotOrganizationError は、GITHUB_OWNER が Organization ではなく個人アカウントの場合に RequireOrganization が返すエラー。
+// 個人アカウントでも動作するツールは errors.As で判別して処理を続ける
+type NotOrganizationError struct {
+	Owner string
+	Type  string
+}
+
+func (e *NotOrganizationError) Error() string {
+	return fmt.Sprintf("GITHUB_OWNER '%s' は個人アカウント (type: %s) です。メンバー・チームの取得は Organization でのみ利用できます", e.Owner, e.Type)
+}
+
+// SelfTest は、認証とアクセス権の最小限の確認 (/user と /orgs/{owner}) だけを行い、
+// チェックごとの結果を表示する。すべて成功した場合に true を返す。
+// requireOrg が false の場合は、owner が個人アカウントでも成功とみなす
+func SelfTest(ctx context.Context, client *github.Client, owner string, requireOrg bool) bool {
+	fmt.Println("--- セルフテスト (出力ファイルは作成しません) ---")
+	ok := true
+
+	user, resp, err := client.Users.Get(ctx, "")
+	if err != nil {
+		fmt.Printf("❌ 認証 (/user): %v\n", err)
+		ok = false
+	} else {
+		fmt.Printf("✅ 認証 (/user): %s としてログインしました\n", user.GetLogin())
+		// クラシックトークンの場合のみスコープがヘッダーで返る (Fine-grained トークンでは空)
+		if scopes := resp.Header.Get("X-OAuth-Scopes"); scopes != "" {
+			fmt.Printf("   トークンのスコープ: %s\n", scopes)
+			if requireOrg && !strings.Contains(scopes, "read:org") && !strings.Contains(scopes, "admin:org") {
+				fmt.Println("   ⚠️ read:org スコープがないため、メンバー・チームを取得できない可能性があります")
+			}
+		}
+	}
+
+	if owner == "" {
+		fmt.Println("❌ GITHUB_OWNER が設定されていません")
+		return false
+	}
+
+	org, _, err := client.Organizations.Get(ctx, owner)
+	switch {
+	case err == nil:
+		fmt.Printf("✅ Organization (/orgs/%s): %s にアクセスできます\n", owner, org.GetLogin())
+	case !requireOrg:
+		if _, _, userErr := client.Users.Get(ctx, owner); userErr == nil {
+			fmt.Printf("✅ 個人アカウント (/users/%s): アクセスできます\n", owner)
+		} else {
+			fmt.Printf("❌ Organization/個人アカウント (%s): %v\n", owner, err)
+			ok = false
+		}
+	default:
+		fmt.Printf("❌ Organization (/orgs/%s): %v\n", owner, err)
+		ok = false
+	}
+
+	if ok {
+		fmt.Println("✅ セルフテストに成功しました")
+	} else {
+		fmt.Println("❌ セルフテストに失敗しました")
+	}
+	return ok
+}
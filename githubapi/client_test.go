@@ -0,0 +1,69 @@
+package githubapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewClientAPIBase(t *testing.T) {
+	tests := []struct {
+		apiBase     string
+		wantBaseURL string
+		wantGraphQL string
+	}{
+		{"", "https://api.github.com/", "https://api.github.com/graphql"},
+		{"https://api.github.com/", "https://api.github.com/", "https://api.github.com/graphql"},
+		{"https://github.example.com", "https://github.example.com/api/v3/", "https://github.example.com/api/graphql"},
+		{"https://github.example.com/api/v3/", "https://github.example.com/api/v3/", "https://github.example.com/api/graphql"},
+	}
+	for _, tt := range tests {
+		t.Setenv("GITHUB_API_BASE", tt.apiBase)
+		client, err := NewClient(context.Background(), "token")
+		if err != nil {
+			t.Fatalf("NewClient (GITHUB_API_BASE=%q): %v", tt.apiBase, err)
+		}
+		if got := client.BaseURL.String(); got != tt.wantBaseURL {
+			t.Errorf("GITHUB_API_BASE=%q: BaseURL = %q, want %q", tt.apiBase, got, tt.wantBaseURL)
+		}
+		if got := graphQLURL(client); got != tt.wantGraphQL {
+			t.Errorf("GITHUB_API_BASE=%q: graphQLURL = %q, want %q", tt.apiBase, got, tt.wantGraphQL)
+		}
+	}
+}
+
+func TestRequireOrganization(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v3/users/acme":
+			w.Write([]byte(`{"login":"acme","type":"Organization"}`))
+		case "/api/v3/users/alice":
+			w.Write([]byte(`{"login":"alice","type":"User"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	t.Setenv("GITHUB_API_BASE", server.URL)
+	client, err := NewClient(context.Background(), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RequireOrganization(context.Background(), client, "acme"); err != nil {
+		t.Errorf("acme: %v", err)
+	}
+
+	// 個人アカウントは NotOrganizationError として判別できる
+	var notOrg *NotOrganizationError
+	if err := RequireOrganization(context.Background(), client, "alice"); !errors.As(err, &notOrg) || notOrg.Type != "User" {
+		t.Errorf("alice: err = %v, want NotOrganizationError", err)
+	}
+
+	// 存在しないアカウントは NotOrganizationError ではないエラーになる
+	if err := RequireOrganization(context.Background(), client, "missing"); err == nil || errors.As(err, &notOrg) {
+		t.Errorf("missing: err = %v, want an API error", err)
+	}
+}
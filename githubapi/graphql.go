@@ -0,0 +1,234 @@
+package githubapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-github/v63/github"
+)
+
+// graphQLURL は GraphQL API の URL を返す。
+// GitHub Enterprise Server では REST API が /api/v3/、GraphQL API が /api/graphql のため、REST の URL から求める
+func graphQLURL(client *github.Client) string {
+	base := client.BaseURL.String()
+	if strings.HasSuffix(base, "/api/v3/") {
+		return strings.TrimSuffix(base, "v3/") + "graphql"
+	}
+	return base + "graphql"
+}
+
+// graphQL は GitHub GraphQL API にクエリを送り、data 部分を out にデコードする
+func graphQL(ctx context.Context, client *github.Client, query string, variables map[string]any, out any) error {
+	body, err := json.Marshal(map[string]any{"query": query, "variables": variables})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, graphQLURL(client), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Client().Do(req)
+	if err != nil {
+		return fmt.Errorf("GraphQL リクエストに失敗しました: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GraphQL API がステータスコード %d を返しました", resp.StatusCode)
+	}
+
+	var result struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("GraphQL レスポンスのデコードに失敗しました: %w", err)
+	}
+	if len(result.Errors) > 0 {
+		messages := make([]string, 0, len(result.Errors))
+		for _, e := range result.Errors {
+			messages = append(messages, e.Message)
+		}
+		return fmt.Errorf("GraphQL エラー: %s", strings.Join(messages, "; "))
+	}
+	return json.Unmarshal(result.Data, out)
+}
+
+type pageInfo struct {
+	HasNextPage bool   `json:"hasNextPage"`
+	EndCursor   string `json:"endCursor"`
+}
+
+type teamMemberConnection struct {
+	PageInfo pageInfo `json:"pageInfo"`
+	Edges    []struct {
+		Role string `json:"role"` // MAINTAINER または MEMBER
+		Node struct {
+			Login string `json:"login"`
+		} `json:"node"`
+	} `json:"edges"`
+}
+
+const orgMembersQuery = `query($org: String!, $cursor: String) {
+  organization(login: $org) {
+    membersWithRole(first: 100, after: $cursor) {
+      pageInfo { hasNextPage endCursor }
+      nodes { login }
+    }
+  }
+}`
+
+const orgTeamsQuery = `query($org: String!, $cursor: String) {
+  organization(login: $org) {
+    teams(first: 50, after: $cursor) {
+      pageInfo { hasNextPage endCursor }
+      nodes {
+        name
+        slug
+        description
+        privacy
+        parentTeam { name }
+        members(first: 100) {
+          pageInfo { hasNextPage endCursor }
+          edges { role node { login } }
+        }
+      }
+    }
+  }
+}`
+
+const teamMembersQuery = `query($org: String!, $slug: String!, $cursor: String) {
+  organization(login: $org) {
+    team(slug: $slug) {
+      members(first: 100, after: $cursor) {
+        pageInfo { hasNextPage endCursor }
+        edges { role node { login } }
+      }
+    }
+  }
+}`
+
+// FetchUserTeamMap は、GraphQL API で Organization の全メンバーと全チーム、チームの所属を取得し、
+// REST API で組み立てる場合と同じ userTeamMap (ログイン名 → チーム名 → ロール) とチーム一覧を返す。
+// REST ではチームごとにメンバー一覧を取得する必要があるが、GraphQL ではチームとメンバーを
+// まとめて取得できるため、大きな Organization でもリクエスト数を大幅に減らせる。
+// ロールは maintainer または member
+func FetchUserTeamMap(ctx context.Context, client *github.Client, org string) (map[string]map[string]string, []*github.Team, error) {
+	userTeamMap := make(map[string]map[string]string)
+
+	// 全メンバー
+	var cursor *string
+	for {
+		var data struct {
+			Organization struct {
+				MembersWithRole struct {
+					PageInfo pageInfo `json:"pageInfo"`
+					Nodes    []struct {
+						Login string `json:"login"`
+					} `json:"nodes"`
+				} `json:"membersWithRole"`
+			} `json:"organization"`
+		}
+		if err := graphQL(ctx, client, orgMembersQuery, map[string]any{"org": org, "cursor": cursor}, &data); err != nil {
+			return nil, nil, fmt.Errorf("メンバー一覧の取得に失敗しました: %w", err)
+		}
+		for _, node := range data.Organization.MembersWithRole.Nodes {
+			userTeamMap[node.Login] = make(map[string]string)
+		}
+		if !data.Organization.MembersWithRole.PageInfo.HasNextPage {
+			break
+		}
+		cursor = github.String(data.Organization.MembersWithRole.PageInfo.EndCursor)
+	}
+
+	// 全チームと、各チームの先頭 100 人のメンバー
+	var teams []*github.Team
+	cursor = nil
+	for {
+		var data struct {
+			Organization struct {
+				Teams struct {
+					PageInfo pageInfo `json:"pageInfo"`
+					Nodes    []struct {
+						Name        string `json:"name"`
+						Slug        string `json:"slug"`
+						Description string `json:"description"`
+						Privacy     string `json:"privacy"` // SECRET または VISIBLE
+						ParentTeam  *struct {
+							Name string `json:"name"`
+						} `json:"parentTeam"`
+						Members teamMemberConnection `json:"members"`
+					} `json:"nodes"`
+				} `json:"teams"`
+			} `json:"organization"`
+		}
+		if err := graphQL(ctx, client, orgTeamsQuery, map[string]any{"org": org, "cursor": cursor}, &data); err != nil {
+			return nil, nil, fmt.Errorf("チーム一覧の取得に失敗しました: %w", err)
+		}
+
+		for _, node := range data.Organization.Teams.Nodes {
+			team := &github.Team{
+				Name:        github.String(node.Name),
+				Slug:        github.String(node.Slug),
+				Description: github.String(node.Description),
+				Privacy:     github.String(restPrivacy(node.Privacy)),
+			}
+			if node.ParentTeam != nil {
+				team.Parent = &github.Team{Name: github.String(node.ParentTeam.Name)}
+			}
+			teams = append(teams, team)
+
+			members := node.Members
+			for {
+				for _, edge := range members.Edges {
+					if _, ok := userTeamMap[edge.Node.Login]; ok {
+						userTeamMap[edge.Node.Login][node.Name] = strings.ToLower(edge.Role)
+					}
+				}
+				if !members.PageInfo.HasNextPage {
+					break
+				}
+				// 100 人を超えるチームは、残りのメンバーをチーム単位で取得する
+				var more struct {
+					Organization struct {
+						Team struct {
+							Members teamMemberConnection `json:"members"`
+						} `json:"team"`
+					} `json:"organization"`
+				}
+				variables := map[string]any{"org": org, "slug": node.Slug, "cursor": members.PageInfo.EndCursor}
+				if err := graphQL(ctx, client, teamMembersQuery, variables, &more); err != nil {
+					return nil, nil, fmt.Errorf("チーム %s のメンバー取得に失敗しました: %w", node.Name, err)
+				}
+				members = more.Organization.Team.Members
+			}
+		}
+
+		if !data.Organization.Teams.PageInfo.HasNextPage {
+			break
+		}
+		cursor = github.String(data.Organization.Teams.PageInfo.EndCursor)
+	}
+
+	return userTeamMap, teams, nil
+}
+
+// restPrivacy は GraphQL のチームの公開範囲を REST API と同じ表記に変換する
+func restPrivacy(privacy string) string {
+	switch privacy {
+	case "SECRET":
+		return "secret"
+	case "VISIBLE":
+		return "closed"
+	}
+	return strings.ToLower(privacy)
+}
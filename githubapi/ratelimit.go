@@ -0,0 +1,82 @@
+package githubapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateUsage は、レスポンスの X-RateLimit-* ヘッダーから、実行中に消費した core API の
+// リクエスト数と残量を記録する。複数のゴルーチンから同時に呼び出してよい
+type RateUsage struct {
+	mu             sync.Mutex
+	requests       int
+	startRemaining int
+	remaining      int
+	limit          int
+	reset          time.Time
+}
+
+// DefaultRateUsage は NewClient で作成したクライアントのレスポンスを記録する
+var DefaultRateUsage = &RateUsage{}
+
+// Observe はレスポンスヘッダーからレート制限の情報を記録する。
+// search や graphql など core 以外のリソースの応答は対象外
+func (u *RateUsage) Observe(header http.Header) {
+	if resource := header.Get("X-RateLimit-Resource"); resource != "" && resource != "core" {
+		return
+	}
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	limit, _ := strconv.Atoi(header.Get("X-RateLimit-Limit"))
+	resetUnix, _ := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.requests == 0 {
+		// 最初の応答の残量は、そのリクエスト自身を消費した後の値
+		u.startRemaining = remaining + 1
+	}
+	u.requests++
+	u.remaining = remaining
+	u.limit = limit
+	u.reset = time.Unix(resetUnix, 0)
+}
+
+// Remaining は、直近の応答時点での core API の残りリクエスト数を返す。
+// まだ応答を記録していない場合は ok が false になる
+func (u *RateUsage) Remaining() (remaining int, ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.remaining, u.requests > 0
+}
+
+// Summary は、消費したリクエスト数と残量、リセット時刻を1行の文字列で返す
+func (u *RateUsage) Summary() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.requests == 0 {
+		return "レート制限の情報はありません (API を呼び出していません)"
+	}
+	return fmt.Sprintf("API 使用量 (core): 今回 %d リクエスト (開始時の残り %d → 終了時の残り %d / 上限 %d)、%s にリセット (あと %s)",
+		u.requests, u.startRemaining, u.remaining, u.limit,
+		u.reset.Format("15:04:05"), time.Until(u.reset).Round(time.Second))
+}
+
+// rateTransport は全レスポンスのレート制限ヘッダーを usage に記録する
+type rateTransport struct {
+	base  http.RoundTripper
+	usage *RateUsage
+}
+
+func (t *rateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		t.usage.Observe(resp.Header)
+	}
+	return resp, err
+}
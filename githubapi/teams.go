@@ -0,0 +1,101 @@
+package githubapi
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/google/go-github/v63/github"
+)
+
+// FetchUserTeamMapFromEnv は、API=graphql の場合は GraphQL API (FetchUserTeamMap)、
+// それ以外は REST API (FetchUserTeamMapREST) で userTeamMap (ログイン名 → チーム名 → ロール) とチーム一覧を取得する。
+// チームの所属を扱う各ツールで API の切り替えを揃えるために使う
+func FetchUserTeamMapFromEnv(ctx context.Context, client *github.Client, org string) (map[string]map[string]string, []*github.Team, error) {
+	if os.Getenv("API") == "graphql" {
+		fmt.Println("-> GraphQL API でメンバー・チーム・所属を取得します")
+		return FetchUserTeamMap(ctx, client, org)
+	}
+	return FetchUserTeamMapREST(ctx, client, org)
+}
+
+// FetchUserTeamMapREST は REST API で全メンバーと全チームを取得し、チームごとのメンバー一覧を
+// 並行して取得して userTeamMap (ログイン名 → チーム名 → ロール) を組み立てる。
+// ロールは FetchUserTeamMap と同じく maintainer または member。
+// チームのメンバー取得に失敗した場合は警告を出し、そのロールの所属を除いて続ける
+func FetchUserTeamMapREST(ctx context.Context, client *github.Client, org string) (map[string]map[string]string, []*github.Team, error) {
+	// 全メンバー
+	optMembers := &github.ListMembersOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	userTeamMap := make(map[string]map[string]string)
+	for {
+		members, resp, err := client.Organizations.ListMembers(ctx, org, optMembers)
+		if err != nil {
+			return nil, nil, fmt.Errorf("メンバー一覧の取得に失敗しました: %w", err)
+		}
+		for _, member := range members {
+			userTeamMap[member.GetLogin()] = make(map[string]string)
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		optMembers.Page = resp.NextPage
+	}
+
+	// 全チーム
+	optTeam := &github.ListOptions{PerPage: 100}
+	var teams []*github.Team
+	for {
+		page, resp, err := client.Teams.ListTeams(ctx, org, optTeam)
+		if err != nil {
+			return nil, nil, fmt.Errorf("チーム一覧の取得に失敗しました: %w", err)
+		}
+		teams = append(teams, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+		optTeam.Page = resp.NextPage
+	}
+
+	// ロールごとに分けて取得し、出力形式や取得方法によらず maintainer/member を記録する
+	memberRoles := []string{"maintainer", "member"}
+
+	fmt.Printf("-> チーム所属メンバーの並行処理を開始 (チーム数: %d)\n", len(teams))
+	var wg sync.WaitGroup
+	var mu sync.Mutex // userTeamMap への書き込み用
+	for _, team := range teams {
+		wg.Add(1)
+		go func(team *github.Team) {
+			defer wg.Done()
+			for _, role := range memberRoles {
+				opt := &github.TeamListTeamMembersOptions{Role: role, ListOptions: github.ListOptions{PerPage: 100}}
+				for {
+					members, resp, err := client.Teams.ListTeamMembersBySlug(ctx, org, team.GetSlug(), opt)
+					if err != nil {
+						log.Printf("警告: チーム %s の %s のメンバー取得に失敗: %v", team.GetName(), role, err)
+						break // 失敗したロールのみ打ち切り、残りのロールは取得する
+					}
+
+					mu.Lock()
+					for _, member := range members {
+						// Organization のメンバーとして取得したユーザーのみ記録する
+						if teamRoles, ok := userTeamMap[member.GetLogin()]; ok {
+							teamRoles[team.GetName()] = role
+						}
+					}
+					mu.Unlock()
+
+					if resp.NextPage == 0 {
+						break
+					}
+					opt.Page = resp.NextPage
+				}
+			}
+		}(team)
+	}
+	wg.Wait()
+	fmt.Println("-> チーム所属メンバーの確認を完了しました。")
+
+	return userTeamMap, teams, nil
+}
@@ -0,0 +1,74 @@
+package githubapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/google/go-github/v63/github"
+)
+
+func TestFetchUserTeamMapRESTRoles(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/orgs/acme/members", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"login":"alice"},{"login":"bob"},{"login":"carol"}]`)
+	})
+	mux.HandleFunc("/orgs/acme/teams", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"name":"Platform","slug":"platform"},{"name":"Security","slug":"security"}]`)
+	})
+	mux.HandleFunc("/orgs/acme/teams/platform/members", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("role") {
+		case "maintainer":
+			fmt.Fprint(w, `[{"login":"alice"}]`)
+		case "member":
+			fmt.Fprint(w, `[{"login":"bob"}]`)
+		default:
+			http.Error(w, `{"message":"unexpected role"}`, http.StatusBadRequest)
+		}
+	})
+	mux.HandleFunc("/orgs/acme/teams/security/members", func(w http.ResponseWriter, r *http.Request) {
+		// maintainer の取得に失敗しても、member は取得する
+		if r.URL.Query().Get("role") == "maintainer" {
+			http.Error(w, `{"message":"server error"}`, http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `[{"login":"carol"}]`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+
+	userTeamMap, teams, err := FetchUserTeamMapREST(context.Background(), client, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(teams) != 2 {
+		t.Fatalf("チーム数 = %d, want 2", len(teams))
+	}
+	want := map[string]map[string]string{
+		"alice": {"Platform": "maintainer"},
+		"bob":   {"Platform": "member"},
+		"carol": {"Security": "member"},
+	}
+	for login, teamRoles := range want {
+		for team, role := range teamRoles {
+			if got := userTeamMap[login][team]; got != role {
+				t.Errorf("%s の %s でのロール = %q, want %q", login, team, got, role)
+			}
+		}
+		if len(userTeamMap[login]) != len(teamRoles) {
+			t.Errorf("%s の所属 = %v, want %v", login, userTeamMap[login], teamRoles)
+		}
+	}
+}
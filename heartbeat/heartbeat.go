@@ -0,0 +1,99 @@
+// Package heartbeat は、外部の監視から実行の停止を検知できるよう、
+// HEARTBEAT_FILE に実行状況を定期的に書き込む (デッドマンスイッチ)。
+// 監視側はファイルの更新時刻が古くなった場合や、completed にならない場合に通知する。
+package heartbeat
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"securityhub-exporter/report"
+)
+
+// Interval は実行中にハートビートを更新する間隔
+const Interval = 30 * time.Second
+
+// Heartbeat はハートビートファイルの更新を行う。
+// HEARTBEAT_FILE 未設定時は nil になり、各メソッドは何もしない
+type Heartbeat struct {
+	path    string
+	tool    string
+	started time.Time
+	done    chan struct{}
+	// stopped は、定期的な更新を行うゴルーチンが終了すると閉じられる
+	stopped chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+}
+
+// Start は HEARTBEAT_FILE が設定されていれば開始を書き込み、
+// 終了するまで Interval ごとにファイルを更新する
+func Start(tool string) *Heartbeat {
+	path := os.Getenv("HEARTBEAT_FILE")
+	if path == "" {
+		return nil
+	}
+	return start(path, tool, Interval)
+}
+
+// start は path へのハートビートを開始し、interval ごとに更新する
+func start(path, tool string, interval time.Duration) *Heartbeat {
+	h := &Heartbeat{path: path, tool: tool, started: time.Now(), done: make(chan struct{}), stopped: make(chan struct{})}
+	h.write("running")
+	log.Printf("ハートビートを %s に書き込みます (%s ごとに更新)", path, interval)
+
+	go func() {
+		defer close(h.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				h.write("running")
+			case <-h.done:
+				return
+			}
+		}
+	}()
+	return h
+}
+
+// Complete は正常終了したことを書き込み、定期的な更新を止める
+func (h *Heartbeat) Complete() {
+	if h == nil {
+		return
+	}
+	h.Stop()
+	h.write("completed")
+}
+
+// Stop は定期的な更新を止める。completed は書き込まないため、監視側からは未完了のまま見える。
+// 更新中の書き込みが Complete の後に running で上書きしないよう、ゴルーチンの終了を待ってから戻る
+func (h *Heartbeat) Stop() {
+	if h == nil {
+		return
+	}
+	h.once.Do(func() { close(h.done) })
+	<-h.stopped
+}
+
+// write は状態と時刻をファイルに書き込む。読み手が書きかけの内容を見ないよう一時ファイル経由で置き換える
+func (h *Heartbeat) write(status string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	file, err := report.CreateAtomic(h.path)
+	if err != nil {
+		log.Printf("警告: ハートビートの書き込みに失敗しました: %v", err)
+		return
+	}
+	fmt.Fprintf(file, "status=%s\ntool=%s\nstarted=%s\nupdated=%s\n",
+		status, h.tool, h.started.Format(time.RFC3339), time.Now().Format(time.RFC3339))
+	if err := file.Commit(); err != nil {
+		log.Printf("警告: ハートビートの書き込みに失敗しました: %v", err)
+	}
+}
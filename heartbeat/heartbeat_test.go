@@ -0,0 +1,41 @@
+package heartbeat
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompleteWhileTicking(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "heartbeat")
+
+	// 更新間隔を極端に短くし、更新の書き込み中に Complete が呼ばれる状況を繰り返し作る
+	for i := 0; i < 50; i++ {
+		h := start(path, "test", time.Microsecond)
+		time.Sleep(time.Duration(i%5) * 100 * time.Microsecond)
+		h.Complete()
+
+		// Complete の後に running で上書きされないこと
+		time.Sleep(time.Millisecond)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(content), "status=completed\n") {
+			t.Fatalf("%d 回目: Complete 後のハートビート =\n%s", i, content)
+		}
+	}
+}
+
+func TestStopIsIdempotent(t *testing.T) {
+	h := start(filepath.Join(t.TempDir(), "heartbeat"), "test", time.Millisecond)
+	h.Stop()
+	h.Stop()
+	h.Complete()
+
+	var nilHeartbeat *Heartbeat
+	nilHeartbeat.Stop()
+	nilHeartbeat.Complete()
+}
@@ -0,0 +1,46 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Manifest は、出力ファイルに添えて書き出すサイドカー (<出力ファイル>.manifest.json) の内容。
+// 取得が途中で止まった場合も出力ファイル自体は作成されるため、後から読む人やジョブが
+// 全件を取得できたかどうかを出力から判断できるよう truncated を残す
+type Manifest struct {
+	Tool        string    `json:"tool"`
+	GeneratedAt time.Time `json:"generatedAt"`
+	Files       []string  `json:"files"`
+	Truncated   bool      `json:"truncated"`
+	// 取得が不完全になった理由 (リポジトリ名やエラー内容など。Truncated が false の場合は空)
+	TruncatedReasons []string `json:"truncatedReasons,omitempty"`
+}
+
+// ManifestPath は、出力ファイル path に対応するマニフェストのパスを返す
+func ManifestPath(path string) string {
+	return path + ".manifest.json"
+}
+
+// WriteManifest は、出力ファイル path のマニフェストを書き出す。
+// 理由が1つでもあれば Truncated を true とする。出力ファイルと同じく一時ファイル経由で置き換える
+func WriteManifest(path string, m Manifest) error {
+	if m.GeneratedAt.IsZero() {
+		m.GeneratedAt = time.Now()
+	}
+	m.Truncated = m.Truncated || len(m.TruncatedReasons) > 0
+
+	manifestPath := ManifestPath(path)
+	file, err := CreateAtomic(manifestPath)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(m); err != nil {
+		file.Abort()
+		return fmt.Errorf("マニフェストの書き込みエラー (%s): %w", manifestPath, err)
+	}
+	return file.Commit()
+}
@@ -0,0 +1,40 @@
+package report
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteManifest(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "commits.csv")
+
+	if err := WriteManifest(path, Manifest{Tool: "commit_list", Files: []string{path}, TruncatedReasons: []string{"repo-a: APIエラー"}}); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(ManifestPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Manifest
+	if err := json.Unmarshal(content, &got); err != nil {
+		t.Fatalf("マニフェストが JSON として読めません: %v\n%s", err, content)
+	}
+	if !got.Truncated || len(got.TruncatedReasons) != 1 || got.Tool != "commit_list" || got.GeneratedAt.IsZero() {
+		t.Errorf("マニフェスト = %+v", got)
+	}
+
+	// 次の実行で全件を取得できた場合は truncated が false に置き換わる
+	if err := WriteManifest(path, Manifest{Tool: "commit_list", Files: []string{path}}); err != nil {
+		t.Fatal(err)
+	}
+	content, _ = os.ReadFile(ManifestPath(path))
+	got = Manifest{}
+	json.Unmarshal(content, &got)
+	if got.Truncated || got.TruncatedReasons != nil {
+		t.Errorf("マニフェスト = %+v, want truncated: false", got)
+	}
+	assertNoTempFiles(t, dir)
+}
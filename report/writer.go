@@ -0,0 +1,350 @@
+// Package report は、各ツールが共通で使う CSV 出力処理をまとめたもの。
+// ファイル作成、BOM、区切り文字、数式インジェクション対策 (CSV_SANITIZE=true の場合)、クローズ時のフラッシュと検証を
+// ひとつの Writer に集約し、ツールごとに挙動がずれないようにする。
+package report
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+)
+
+// 対応している出力エンコーディング
+const (
+	EncodingUTF8 = "utf8"
+	EncodingSJIS = "sjis"
+)
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// Options は CSV の出力形式を表す
+type Options struct {
+	BOM      bool   // 先頭に UTF-8 BOM を付ける (Excel で文字化けさせないため)
+	Comma    rune   // 区切り文字
+	Sanitize bool   // =, @ や、数字以外が続く +, - などで始まるセルを数式として解釈させない (sanitizeField を参照)
+	Validate bool   // Close 時に確定前のファイルを再読み込みして検証する (不正な場合は確定させない)
+	Encoding string // 出力エンコーディング (utf8 または sjis。空の場合は utf8)
+
+	commaErr error // CSV_DELIMITER が不正な場合のエラー (Check と Create で返す)
+}
+
+// OptionsFromEnv は、全ツール共通の既定値に環境変数の設定を反映した Options を返す。
+// VALIDATE_OUTPUT=true で出力後の検証を有効化し、ENCODING=sjis で Shift_JIS で出力する。
+// CSV_DELIMITER=; のように1文字を指定すると区切り文字を変更する (Excel の地域設定に合わせるため)。
+// CSV_SANITIZE=true で数式インジェクション対策を有効化する。セルの先頭に ' を付けて値を書き換えるため、
+// 監査証跡としてそのまま使う出力を変えないよう既定では無効にしている
+func OptionsFromEnv() Options {
+	comma, err := parseDelimiter(os.Getenv("CSV_DELIMITER"))
+	return Options{
+		BOM:      true,
+		Comma:    comma,
+		Sanitize: os.Getenv("CSV_SANITIZE") == "true",
+		Validate: os.Getenv("VALIDATE_OUTPUT") == "true",
+		Encoding: os.Getenv("ENCODING"),
+		commaErr: err,
+	}
+}
+
+// parseDelimiter は CSV_DELIMITER の値を区切り文字として解釈する (空の場合はカンマ)
+func parseDelimiter(value string) (rune, error) {
+	if value == "" {
+		return ',', nil
+	}
+	if utf8.RuneCountInString(value) != 1 {
+		return ',', fmt.Errorf("CSV_DELIMITER は1文字で指定してください (指定値: %q)", value)
+	}
+	comma, _ := utf8.DecodeRuneInString(value)
+	// encoding/csv が区切り文字として扱えない文字
+	if comma == '"' || comma == '\r' || comma == '\n' || comma == utf8.RuneError {
+		return ',', fmt.Errorf("CSV_DELIMITER に %q は指定できません", value)
+	}
+	return comma, nil
+}
+
+// Check は Options の設定値を検証する。長時間の取得処理の前に設定ミスを検出するために使う
+func (o Options) Check() error {
+	if o.commaErr != nil {
+		return o.commaErr
+	}
+	_, err := validateEncoding(o.Encoding)
+	return err
+}
+
+// validateEncoding はエンコーディング名を検証し、正規化した名前を返す
+func validateEncoding(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "", "utf8", "utf-8":
+		return EncodingUTF8, nil
+	case "sjis", "shift_jis", "shift-jis":
+		return EncodingSJIS, nil
+	}
+	return "", fmt.Errorf("ENCODING は utf8 または sjis を指定してください (指定値: %s)", name)
+}
+
+// shiftJISEncoder は Shift_JIS に変換するエンコーダーを返す。
+// 絵文字など Shift_JIS で表現できない文字は、書き込みエラーにせず代替文字に置き換える
+func shiftJISEncoder() *encoding.Encoder {
+	return encoding.ReplaceUnsupported(japanese.ShiftJIS.NewEncoder())
+}
+
+// Writer は CSV ファイルへの書き込みを行う。Close でフラッシュ・クローズ・検証までを行う。
+// 書き込みは同じディレクトリの一時ファイルに対して行い、正常に閉じられた時点で本来のパスへ
+// 置き換えるため、途中でエラーや異常終了が起きても中途半端なファイルが残らない
+type Writer struct {
+	path   string
+	opts   Options
+	file   *AtomicFile
+	enc    io.WriteCloser // Shift_JIS 出力時の変換用 (UTF-8 の場合は nil)
+	csv    *csv.Writer
+	fields int
+	err    error
+	closed bool
+}
+
+// Create は path に CSV ファイルを作成し、Writer を返す
+func Create(path string, opts Options) (*Writer, error) {
+	if opts.commaErr != nil {
+		return nil, opts.commaErr
+	}
+	if opts.Comma == 0 {
+		opts.Comma = ','
+	}
+	encodingName, err := validateEncoding(opts.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	opts.Encoding = encodingName
+	// BOM は UTF-8 の場合のみ意味を持つ
+	if opts.Encoding == EncodingSJIS {
+		opts.BOM = false
+	}
+
+	file, err := CreateAtomic(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.BOM {
+		if _, err := file.Write(utf8BOM); err != nil {
+			file.Abort()
+			return nil, fmt.Errorf("BOM書き込みエラー (%s): %w", path, err)
+		}
+	}
+
+	w := &Writer{path: path, opts: opts, file: file}
+	var out io.Writer = file
+	if opts.Encoding == EncodingSJIS {
+		w.enc = transform.NewWriter(file, shiftJISEncoder())
+		out = w.enc
+	}
+
+	w.csv = csv.NewWriter(out)
+	w.csv.Comma = opts.Comma
+	return w, nil
+}
+
+// Path は出力先のファイルパスを返す
+func (w *Writer) Path() string {
+	return w.path
+}
+
+// Write は1行を書き込む。最初に書き込んだ行 (ヘッダー) の列数を検証時の期待値として使う
+func (w *Writer) Write(record []string) error {
+	if w.fields == 0 {
+		w.fields = len(record)
+	}
+	if w.opts.Sanitize {
+		sanitized := make([]string, len(record))
+		for i, field := range record {
+			sanitized[i] = sanitizeField(field)
+		}
+		record = sanitized
+	}
+	if err := w.csv.Write(record); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
+
+// Close はバッファをフラッシュし、Validate が有効なら内容を検証してからファイルを確定させる。
+// それまでに書き込みエラーがあった場合や検証に失敗した場合は、ファイルを確定させずに破棄する
+// (前回の出力はそのまま残る)。
+// 2回目以降の呼び出しは何もしないため、defer と明示的な呼び出しを併用できる
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	w.csv.Flush()
+	if err := w.csv.Error(); err != nil && w.err == nil {
+		w.err = err
+	}
+	// 変換中のバイト列を書き出す
+	if w.enc != nil {
+		if err := w.enc.Close(); err != nil && w.err == nil {
+			w.err = err
+		}
+	}
+	if w.err != nil {
+		w.file.Abort()
+		return fmt.Errorf("CSV書き込みエラーのため出力を破棄しました (%s): %w", w.path, w.err)
+	}
+	if w.opts.Validate {
+		if err := w.validateTemp(); err != nil {
+			w.file.Abort()
+			return err
+		}
+	}
+	return w.file.Commit()
+}
+
+// validateTemp は、確定前の一時ファイルを検証する (エラーには本来のパスを表示する)
+func (w *Writer) validateTemp() error {
+	file, err := os.Open(w.file.Name())
+	if err != nil {
+		return fmt.Errorf("検証用にCSVファイルを開けませんでした: %w", err)
+	}
+	defer file.Close()
+	return validateCSV(file, w.path, w.fields, w.opts)
+}
+
+// Abort は書き込んだ内容を確定させずに破棄する。Close 済みの場合は何もしない
+func (w *Writer) Abort() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.file.Abort()
+}
+
+// sanitizeField は、表計算ソフトで数式として評価されうるセルの先頭に ' を付ける。
+// =, @, タブ, CR で始まるセルは常に対象とし、+, - は数字以外が続く場合のみ対象とする
+// (負の数や "+09:00" のようなタイムゾーンのオフセット、"-" だけのセルは書き換えない)
+func sanitizeField(field string) string {
+	if field == "" {
+		return field
+	}
+	switch field[0] {
+	case '=', '@', '\t', '\r':
+		return "'" + field
+	case '+', '-':
+		if len(field) > 1 && (field[1] < '0' || field[1] > '9') {
+			return "'" + field
+		}
+	}
+	return field
+}
+
+// Validate は、出力済みの CSV を再読み込みし、全行の列数が expectedFields と一致し、
+// NUL 文字が混入していないことを確認する。最初に見つかった不正な行をエラーとして返す
+func Validate(path string, expectedFields int, opts Options) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("検証用にCSVファイルを開けませんでした: %w", err)
+	}
+	defer file.Close()
+	return validateCSV(file, path, expectedFields, opts)
+}
+
+// validateCSV は、r から読み込んだ CSV を Validate と同じ条件で検証する。path はメッセージの表示にのみ使う
+func validateCSV(r io.Reader, path string, expectedFields int, opts Options) error {
+	// Shift_JIS の場合は UTF-8 に戻してから検証し、UTF-8 の場合は先頭の BOM を読み飛ばす
+	var br *bufio.Reader
+	if encodingName, _ := validateEncoding(opts.Encoding); encodingName == EncodingSJIS {
+		br = bufio.NewReader(transform.NewReader(r, japanese.ShiftJIS.NewDecoder()))
+	} else {
+		br = bufio.NewReader(r)
+		if bom, err := br.Peek(len(utf8BOM)); err == nil && string(bom) == string(utf8BOM) {
+			br.Discard(len(utf8BOM))
+		}
+	}
+
+	reader := csv.NewReader(br)
+	reader.FieldsPerRecord = expectedFields
+	if opts.Comma != 0 {
+		reader.Comma = opts.Comma
+	}
+
+	row := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		row++
+		if err != nil {
+			return fmt.Errorf("%s の %d 行目が不正です: %w", path, row, err)
+		}
+		for i, field := range record {
+			if strings.ContainsRune(field, 0) {
+				return fmt.Errorf("%s の %d 行目の %d 列目に NUL 文字が含まれています", path, row, i+1)
+			}
+		}
+	}
+
+	log.Printf("CSV検証完了: %s (%d 行, 各 %d 列)", path, row, expectedFields)
+	return nil
+}
+
+// AtomicFile は同じディレクトリの一時ファイルに書き込み、Commit で本来のパスへ置き換えるファイル。
+// 読み手が書き込み途中のファイルを目にすることはない
+type AtomicFile struct {
+	*os.File
+	path string
+	done bool
+}
+
+// CreateAtomic は path の置き換え用の一時ファイルを作成する
+func CreateAtomic(path string) (*AtomicFile, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("ファイル作成エラー (%s): %w", path, err)
+	}
+	return &AtomicFile{File: file, path: path}, nil
+}
+
+// Commit は一時ファイルを閉じ、本来のパスへリネームして確定させる
+func (f *AtomicFile) Commit() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("ファイルクローズエラー (%s): %w", f.path, err)
+	}
+	// os.CreateTemp は 0600 で作成するため、通常の os.Create と同じ権限に揃える
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("権限設定エラー (%s): %w", f.path, err)
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("ファイル置き換えエラー (%s): %w", f.path, err)
+	}
+	return nil
+}
+
+// Abort は一時ファイルを破棄する。Commit 済みの場合は何もしないため defer で呼び出せる
+func (f *AtomicFile) Abort() {
+	if f.done {
+		return
+	}
+	f.done = true
+
+	f.File.Close()
+	os.Remove(f.Name())
+}
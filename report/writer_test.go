@@ -0,0 +1,203 @@
+package report
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const previousOutput = "previous,output\n"
+
+// writePrevious は前回の実行結果に相当するファイルを作成する
+func writePrevious(t *testing.T, path string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(previousOutput), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// assertPrevious は path の内容が前回の出力のままであることを確認する
+func assertPrevious(t *testing.T, path string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("前回の出力が読めません: %v", err)
+	}
+	if string(got) != previousOutput {
+		t.Errorf("前回の出力が書き換えられています: %q", got)
+	}
+}
+
+// assertNoTempFiles は dir に一時ファイルが残っていないことを確認する
+func assertNoTempFiles(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".tmp-") {
+			t.Errorf("一時ファイルが残っています: %s", entry.Name())
+		}
+	}
+}
+
+func TestWriterCommitsOnClose(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.csv")
+	writePrevious(t, path)
+
+	w, err := Create(path, Options{Validate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range [][]string{{"id", "name"}, {"1", "alice"}} {
+		if err := w.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 確定前は前回の出力が見えていること
+	assertPrevious(t, path)
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "id,name\n1,alice\n"; string(got) != want {
+		t.Errorf("出力 = %q, want %q", got, want)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0644 {
+		t.Errorf("権限 = %o, want 644", perm)
+	}
+	assertNoTempFiles(t, dir)
+}
+
+func TestWriterWriteErrorKeepsPreviousOutput(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.csv")
+	writePrevious(t, path)
+
+	w, err := Create(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 下層のファイルを閉じておき、バッファのフラッシュ時に書き込みエラーを起こす
+	w.file.File.Close()
+	long := strings.Repeat("x", 8192)
+	w.Write([]string{"id", "name"})
+	w.Write([]string{"1", long})
+
+	if err := w.Close(); err == nil {
+		t.Fatal("書き込みエラーが Close で返されていません")
+	}
+	assertPrevious(t, path)
+	assertNoTempFiles(t, dir)
+}
+
+func TestWriterCommitErrorKeepsPreviousOutput(t *testing.T) {
+	dir := t.TempDir()
+	// 出力先が空でないディレクトリの場合、リネームに失敗する
+	path := filepath.Join(dir, "out.csv")
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writePrevious(t, filepath.Join(path, "keep.csv"))
+
+	w, err := Create(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]string{"id"})
+	if err := w.Close(); err == nil {
+		t.Fatal("リネームの失敗が Close で返されていません")
+	}
+	assertPrevious(t, filepath.Join(path, "keep.csv"))
+	assertNoTempFiles(t, dir)
+}
+
+func TestWriterValidateErrorKeepsPreviousOutput(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.csv")
+	writePrevious(t, path)
+
+	w, err := Create(path, Options{Validate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ヘッダーと列数の異なる行は検証で不正と判定される
+	w.Write([]string{"id", "name"})
+	w.Write([]string{"1", "alice", "extra"})
+
+	err = w.Close()
+	if err == nil || !strings.Contains(err.Error(), "2 行目") {
+		t.Fatalf("Close = %v, want 2 行目の検証エラー", err)
+	}
+	if !strings.Contains(err.Error(), path) {
+		t.Errorf("エラーに出力先のパスが含まれていません: %v", err)
+	}
+	assertPrevious(t, path)
+	assertNoTempFiles(t, dir)
+}
+
+func TestWriterAbortKeepsPreviousOutput(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.csv")
+	writePrevious(t, path)
+
+	w, err := Create(path, Options{BOM: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]string{"id", "name"})
+	w.Abort()
+	// Abort 後の Close は何もしない
+	if err := w.Close(); err != nil {
+		t.Errorf("Abort 後の Close: %v", err)
+	}
+	assertPrevious(t, path)
+	assertNoTempFiles(t, dir)
+}
+
+func TestSanitizeField(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{"=SUM(A1)", "'=SUM(A1)"},
+		{"@cmd", "'@cmd"},
+		{"\tx", "'\tx"},
+		{"\rx", "'\rx"},
+		{"+cmd", "'+cmd"},
+		{"-cmd", "'-cmd"},
+		{"-1", "-1"},
+		{"-0.5", "-0.5"},
+		{"+09:00", "+09:00"},
+		{"-", "-"},
+		{"+", "+"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeField(tt.in); got != tt.want {
+			t.Errorf("sanitizeField(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestOptionsFromEnvSanitizeIsOptIn(t *testing.T) {
+	t.Setenv("CSV_SANITIZE", "")
+	if OptionsFromEnv().Sanitize {
+		t.Error("CSV_SANITIZE 未設定でサニタイズが有効になっています")
+	}
+	t.Setenv("CSV_SANITIZE", "true")
+	if !OptionsFromEnv().Sanitize {
+		t.Error("CSV_SANITIZE=true でサニタイズが有効になっていません")
+	}
+}